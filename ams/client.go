@@ -0,0 +1,313 @@
+package ams
+
+/*
+
+Client for the AMS web services used to load the repository of an airport. Flights are
+retrieved with the SOAP GetFlights operation of the AMS Integration Service and the fixed
+resources from the AMS REST API. Every call has a timeout and transient failures are retried
+with an exponential backoff
+
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/monitoring"
+)
+
+const getFlightsTemplateBody = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:ams6="http://www.sita.aero/ams6-xml-api-webservice">
+<soapenv:Header/>
+<soapenv:Body>
+   <ams6:GetFlights>
+	  <!--Optional:-->
+	  <ams6:sessionToken>%s</ams6:sessionToken>
+	  <!--Optional:-->
+	  <ams6:from>%sT00:00:00</ams6:from>
+	  <!--Optional:-->
+	  <ams6:to>%sT00:00:00</ams6:to>
+	  <!--Optional:-->
+	  <ams6:airport>%s</ams6:airport>
+	  <!--Optional:-->
+   </ams6:GetFlights>
+</soapenv:Body>
+</soapenv:Envelope>`
+
+const getAirportsTemplateBody = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:ams6="http://www.sita.aero/ams6-xml-api-webservice">
+<soapenv:Header/>
+<soapenv:Body>
+   <ams6:GetAirports>
+	  <!--Optional:-->
+	  <ams6:sessionToken>%s</ams6:sessionToken>
+   </ams6:GetAirports>
+</soapenv:Body>
+</soapenv:Envelope>`
+
+const soapActionPrefix = "http://www.sita.aero/ams6-xml-api-webservice/IAMSIntegrationService/"
+
+// The operations recorded in the metrics
+const (
+	GetFlightsOperation        = "GetFlights"
+	GetAirportsOperation       = "GetAirports"
+	GetFixedResourcesOperation = "GetFixedResources"
+)
+
+// Client is the access to AMS used to load and refresh the repository of an airport
+type Client interface {
+	// GetAirports calls the SOAP GetAirports operation. Used to check the SOAP service is available
+	GetAirports(ctx context.Context) error
+	// GetFlights returns the flights of the airport with a scheduled date of operation from "from" up to "to"
+	GetFlights(ctx context.Context, from, to time.Time) ([]models.Flight, error)
+	// GetFixedResources returns the resources of the type (CheckIns, Stands, Gates, Carousels or Chutes)
+	GetFixedResources(ctx context.Context, resourceType string) ([]models.FixedResource, error)
+	// Metrics returns the metrics of the calls made by the client, by operation
+	Metrics() map[string]OperationMetrics
+}
+
+// Config is the AMS connection of an airport and the timeout and retry policy of the calls
+type Config struct {
+	Airport        string
+	SOAPServiceURL string
+	RestServiceURL string
+	Token          string
+
+	// Timeout of each attempt of a SOAP call. GetFlights responses can be large
+	SOAPTimeout time.Duration
+	// Timeout of each attempt of a REST call
+	RestTimeout time.Duration
+	// Number of times a call is retried after a transient failure
+	MaxRetries int
+	// Wait before the first retry. Doubled for each subsequent retry
+	RetryBackoff time.Duration
+}
+
+// ConfigFromRepository returns the configuration of the AMS client for the repository,
+// with the timeouts and retry policy from service.json
+func ConfigFromRepository(repo *models.Repository) Config {
+
+	config := Config{
+		Airport:        repo.AMSAirport,
+		SOAPServiceURL: repo.AMSSOAPServiceURL,
+		RestServiceURL: repo.AMSRestServiceURL,
+		Token:          repo.AMSToken,
+		SOAPTimeout:    configSeconds("AMSSOAPTimeoutInSeconds", 300),
+		RestTimeout:    configSeconds("AMSRestTimeoutInSeconds", 30),
+		MaxRetries:     3,
+		RetryBackoff:   time.Duration(globals.ConfigViper.GetInt("AMSRetryBackoffInMilliseconds")) * time.Millisecond,
+	}
+
+	if globals.ConfigViper.IsSet("AMSMaxRetries") {
+		config.MaxRetries = globals.ConfigViper.GetInt("AMSMaxRetries")
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
+
+	return config
+}
+
+func configSeconds(key string, defaultSeconds int) time.Duration {
+	secs := globals.ConfigViper.GetInt(key)
+	if secs <= 0 {
+		secs = defaultSeconds
+	}
+	return time.Duration(secs) * time.Second
+}
+
+type httpClient struct {
+	config  Config
+	client  *http.Client
+	metrics *metrics
+}
+
+// NewClient returns a client that calls the AMS web services described by the config
+func NewClient(config Config) Client {
+	return &httpClient{
+		config:  config,
+		client:  &http.Client{},
+		metrics: newMetrics(),
+	}
+}
+
+func (c *httpClient) GetAirports(ctx context.Context) error {
+
+	body := fmt.Sprintf(getAirportsTemplateBody, c.config.Token)
+	_, err := c.call(ctx, GetAirportsOperation, c.config.SOAPTimeout, true, func(ctx context.Context) (*http.Request, error) {
+		return c.soapRequest(ctx, GetAirportsOperation, body)
+	})
+	return err
+}
+
+func (c *httpClient) GetFlights(ctx context.Context, from, to time.Time) ([]models.Flight, error) {
+
+	body := fmt.Sprintf(getFlightsTemplateBody, c.config.Token, from.Format("2006-01-02"), to.Format("2006-01-02"), c.config.Airport)
+	resBody, err := c.call(ctx, GetFlightsOperation, c.config.SOAPTimeout, true, func(ctx context.Context) (*http.Request, error) {
+		return c.soapRequest(ctx, GetFlightsOperation, body)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var envel models.Envelope
+	if err := xml.Unmarshal(resBody, &envel); err != nil {
+		return nil, fmt.Errorf("AMS %s for %s: could not read response: %w", GetFlightsOperation, c.config.Airport, err)
+	}
+
+	return envel.Body.GetFlightsResponse.GetFlightsResult.WebServiceResult.ApiResponse.Data.Flights.Flight, nil
+}
+
+func (c *httpClient) GetFixedResources(ctx context.Context, resourceType string) ([]models.FixedResource, error) {
+
+	url := c.config.RestServiceURL + "/" + c.config.Airport + "/" + resourceType
+	resBody, err := c.call(ctx, GetFixedResourcesOperation, c.config.RestTimeout, false, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", c.config.Token)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var resources models.FixedResources
+	if err := xml.Unmarshal(resBody, &resources); err != nil {
+		return nil, fmt.Errorf("AMS %s %s for %s: could not read response: %w", GetFixedResourcesOperation, resourceType, c.config.Airport, err)
+	}
+
+	return resources.Values, nil
+}
+
+func (c *httpClient) Metrics() map[string]OperationMetrics {
+	return c.metrics.snapshot()
+}
+
+func (c *httpClient) soapRequest(ctx context.Context, operation, body string) (*http.Request, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.SOAPServiceURL, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "text/xml;charset=UTF-8")
+	req.Header.Add("SOAPAction", soapActionPrefix+operation)
+	return req, nil
+}
+
+// call makes the request, retrying transient failures with an exponential backoff, and returns the response body.
+// newRequest is called for every attempt with a context that carries the timeout of the attempt
+func (c *httpClient) call(ctx context.Context, operation string, timeout time.Duration, soap bool, newRequest func(context.Context) (*http.Request, error)) ([]byte, error) {
+
+	start := time.Now()
+
+	var body []byte
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		body, err = c.attempt(ctx, operation, timeout, soap, newRequest)
+		if err == nil || attempt >= c.config.MaxRetries || !isRetryable(err) || ctx.Err() != nil {
+			break
+		}
+
+		backoff := c.config.RetryBackoff << attempt
+		c.metrics.retry(operation)
+		monitoring.AMSRetries.WithLabelValues(c.config.Airport, operation).Inc()
+		globals.Logger.Warn(fmt.Sprintf("AMS %s for %s failed. Retrying in %s: %s", operation, c.config.Airport, backoff, err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	elapsed := time.Since(start)
+	c.metrics.record(operation, elapsed, err)
+	monitoring.AMSRequestDuration.WithLabelValues(c.config.Airport, operation).Observe(elapsed.Seconds())
+	if err != nil {
+		monitoring.AMSRequestErrors.WithLabelValues(c.config.Airport, operation, errorReason(err)).Inc()
+	}
+	globals.MetricsLogger.Info(fmt.Sprintf("AMS %s for %s took %s", operation, c.config.Airport, elapsed))
+
+	return body, err
+}
+
+func (c *httpClient) attempt(ctx context.Context, operation string, timeout time.Duration, soap bool, newRequest func(context.Context) (*http.Request, error)) ([]byte, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := newRequest(ctx)
+	if err != nil {
+		return nil, &RequestError{Operation: operation, Err: err}
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// SOAP faults are returned with a status of 500
+	if soap {
+		if fault := parseSOAPFault(body); fault != nil {
+			fault.Operation = operation
+			fault.StatusCode = res.StatusCode
+			return nil, fault
+		}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &StatusError{Operation: operation, StatusCode: res.StatusCode, Body: truncate(string(body), 512)}
+	}
+
+	return body, nil
+}
+
+// isRetryable reports whether the failure may be transient. Connection failures, timeouts and
+// server errors are retried. SOAP faults, client errors and invalid requests are not
+func isRetryable(err error) bool {
+
+	var fault *SOAPFault
+	if errors.As(err, &fault) {
+		return false
+	}
+
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 ||
+			statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode == http.StatusRequestTimeout
+	}
+
+	return true
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,89 @@
+package ams
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// SOAPFault is returned when AMS responds to a SOAP request with a fault
+type SOAPFault struct {
+	Operation  string
+	StatusCode int
+	Code       string
+	String     string
+	Detail     string
+}
+
+func (f *SOAPFault) Error() string {
+	return fmt.Sprintf("AMS %s returned SOAP fault %s: %s", f.Operation, f.Code, f.String)
+}
+
+// StatusError is returned when AMS responds with an HTTP status other than 200 and no SOAP fault
+type StatusError struct {
+	Operation  string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("AMS %s returned status code %d", e.Operation, e.StatusCode)
+}
+
+// RequestError is returned when the request to AMS could not be created. Usually a misconfigured URL
+type RequestError struct {
+	Operation string
+	Err       error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("AMS %s: could not create request: %s", e.Operation, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// IsTimeout reports whether the call failed because AMS did not respond in time
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+type soapFaultEnvelope struct {
+	Body struct {
+		Fault *struct {
+			Code   string `xml:"faultcode"`
+			String string `xml:"faultstring"`
+			Detail struct {
+				Content string `xml:",innerxml"`
+			} `xml:"detail"`
+		} `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+// parseSOAPFault returns the fault in the SOAP response, or nil if the response is not a fault
+func parseSOAPFault(body []byte) *SOAPFault {
+
+	// Avoid parsing large flight responses a second time
+	if !bytes.Contains(body, []byte("Fault>")) {
+		return nil
+	}
+
+	var envel soapFaultEnvelope
+	if err := xml.Unmarshal(body, &envel); err != nil || envel.Body.Fault == nil {
+		return nil
+	}
+
+	return &SOAPFault{
+		Code:   envel.Body.Fault.Code,
+		String: envel.Body.Fault.String,
+		Detail: string(bytes.TrimSpace([]byte(envel.Body.Fault.Detail.Content))),
+	}
+}
@@ -0,0 +1,113 @@
+package ams
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// OperationMetrics are the counts and latencies of the calls to an AMS operation.
+// A call that succeeds after retries counts as one successful call
+type OperationMetrics struct {
+	Calls            int64
+	Failures         int64
+	Retries          int64
+	SOAPFaults       int64
+	Timeouts         int64
+	AverageLatencyMS int64
+	MaxLatencyMS     int64
+	LastError        string
+	LastErrorTime    time.Time
+}
+
+type metrics struct {
+	mu           sync.Mutex
+	byOperation  map[string]*OperationMetrics
+	totalLatency map[string]time.Duration
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		byOperation:  make(map[string]*OperationMetrics),
+		totalLatency: make(map[string]time.Duration),
+	}
+}
+
+// get must be called while holding the lock
+func (m *metrics) get(operation string) *OperationMetrics {
+	op := m.byOperation[operation]
+	if op == nil {
+		op = &OperationMetrics{}
+		m.byOperation[operation] = op
+	}
+	return op
+}
+
+func (m *metrics) retry(operation string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.get(operation).Retries++
+}
+
+func (m *metrics) record(operation string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op := m.get(operation)
+	op.Calls++
+
+	m.totalLatency[operation] += elapsed
+	op.AverageLatencyMS = (m.totalLatency[operation] / time.Duration(op.Calls)).Milliseconds()
+	if elapsed.Milliseconds() > op.MaxLatencyMS {
+		op.MaxLatencyMS = elapsed.Milliseconds()
+	}
+
+	if err == nil {
+		return
+	}
+
+	op.Failures++
+	op.LastError = err.Error()
+	op.LastErrorTime = time.Now()
+
+	var fault *SOAPFault
+	if errors.As(err, &fault) {
+		op.SOAPFaults++
+	}
+	if IsTimeout(err) {
+		op.Timeouts++
+	}
+}
+
+func (m *metrics) snapshot() map[string]OperationMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]OperationMetrics, len(m.byOperation))
+	for operation, op := range m.byOperation {
+		snapshot[operation] = *op
+	}
+	return snapshot
+}
+
+// errorReason classifies a failed call for the Prometheus metrics
+func errorReason(err error) string {
+
+	var fault *SOAPFault
+	var reqErr *RequestError
+	var statusErr *StatusError
+
+	switch {
+	case errors.As(err, &fault):
+		return "soap_fault"
+	case IsTimeout(err):
+		return "timeout"
+	case errors.As(err, &reqErr):
+		return "request"
+	case errors.As(err, &statusErr):
+		return "status"
+	default:
+		return "connection"
+	}
+}
@@ -19,14 +19,8 @@ func demo() {
 	go server.StartGinServer(true)
 	go eventMonitor()
 
-	// // Initiate the User Change Subscriptions
-	globals.UserChangeSubscriptionsMutex.Lock()
-	for _, up := range globals.GetUserProfiles() {
-		if up.Enabled {
-			globals.UserChangeSubscriptions = append(globals.UserChangeSubscriptions, up.UserChangeSubscriptions...)
-		}
-	}
-	globals.UserChangeSubscriptionsMutex.Unlock()
+	// Initiate the User Change Subscriptions
+	repo.RefreshChangeSubscriptions()
 
 	repo.StartChangePushWorkerPool(globals.ConfigViper.GetInt("NumberOfChangePushWorkers"))
 	repo.PerfTestInit()
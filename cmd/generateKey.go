@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"fmt"
+
+	"flightresourcerestapi/repo"
+
+	"github.com/spf13/cobra"
+)
+
+var generateKeyCmd = &cobra.Command{
+	Use:   "generateKey",
+	Short: `Generate a user key and its hash for users.json`,
+	Long:  "\nGenerates a new random user key. Give the key to the user and put the KeyPrefix and KeyHash in their entry in users.json in place of the Key,\nso the key itself is not stored on the server",
+	Run: func(cmds *cobra.Command, args []string) {
+		key, prefix := repo.GenerateAPIKey()
+		fmt.Printf("Key:       %s\n", key)
+		fmt.Printf("KeyPrefix: %s\n", prefix)
+		fmt.Printf("KeyHash:   %s\n", repo.HashAPIKey(key))
+	},
+}
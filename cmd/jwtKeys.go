@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/jwtauth"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	jwksFileName        = "jwks.json"
+	jwtSigningKeyName   = "jwt-signing-key.pem"
+	defaultTokenMinutes = 60
+)
+
+var generateJWKSCmd = &cobra.Command{
+	Use:   "generateJWKS {directory}",
+	Short: `Generate a local key set for bearer tokens`,
+	Long:  "\nGenerates an RSA signing key and writes it to " + jwtSigningKeyName + " and its public key set to " + jwksFileName + " in the directory\n(default the current directory). Set JWTJWKSFile in service.json to the key set and use issueToken to create tokens for testing",
+	Run: func(cmds *cobra.Command, args []string) {
+		dir := "."
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		if err := generateJWKS(dir); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var issueTokenCmd = &cobra.Command{
+	Use:   "issueToken {signing key file} {client id} {roles} {airlines} {minutes valid}",
+	Short: `Issue a bearer token signed with a local key`,
+	Long:  "\nIssues a bearer token for the client signed with a key created by generateJWKS. Roles and airlines are comma separated lists,\n\"-\" for none. The token is valid for 60 minutes unless the minutes are given. The issuer and audience are JWTIssuer and JWTAudience from service.json",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmds *cobra.Command, args []string) {
+		token, err := issueToken(args)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(token)
+	},
+}
+
+func generateJWKS(dir string) error {
+
+	key, err := jwtauth.GenerateKey()
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	jwks, err := jwtauth.PublicKeySet(key)
+	if err != nil {
+		return err
+	}
+
+	keyFile := filepath.Join(dir, jwtSigningKeyName)
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	jwksFile := filepath.Join(dir, jwksFileName)
+	if err := os.WriteFile(jwksFile, jwks, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Signing key: %s\nKey set:     %s\nKey ID:      %s\n", keyFile, jwksFile, jwtauth.KeyID(&key.PublicKey))
+	return nil
+}
+
+func issueToken(args []string) (string, error) {
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", errors.New("the signing key file is not a PEM file")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("the signing key is not an RSA key")
+	}
+
+	minutes := defaultTokenMinutes
+	if len(args) > 4 {
+		if minutes, err = strconv.Atoi(args[4]); err != nil {
+			return "", fmt.Errorf("invalid minutes %s", args[4])
+		}
+	}
+
+	now := time.Now()
+	claims := jwtauth.Claims{
+		"sub": args[1],
+		"iat": now.Unix(),
+		"exp": now.Add(time.Duration(minutes) * time.Minute).Unix(),
+	}
+	claims[claimName("JWTClientIDClaim", "client_id")] = args[1]
+	if issuer := globals.ConfigViper.GetString("JWTIssuer"); issuer != "" {
+		claims["iss"] = issuer
+	}
+	if audience := globals.ConfigViper.GetString("JWTAudience"); audience != "" {
+		claims["aud"] = audience
+	}
+	if len(args) > 2 && args[2] != "-" {
+		claims[claimName("JWTRolesClaim", "roles")] = strings.Split(args[2], ",")
+	}
+	if len(args) > 3 && args[3] != "-" {
+		claims[claimName("JWTAirlineClaim", "airline")] = strings.Split(args[3], ",")
+	}
+
+	return jwtauth.Sign(claims, key)
+}
+
+func claimName(key, defaultName string) string {
+	if name := globals.ConfigViper.GetString(key); name != "" {
+		return name
+	}
+	return defaultName
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/mockams"
+
+	"github.com/spf13/cobra"
+)
+
+var mockAMSCmd = &cobra.Command{
+	Use:   "mockams {listen address} {rotations per day} {notification interval in seconds}",
+	Short: `Run a mock AMS for development and testing`,
+	Long:  "\nServes the AMS SOAP GetFlights and GetAirports operations and the REST fixed resource endpoints from a schedule generated from the airport, airlines, routes and resource areas in test.json\nFlight Created, Updated and Deleted notifications built from arrival.template.xml and departure.template.xml are published to the RabbitMQ exchange configured in test.json\nPoint the \"AMSSOAPServiceURL\" and \"AMSRestServiceURL\" of the airport in airports.json at the mock and start the service with \"run\"\nThe listen address defaults to localhost:8090, the rotations (arrival and departure pairs) per day to 100 and the notification interval to 10 seconds. An interval of 0 disables notifications",
+	Run: func(cmds *cobra.Command, args []string) {
+		addr := "localhost:8090"
+		rotations := 100
+		interval := 10
+		if len(args) > 0 {
+			addr = args[0]
+		}
+		if len(args) > 1 {
+			if n, err := strconv.Atoi(args[1]); err == nil && n > 0 {
+				rotations = n
+			}
+		}
+		if len(args) > 2 {
+			if n, err := strconv.Atoi(args[2]); err == nil && n >= 0 {
+				interval = n
+			}
+		}
+		mockAMS(addr, rotations, time.Duration(interval)*time.Second)
+	},
+}
+
+func mockAMS(addr string, rotations int, interval time.Duration) {
+
+	server, err := mockams.NewServer(rotations)
+	if err != nil {
+		fmt.Printf("Could not start the mock AMS: %s\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if interval > 0 {
+		publisher, err := server.NewRabbitMQPublisher()
+		if err != nil {
+			globals.Logger.Warn(fmt.Sprintf("Mock AMS: notifications disabled: %s", err))
+		} else {
+			defer publisher.Close()
+			go server.EmitNotifications(ctx, publisher, interval)
+		}
+	}
+
+	fmt.Printf("Mock AMS for %s serving %d flights on http://%s\n", server.Airport(), server.NumberOfFlights(), addr)
+	fmt.Printf("Configure the airport in airports.json with\n")
+	fmt.Printf("    \"AMSAirport\": \"%s\",\n", server.Airport())
+	fmt.Printf("    \"AMSSOAPServiceURL\": \"http://%s/SITAAMSIntegrationService/v2/SITAAMSIntegrationService\",\n", addr)
+	fmt.Printf("    \"AMSRestServiceURL\": \"http://%s/api/v1\",\n", addr)
+	fmt.Printf("and the AMSToken and RabbitMQ settings from test.json\n")
+
+	if err := server.ListenAndServe(ctx, addr); err != nil {
+		fmt.Printf("Mock AMS stopped: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -27,13 +27,7 @@ func perfTest() {
 	go eventMonitor()
 
 	// Initiate the User Change Subscriptions
-	globals.UserChangeSubscriptionsMutex.Lock()
-	for _, up := range globals.GetUserProfiles() {
-		if up.Enabled {
-			globals.UserChangeSubscriptions = append(globals.UserChangeSubscriptions, up.UserChangeSubscriptions...)
-		}
-	}
-	globals.UserChangeSubscriptionsMutex.Unlock()
+	repo.RefreshChangeSubscriptions()
 	go repo.SchedulePushes("APT", false)
 	repo.StartChangePushWorkerPool(globals.ConfigViper.GetInt("NumberOfChangePushWorkers"))
 	repo.PerfTestInit()
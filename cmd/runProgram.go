@@ -17,6 +17,10 @@ func runProgram() {
 	globals.Logger.Debug(fmt.Sprintf("Number of cores available = %v", numCPU))
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	// Spans are recorded from the start so the initial load and first requests are traced
+	startTracing()
+
 	//Wait group so the program doesn't exit
 	globals.Wg.Add(1)
 
@@ -30,12 +34,6 @@ func runProgram() {
 	go repo.InitRepositories()
 
 	// Initiate the User Change Subscriptions
-	globals.UserChangeSubscriptionsMutex.Lock()
-	for _, up := range globals.GetUserProfiles() {
-		if up.Enabled {
-			globals.UserChangeSubscriptions = append(globals.UserChangeSubscriptions, up.UserChangeSubscriptions...)
-		}
-	}
-	globals.UserChangeSubscriptionsMutex.Unlock()
+	repo.RefreshChangeSubscriptions()
 	globals.Wg.Wait()
 }
@@ -3,7 +3,6 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"strings"
 	"time"
 
 	"flightresourcerestapi/globals"
@@ -11,8 +10,6 @@ import (
 	"flightresourcerestapi/version"
 
 	"github.com/spf13/cobra"
-	"golang.org/x/sys/windows/svc"
-	"golang.org/x/sys/windows/svc/debug"
 )
 
 func InitCobra() {
@@ -28,6 +25,10 @@ func InitCobra() {
 	rootCmd.AddCommand(removeCmd)
 	rootCmd.AddCommand(startCmd)
 	rootCmd.AddCommand(stopCmd)
+	rootCmd.AddCommand(mockAMSCmd)
+	rootCmd.AddCommand(generateKeyCmd)
+	rootCmd.AddCommand(generateJWKSCmd)
+	rootCmd.AddCommand(issueTokenCmd)
 }
 func ExecuteCobra() {
 	err := rootCmd.Execute()
@@ -72,61 +73,6 @@ var perfTestCmd = &cobra.Command{
 	},
 }
 
-type exampleService struct{}
-
-func (m *exampleService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
-
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
-	changes <- svc.Status{State: svc.StartPending}
-
-	go runProgram()
-	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
-
-loop:
-	for {
-
-		select {
-
-		case c := <-r:
-			switch c.Cmd {
-			case svc.Interrogate:
-				changes <- c.CurrentStatus
-				// Testing deadlock from https://code.google.com/p/winsvc/issues/detail?id=4
-				time.Sleep(100 * time.Millisecond)
-				changes <- c.CurrentStatus
-			case svc.Stop, svc.Shutdown:
-				// golang.org/x/sys/windows/svc.TestExample is verifying this output.
-				testOutput := strings.Join(args, "-")
-				testOutput += fmt.Sprintf("-%d", c.Context)
-				globals.Logger.Debug(testOutput)
-
-				//Stop the Servers
-				globals.Wg.Done()
-				break loop
-			default:
-				globals.Logger.Error(fmt.Sprintf("unexpected control request #%d", c))
-			}
-		}
-	}
-	changes <- svc.Status{State: svc.StopPending}
-	return
-}
-func RunService(name string, isDebug bool) {
-	var err error
-
-	globals.Logger.Info(fmt.Sprintf("Starting %s service", name))
-	run := svc.Run
-	if isDebug {
-		run = debug.Run
-	}
-	err = run(name, &exampleService{})
-	if err != nil {
-		globals.Logger.Info(fmt.Sprintf("%s service failed: %v", name, err))
-		return
-	}
-	globals.Logger.Info(fmt.Sprintf("%s service stopped", name))
-}
-
 func eventMonitor() {
 
 	//Acts as an exchange between events and action to be taken on those events
@@ -138,12 +84,12 @@ func eventMonitor() {
 			globals.Logger.Trace(fmt.Sprintf("FlightUpdated: %s", flightChanMesage.FlightID))
 			go repo.HandleFlightUpdate(flightChanMesage)
 
-		case flight := <-globals.FlightDeletedChannel:
+		case flightChanMesage := <-globals.FlightDeletedChannel:
 
-			globals.Logger.Trace(fmt.Sprintf("FlightDeleted: %s", flight.GetFlightID()))
-			go repo.HandleFlightDelete(flight)
+			globals.Logger.Trace(fmt.Sprintf("FlightDeleted: %s", flightChanMesage.Flight.GetFlightID()))
+			go repo.HandleFlightDelete(flightChanMesage)
 
-		case flightChanMesage := <-globals.FlightUpdatedChannel:
+		case flightChanMesage := <-globals.FlightCreatedChannel:
 
 			globals.Logger.Trace(fmt.Sprintf("FlightCreated: %s", flightChanMesage.FlightID))
 			go repo.HandleFlightCreate(flightChanMesage)
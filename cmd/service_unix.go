@@ -0,0 +1,143 @@
+//go:build !windows
+
+package cmd
+
+/*
+
+Running as a systemd service. The unit generated by "install" starts the executable without
+arguments and main hands over to RunService. Readiness, reloads and the watchdog are reported
+to systemd with sd_notify
+
+*/
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/repo"
+	"flightresourcerestapi/tracing"
+)
+
+// InService reports whether the process was started by systemd as the main process of a service
+func InService() (bool, error) {
+	return os.Getenv("INVOCATION_ID") != "" && os.Getppid() == 1, nil
+}
+
+func RunService(name string, isDebug bool) {
+
+	globals.Logger.Info(fmt.Sprintf("Starting %s service", name))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	go runProgram()
+
+	// Only ready once every airport has completed its first load
+	go func() {
+		<-repo.RepositoriesReady()
+		// The first load is abandoned if the service is stopped while waiting for AMS
+		if globals.Ctx.Err() != nil {
+			return
+		}
+		globals.Logger.Info(fmt.Sprintf("%s service ready", name))
+		sdNotify("READY=1")
+	}()
+
+	go watchdog()
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			globals.Logger.Info("SIGHUP received. Reloading configuration")
+			globals.ReloadConfig()
+		default:
+			globals.Logger.Info(fmt.Sprintf("%s received. Stopping %s service", sig, name))
+			sdNotify("STOPPING=1")
+
+			//Stop the Servers, listeners, schedulers and push workers
+			globals.Shutdown()
+			tracing.Shutdown()
+			globals.Wg.Done()
+			globals.Logger.Info(fmt.Sprintf("%s service stopped", name))
+			return
+		}
+	}
+}
+
+// sdNotify sends the state to systemd. Does nothing if not started by systemd with a notify socket
+func sdNotify(state string) {
+
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	// A socket name starting with "@" is in the abstract namespace, which the net package handles
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("sd_notify: could not connect to %s: %s", socket, err))
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		globals.Logger.Error(fmt.Sprintf("sd_notify: could not send %s: %s", state, err))
+	}
+}
+
+// watchdog pings the systemd watchdog at half the interval configured by WatchdogSec in the unit.
+// Each ping needs a health report of the repositories produced within the interval, so the service
+// is restarted if it is deadlocked rather than only if the process has gone
+func watchdog() {
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	globals.Logger.Info(fmt.Sprintf("systemd watchdog enabled. Notifying every %s", interval))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if alive(interval) {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+var livenessCheck chan struct{}
+
+// alive reports whether the health report of the repositories was produced within the timeout. It
+// takes the locks of every repository and reads the push outbox, which a deadlock would hold up. A
+// check that has not completed is waited for rather than starting another one
+func alive(timeout time.Duration) bool {
+
+	if livenessCheck == nil {
+		livenessCheck = make(chan struct{})
+		go func(done chan struct{}) {
+			repo.HealthReport()
+			close(done)
+		}(livenessCheck)
+	}
+
+	select {
+	case <-livenessCheck:
+		livenessCheck = nil
+		return true
+	case <-time.After(timeout):
+		globals.Logger.Warn(fmt.Sprintf("systemd watchdog not notified. The health report was not produced within %s", timeout))
+		return false
+	}
+}
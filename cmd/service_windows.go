@@ -0,0 +1,83 @@
+package cmd
+
+/*
+
+Running as a Windows Service. The service control manager starts the executable without
+arguments and main hands over to RunService
+
+*/
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/tracing"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/debug"
+)
+
+// InService reports whether the process was started by the Windows service control manager
+func InService() (bool, error) {
+	return svc.IsWindowsService()
+}
+
+type exampleService struct{}
+
+func (m *exampleService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
+
+	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
+	changes <- svc.Status{State: svc.StartPending}
+
+	go runProgram()
+	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+
+loop:
+	for {
+
+		select {
+
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+				// Testing deadlock from https://code.google.com/p/winsvc/issues/detail?id=4
+				time.Sleep(100 * time.Millisecond)
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// golang.org/x/sys/windows/svc.TestExample is verifying this output.
+				testOutput := strings.Join(args, "-")
+				testOutput += fmt.Sprintf("-%d", c.Context)
+				globals.Logger.Debug(testOutput)
+
+				//Stop the Servers, listeners, schedulers and push workers
+				changes <- svc.Status{State: svc.StopPending, WaitHint: uint32((globals.ShutdownTimeout() + 5*time.Second) / time.Millisecond)}
+				globals.Shutdown()
+				tracing.Shutdown()
+				globals.Wg.Done()
+				break loop
+			default:
+				globals.Logger.Error(fmt.Sprintf("unexpected control request #%d", c))
+			}
+		}
+	}
+	changes <- svc.Status{State: svc.StopPending}
+	return
+}
+func RunService(name string, isDebug bool) {
+	var err error
+
+	globals.Logger.Info(fmt.Sprintf("Starting %s service", name))
+	run := svc.Run
+	if isDebug {
+		run = debug.Run
+	}
+	err = run(name, &exampleService{})
+	if err != nil {
+		globals.Logger.Info(fmt.Sprintf("%s service failed: %v", name, err))
+		return
+	}
+	globals.Logger.Info(fmt.Sprintf("%s service stopped", name))
+}
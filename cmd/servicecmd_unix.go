@@ -0,0 +1,124 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"flightresourcerestapi/globals"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const systemdUnitDirectory = "/etc/systemd/system"
+
+// The start timeout is disabled because readiness is only reported once the first load from AMS
+// has completed, and the service waits for AMS to be available. The stop timeout allows for the
+// shutdown deadline of the service
+const systemdUnitTemplate = `[Unit]
+Description=%s
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+WorkingDirectory=%s
+Restart=on-failure
+RestartSec=5
+TimeoutStartSec=infinity
+TimeoutStopSec=%d
+WatchdogSec=%d
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func systemdUnitPath(name string) string {
+	return filepath.Join(systemdUnitDirectory, name+".service")
+}
+
+// systemdPath escapes the specifiers systemd expands in a path
+func systemdPath(path string) string {
+	return strings.ReplaceAll(path, "%", "%%")
+}
+
+// systemdQuote quotes the path as a command line argument, so a path with spaces, quotes, "$" or "%"
+// is started as it is
+func systemdQuote(path string) string {
+	path = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$").Replace(systemdPath(path))
+	return `"` + path + `"`
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %v failed: %s %s", args, err, out)
+	}
+	return nil
+}
+
+// installService generates the systemd unit for the service from service.json and enables it
+func installService(name, displayName, desc string) error {
+	exepath, err := globals.ExePath()
+	if err != nil {
+		return err
+	}
+
+	unitPath := systemdUnitPath(name)
+	if _, err := os.Stat(unitPath); err == nil {
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	if desc == "" {
+		desc = displayName
+	}
+	watchdogSec := globals.ConfigViper.GetInt("SystemdWatchdogSeconds")
+	if watchdogSec <= 0 {
+		watchdogSec = 30
+	}
+
+	stopSec := int(globals.ShutdownTimeout().Seconds()) + 10
+
+	unit := fmt.Sprintf(systemdUnitTemplate, desc, systemdQuote(exepath), systemdPath(filepath.Dir(exepath)), stopSec, watchdogSec)
+	if err := os.WriteFile(unitPath, []byte(unit), 0644); err != nil {
+		return err
+	}
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl("enable", name); err != nil {
+		return err
+	}
+
+	fmt.Printf("Installed %s\n", unitPath)
+	return nil
+}
+func removeService(name string) error {
+	unitPath := systemdUnitPath(name)
+	if _, err := os.Stat(unitPath); err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+
+	// The service may already be stopped and disabled
+	systemctl("stop", name)
+	systemctl("disable", name)
+
+	if err := os.Remove(unitPath); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+func startService(name string) error {
+	return systemctl("start", name)
+}
+func stopService(name string) error {
+	return systemctl("stop", name)
+}
+func amAdmin() bool {
+	return os.Geteuid() == 0
+}
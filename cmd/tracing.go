@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/tracing"
+	"flightresourcerestapi/version"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// startTracing sets up the exporter of the trace spans from TracingExporter in service.json
+func startTracing() {
+
+	exporter := globals.ConfigViper.GetString("TracingExporter")
+
+	serviceName := globals.ConfigViper.GetString("TracingServiceName")
+	if serviceName == "" {
+		serviceName = "flightresourcerestapi"
+	}
+	sampleRatio := 1.0
+	if globals.ConfigViper.IsSet("TracingSampleRatio") {
+		sampleRatio = globals.ConfigViper.GetFloat64("TracingSampleRatio")
+	}
+
+	config := tracing.Config{
+		Exporter:     exporter,
+		ServiceName:  serviceName,
+		Version:      version.Version,
+		OTLPEndpoint: globals.ConfigViper.GetString("TracingOTLPEndpoint"),
+		OTLPInsecure: globals.ConfigViper.GetBool("TracingOTLPInsecure"),
+		OTLPHeaders:  globals.ConfigViper.GetStringMapString("TracingOTLPHeaders"),
+		SampleRatio:  sampleRatio,
+	}
+	if file := globals.ConfigViper.GetString("TracingFile"); file != "" {
+		config.File = &lumberjack.Logger{
+			Filename:   file,
+			MaxSize:    globals.ConfigViper.GetInt("MaxLogFileSizeInMB"), // megabytes
+			MaxBackups: globals.ConfigViper.GetInt("MaxNumberLogFiles"),
+			MaxAge:     28,   //days
+			Compress:   true, // disabled by default
+		}
+	}
+
+	if err := tracing.Start(config); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not start tracing. Spans will not be recorded: %s", err))
+		return
+	}
+	if exporter != "" && exporter != tracing.ExporterNone {
+		globals.Logger.Info(fmt.Sprintf("Tracing enabled. Exporter: %s Sample ratio: %v", exporter, sampleRatio))
+	}
+}
@@ -14,10 +14,11 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-var RepoList []models.Repository
+var RepoList []*models.Repository
 var Wg sync.WaitGroup
 
-var MapMutex = &sync.RWMutex{}
+// Guards RepoList. Each repository has its own lock for its content
+var RepoListMutex = &sync.RWMutex{}
 
 // var serviceConfig ServiceConfig
 var IsDebug bool = false
@@ -25,6 +26,7 @@ var IsDebug bool = false
 var Logger = logrus.New()
 var RequestLogger = logrus.New()
 var MetricsLogger = logrus.New()
+var AuditLogger = logrus.New()
 
 var ConfigViper = viper.New()
 var UserViper = viper.New()
@@ -35,10 +37,16 @@ const CreateAction = "CREATE"
 const DeleteAction = "DELETE"
 const StatusAction = "STATUS"
 
+// The source of each version of a flight recorded in the flight history
+const FlightUpdatedMessage = "FlightUpdatedNotification"
+const FlightCreatedMessage = "FlightCreatedNotification"
+const FlightDeletedMessage = "FlightDeletedNotification"
+const GetFlightsMessage = "GetFlights"
+
 var RepositoryUpdateChannel = make(chan int)
 var FlightUpdatedChannel = make(chan models.FlightUpdateChannelMessage)
 var FlightCreatedChannel = make(chan models.FlightUpdateChannelMessage)
-var FlightDeletedChannel = make(chan models.Flight)
+var FlightDeletedChannel = make(chan models.FlightDeleteChannelMessage)
 var FileDeleteChannel = make(chan string)
 var FlightsInitChannel = make(chan int)
 
@@ -89,15 +97,53 @@ func InitGlobals() {
 		if err := UserViper.ReadInConfig(); err != nil {
 			Logger.Fatal("Could Not Read users.json config file")
 		}
+		userConfigChanged()
 	})
 	UserViper.WatchConfig()
 
+	initLogging()
+	setLogLevels()
+}
+
+var userConfigListeners []func()
+var userConfigListenersMutex sync.Mutex
+
+// OnUserConfigChange registers a function to be called after users.json has been re-read
+func OnUserConfigChange(listener func()) {
+	userConfigListenersMutex.Lock()
+	defer userConfigListenersMutex.Unlock()
+	userConfigListeners = append(userConfigListeners, listener)
+}
+
+func userConfigChanged() {
+	userConfigListenersMutex.Lock()
+	defer userConfigListenersMutex.Unlock()
+	for _, listener := range userConfigListeners {
+		listener()
+	}
+}
+
+// ReloadConfig re-reads service.json and users.json and applies the logging levels
+func ReloadConfig() {
+
+	if err := ConfigViper.ReadInConfig(); err != nil {
+		Logger.Error("Could Not Read service.json config file")
+	}
+	if err := UserViper.ReadInConfig(); err != nil {
+		Logger.Error("Could Not Read users.json config file")
+	}
+	setLogLevels()
+	userConfigChanged()
+
+	Logger.Info("Configuration reloaded")
+}
+
+func setLogLevels() {
+
 	//serviceConfig = getServiceConfig()
 	IsDebug = ConfigViper.GetBool("DebugService")
 	IsTrace := ConfigViper.GetBool("TraceService")
 
-	initLogging()
-
 	if ConfigViper.GetBool("EnableMetrics") {
 		MetricsLogger.SetLevel(logrus.InfoLevel)
 	} else {
@@ -156,4 +202,18 @@ func initLogging() {
 			Compress:   true, // disabled by default
 		})
 	}
+	// Admin actions are always recorded, whatever the logging levels
+	AuditLogger.Formatter = &easy.Formatter{
+		TimestampFormat: "2006-01-02 15:04:05",
+		LogFormat:       "[%lvl%]: %time% - %msg%\n",
+	}
+	if ConfigViper.GetString("AuditLogFile") != "" {
+		AuditLogger.SetOutput(&lumberjack.Logger{
+			Filename:   ConfigViper.GetString("AuditLogFile"),
+			MaxSize:    ConfigViper.GetInt("MaxLogFileSizeInMB"), // megabytes
+			MaxBackups: ConfigViper.GetInt("MaxNumberLogFiles"),
+			MaxAge:     28,   //days
+			Compress:   true, // disabled by default
+		})
+	}
 }
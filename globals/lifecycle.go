@@ -0,0 +1,60 @@
+package globals
+
+/*
+
+The lifecycle of the service. Ctx is cancelled when the service is asked to stop and every
+background component (HTTP server, notification listeners, schedulers and push workers) watches it.
+Components that have work to finish before the process exits register with ShutdownWg.
+Work that is still running when the shutdown deadline passes is cut off by DrainCtx
+
+*/
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cancelled when the service is asked to stop
+var Ctx, cancelCtx = context.WithCancel(context.Background())
+
+// Cancelled when the shutdown deadline has passed
+var DrainCtx, cancelDrainCtx = context.WithCancel(context.Background())
+
+// Background components that need to finish their work before the process exits
+var ShutdownWg sync.WaitGroup
+
+// ShutdownTimeout is the time allowed for the HTTP server to drain and the queued pushes to complete
+func ShutdownTimeout() time.Duration {
+	secs := ConfigViper.GetInt("ShutdownTimeoutInSeconds")
+	if secs <= 0 {
+		secs = 30
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// Shutdown signals every background component to stop and waits for them, up to the shutdown timeout
+func Shutdown() {
+
+	Logger.Info("Shutting down background components")
+	cancelCtx()
+
+	timeout := ShutdownTimeout()
+	deadline := time.AfterFunc(timeout, cancelDrainCtx)
+	defer deadline.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		ShutdownWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		Logger.Info("Background components stopped")
+	case <-DrainCtx.Done():
+		Logger.Warn(fmt.Sprintf("Background components did not stop within %s. Remaining work abandoned", timeout))
+	}
+	cancelDrainCtx()
+}
@@ -0,0 +1,258 @@
+package jwtauth
+
+/*
+
+Validation of the JWT bearer tokens issued by an identity provider.
+
+A token must be signed with one of the keys of the provider's JSON Web Key Set with RS256, RS384,
+RS512, PS256, PS384, PS512, ES256, ES384 or ES512. Unsigned and HMAC signed tokens are rejected.
+The token must have an expiry ("exp") and, if they are configured, the issuer ("iss") and one of the
+audiences ("aud") must match. The key set can be read from a file or fetched from the provider, and
+is read again when a token is signed with a key that is not in the set so keys can be rotated.
+
+A validator for a key set generated locally, for example for testing, is created with
+
+	keys, err := jwtauth.ParseKeySet(jwks)
+	validator := &jwtauth.Validator{Keys: keys, Issuer: issuer, Audience: audience}
+	claims, err := validator.Validate(token)
+
+*/
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// DefaultLeeway is the difference allowed between the clocks of the provider and the service
+const DefaultLeeway = time.Minute
+
+var (
+	ErrMalformedToken       = errors.New("the token is malformed")
+	ErrUnsupportedAlgorithm = errors.New("the token signing algorithm is not supported")
+	ErrUnknownKey           = errors.New("the token is signed with an unknown key")
+	ErrInvalidSignature     = errors.New("the token signature is not valid")
+	ErrExpiredToken         = errors.New("the token has expired")
+	ErrTokenNotYetValid     = errors.New("the token is not yet valid")
+	ErrInvalidIssuer        = errors.New("the token issuer is not accepted")
+	ErrInvalidAudience      = errors.New("the token audience is not accepted")
+)
+
+// Keys provides the public key with the key ID
+type Keys interface {
+	Key(kid string) (crypto.PublicKey, string, error)
+}
+
+// Claims are the claims of a validated token
+type Claims map[string]interface{}
+
+// String returns the claim if it is a string
+func (c Claims) String(name string) string {
+	if s, ok := c[name].(string); ok {
+		return s
+	}
+	return ""
+}
+
+// Strings returns the claim as a list of strings. A claim that is a single string is split on spaces
+// and commas, as scopes and some role claims are given that way
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// audiences returns the audiences of the token. A single audience is given as a string, which is not split
+func (c Claims) audiences() []string {
+	if aud, ok := c["aud"].(string); ok {
+		return []string{aud}
+	}
+	return c.Strings("aud")
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	if v, ok := c[name].(float64); ok {
+		return time.Unix(int64(v), 0), true
+	}
+	return time.Time{}, false
+}
+
+// Validator validates tokens signed with its keys. The issuer and audience are only checked if they are set
+type Validator struct {
+	Keys     Keys
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Validate checks the signature and claims of the token and returns its claims
+func (v *Validator) Validate(token string) (Claims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformedToken
+	}
+	hash, err := algorithmHash(h.Alg)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	key, keyAlg, err := v.Keys.Key(h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if keyAlg != "" && keyAlg != h.Alg {
+		return nil, fmt.Errorf("%w: the key is for %s", ErrUnsupportedAlgorithm, keyAlg)
+	}
+
+	digest := hash.New()
+	digest.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(h.Alg, hash, key, digest.Sum(nil), signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Validator) checkClaims(claims Claims) error {
+
+	leeway := v.Leeway
+	if leeway == 0 {
+		leeway = DefaultLeeway
+	}
+	now := time.Now()
+
+	expires, ok := claims.time("exp")
+	if !ok || now.After(expires.Add(leeway)) {
+		return ErrExpiredToken
+	}
+	if notBefore, ok := claims.time("nbf"); ok && now.Add(leeway).Before(notBefore) {
+		return ErrTokenNotYetValid
+	}
+
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return ErrInvalidIssuer
+	}
+	if v.Audience != "" {
+		for _, aud := range claims.audiences() {
+			if aud == v.Audience {
+				return nil
+			}
+		}
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func algorithmHash(alg string) (crypto.Hash, error) {
+	if len(alg) != 5 {
+		return 0, ErrUnsupportedAlgorithm
+	}
+	switch alg[:2] {
+	case "RS", "PS", "ES":
+	default:
+		return 0, ErrUnsupportedAlgorithm
+	}
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, nil
+	case "384":
+		return crypto.SHA384, nil
+	case "512":
+		return crypto.SHA512, nil
+	}
+	return 0, ErrUnsupportedAlgorithm
+}
+
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, digest, signature []byte) error {
+
+	switch alg[:2] {
+	case "RS", "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: %s requires an RSA key", ErrUnsupportedAlgorithm, alg)
+		}
+		var err error
+		if alg[:2] == "RS" {
+			err = rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature)
+		} else {
+			err = rsa.VerifyPSS(rsaKey, hash, digest, signature, nil)
+		}
+		if err != nil {
+			return ErrInvalidSignature
+		}
+
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve.Params().BitSize != curveBits(alg) {
+			return fmt.Errorf("%w: %s requires a matching EC key", ErrUnsupportedAlgorithm, alg)
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return ErrInvalidSignature
+		}
+	}
+	return nil
+}
+
+// curveBits returns the size of the curve used with the EC algorithm
+func curveBits(alg string) int {
+	switch alg {
+	case "ES256":
+		return 256
+	case "ES384":
+		return 384
+	}
+	return 521
+}
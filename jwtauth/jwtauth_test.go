@@ -0,0 +1,283 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://idp.example"
+const testAudience = "frapi"
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func keySet(t *testing.T, keys ...*rsa.PrivateKey) []byte {
+	t.Helper()
+	jwks, err := PublicKeySet(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwks
+}
+
+func validator(t *testing.T, keys ...*rsa.PrivateKey) *Validator {
+	t.Helper()
+	set, err := ParseKeySet(keySet(t, keys...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Validator{Keys: set, Issuer: testIssuer, Audience: testAudience}
+}
+
+func sign(t *testing.T, claims Claims, key *rsa.PrivateKey) string {
+	t.Helper()
+	token, err := Sign(claims, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// validClaims returns the claims of a token that expires in an hour
+func validClaims() Claims {
+	return Claims{"iss": testIssuer, "aud": testAudience, "client_id": "client", "exp": float64(time.Now().Add(time.Hour).Unix())}
+}
+
+func TestValidToken(t *testing.T) {
+
+	key := generateKey(t)
+	claims, err := validator(t, key).Validate(sign(t, validClaims(), key))
+	if err != nil {
+		t.Fatalf("valid token rejected: %s", err)
+	}
+	if claims.String("client_id") != "client" {
+		t.Errorf("client_id is %q, expected client", claims.String("client_id"))
+	}
+}
+
+func TestSignature(t *testing.T) {
+
+	key := generateKey(t)
+	v := validator(t, key)
+	token := sign(t, validClaims(), key)
+	parts := strings.Split(token, ".")
+
+	// The claims of a signed token can not be changed
+	claims := validClaims()
+	claims["client_id"] = "other"
+	changed := strings.Split(sign(t, claims, key), ".")[1]
+	if _, err := v.Validate(parts[0] + "." + changed + "." + parts[2]); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("token with changed claims: got %v, expected %v", err, ErrInvalidSignature)
+	}
+
+	// A token signed with another key that has the same key ID
+	other := generateKey(t)
+	forged := strings.Split(sign(t, validClaims(), other), ".")
+	if _, err := v.Validate(parts[0] + "." + forged[1] + "." + forged[2]); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("token signed with another key: got %v, expected %v", err, ErrInvalidSignature)
+	}
+
+	// A key that is not in the key set
+	if _, err := v.Validate(sign(t, validClaims(), other)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token signed with an unknown key: got %v, expected %v", err, ErrUnknownKey)
+	}
+
+	for _, alg := range []string{"none", "HS256"} {
+		h, _ := json.Marshal(header{Alg: alg, Kid: KeyID(&key.PublicKey)})
+		unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + parts[1] + "." + parts[2]
+		if _, err := v.Validate(unsigned); !errors.Is(err, ErrUnsupportedAlgorithm) {
+			t.Errorf("%s token: got %v, expected %v", alg, err, ErrUnsupportedAlgorithm)
+		}
+	}
+
+	if _, err := v.Validate("not.a token"); !errors.Is(err, ErrMalformedToken) {
+		t.Errorf("malformed token: got %v, expected %v", err, ErrMalformedToken)
+	}
+}
+
+func TestECSignature(t *testing.T) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := 32
+	set, _ := json.Marshal(map[string][]jwk{"keys": {{
+		Kty: "EC", Kid: "ec", Use: "sig", Alg: "ES256", Crv: "P-256",
+		X: base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		Y: base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}}})
+	keys, err := ParseKeySet(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, _ := json.Marshal(header{Alg: "ES256", Kid: "ec"})
+	c, _ := json.Marshal(validClaims())
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+
+	v := &Validator{Keys: keys, Issuer: testIssuer, Audience: testAudience}
+	if _, err := v.Validate(signed + "." + base64.RawURLEncoding.EncodeToString(signature)); err != nil {
+		t.Errorf("ES256 token rejected: %s", err)
+	}
+
+	signature[0] ^= 0xff
+	if _, err := v.Validate(signed + "." + base64.RawURLEncoding.EncodeToString(signature)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("ES256 token with a changed signature: got %v, expected %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+
+	key := generateKey(t)
+	v := validator(t, key)
+	v.Leeway = time.Minute
+
+	tests := []struct {
+		name string
+		set  func(Claims)
+		err  error
+	}{
+		{"no expiry", func(c Claims) { delete(c, "exp") }, ErrExpiredToken},
+		{"expired", func(c Claims) { c["exp"] = float64(time.Now().Add(-2 * time.Minute).Unix()) }, ErrExpiredToken},
+		{"expired within the leeway", func(c Claims) { c["exp"] = float64(time.Now().Add(-30 * time.Second).Unix()) }, nil},
+		{"not yet valid", func(c Claims) { c["nbf"] = float64(time.Now().Add(2 * time.Minute).Unix()) }, ErrTokenNotYetValid},
+		{"valid within the leeway", func(c Claims) { c["nbf"] = float64(time.Now().Add(30 * time.Second).Unix()) }, nil},
+	}
+
+	for _, test := range tests {
+		claims := validClaims()
+		test.set(claims)
+		if _, err := v.Validate(sign(t, claims, key)); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestIssuerAndAudience(t *testing.T) {
+
+	key := generateKey(t)
+	v := validator(t, key)
+
+	tests := []struct {
+		name string
+		set  func(Claims)
+		err  error
+	}{
+		{"other issuer", func(c Claims) { c["iss"] = "https://other.example" }, ErrInvalidIssuer},
+		{"no issuer", func(c Claims) { delete(c, "iss") }, ErrInvalidIssuer},
+		{"other audience", func(c Claims) { c["aud"] = "other" }, ErrInvalidAudience},
+		{"no audience", func(c Claims) { delete(c, "aud") }, ErrInvalidAudience},
+		{"audience in a list", func(c Claims) { c["aud"] = []interface{}{"other", testAudience} }, nil},
+		{"audience with a space is one audience", func(c Claims) { c["aud"] = "other " + testAudience }, ErrInvalidAudience},
+		{"audience with a comma is one audience", func(c Claims) { c["aud"] = testAudience + ",other" }, ErrInvalidAudience},
+	}
+
+	for _, test := range tests {
+		claims := validClaims()
+		test.set(claims)
+		if _, err := v.Validate(sign(t, claims, key)); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	// Neither is checked if they are not configured
+	v.Issuer, v.Audience = "", ""
+	claims := validClaims()
+	delete(claims, "iss")
+	delete(claims, "aud")
+	if _, err := v.Validate(sign(t, claims, key)); err != nil {
+		t.Errorf("token without issuer or audience rejected when they are not configured: %s", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+
+	oldKey, newKey := generateKey(t), generateKey(t)
+
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, keySet(t, oldKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	source := &KeySource{File: file, Refresh: time.Hour}
+	v := &Validator{Keys: source}
+
+	if _, err := v.Validate(sign(t, validClaims(), oldKey)); err != nil {
+		t.Fatalf("token signed with the current key rejected: %s", err)
+	}
+
+	// The provider starts signing with a new key and publishes it in the key set
+	if err := os.WriteFile(file, keySet(t, newKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key set is not read again more than once a minute for unknown keys
+	if _, err := v.Validate(sign(t, validClaims(), newKey)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token signed with the new key straight after the key set was read: got %v, expected %v", err, ErrUnknownKey)
+	}
+
+	source.mutex.Lock()
+	source.attempts = time.Now().Add(-2 * minimumKeyRefresh)
+	source.mutex.Unlock()
+
+	if _, err := v.Validate(sign(t, validClaims(), newKey)); err != nil {
+		t.Errorf("token signed with the new key rejected: %s", err)
+	}
+	if _, err := v.Validate(sign(t, validClaims(), oldKey)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("token signed with the removed key: got %v, expected %v", err, ErrUnknownKey)
+	}
+}
+
+// The key set is read again once it is older than the refresh interval
+func TestKeyRefresh(t *testing.T) {
+
+	oldKey, newKey := generateKey(t), generateKey(t)
+
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, keySet(t, oldKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	source := &KeySource{File: file, Refresh: time.Hour}
+	if _, _, err := source.Key(KeyID(&oldKey.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(file, keySet(t, oldKey, newKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	source.mutex.Lock()
+	source.loaded = time.Now().Add(-2 * time.Hour)
+	source.mutex.Unlock()
+
+	key, alg, err := source.Key(KeyID(&newKey.PublicKey))
+	if err != nil {
+		t.Fatalf("new key not found after the refresh interval: %s", err)
+	}
+	if alg != "RS256" || !key.(*rsa.PublicKey).Equal(crypto.PublicKey(&newKey.PublicKey)) {
+		t.Errorf("refreshed key set returned the wrong key")
+	}
+}
@@ -0,0 +1,270 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The shortest time between fetching the key set again because a token used an unknown key
+const minimumKeyRefresh = time.Minute
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type publicKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// KeySet is a parsed JSON Web Key Set
+type KeySet struct {
+	keys []publicKey
+}
+
+// ParseKeySet reads the RSA and EC signing keys of a JSON Web Key Set. Other keys are ignored
+func ParseKeySet(data []byte) (*KeySet, error) {
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid key set: %w", err)
+	}
+
+	keys := &KeySet{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys.keys = append(keys.keys, publicKey{kid: k.Kid, alg: k.Alg, key: key})
+		}
+	}
+	if len(keys.keys) == 0 {
+		return nil, errors.New("the key set has no signing keys")
+	}
+	return keys, nil
+}
+
+// Key returns the key with the ID and the algorithm it is restricted to. A token without a key ID can
+// only be used with a key set that has one key
+func (s *KeySet) Key(kid string) (crypto.PublicKey, string, error) {
+	if kid == "" && len(s.keys) == 1 {
+		return s.keys[0].key, s.keys[0].alg, nil
+	}
+	for _, k := range s.keys {
+		if k.kid == kid {
+			return k.key, k.alg, nil
+		}
+	}
+	return nil, "", ErrUnknownKey
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// KeySource provides the keys of a key set read from a file or fetched from a URL. The key set is read
+// again when it is older than the refresh interval, or when a token uses a key that is not in the set
+type KeySource struct {
+	File    string
+	URL     string
+	Refresh time.Duration
+	Client  *http.Client
+
+	mutex    sync.Mutex
+	keys     *KeySet
+	loaded   time.Time
+	attempts time.Time
+}
+
+// Key returns the key with the ID, reading the key set if required
+func (s *KeySource) Key(kid string) (crypto.PublicKey, string, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stale := s.keys == nil || (s.Refresh > 0 && time.Since(s.loaded) > s.Refresh)
+	if stale {
+		if err := s.load(); err != nil && s.keys == nil {
+			return nil, "", err
+		}
+	}
+
+	key, alg, err := s.keys.Key(kid)
+	if errors.Is(err, ErrUnknownKey) && !stale && time.Since(s.attempts) > minimumKeyRefresh {
+		if s.load() == nil {
+			key, alg, err = s.keys.Key(kid)
+		}
+	}
+	return key, alg, err
+}
+
+func (s *KeySource) load() error {
+
+	s.attempts = time.Now()
+
+	data, err := s.read()
+	if err != nil {
+		return fmt.Errorf("could not read the key set: %w", err)
+	}
+	keys, err := ParseKeySet(data)
+	if err != nil {
+		return err
+	}
+
+	s.keys = keys
+	s.loaded = time.Now()
+	return nil
+}
+
+func (s *KeySource) read() ([]byte, error) {
+
+	if s.File != "" {
+		return os.ReadFile(s.File)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", s.URL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// GenerateKey returns a new RSA key for signing tokens locally
+func GenerateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// KeyID returns the RFC 7638 thumbprint of the key, which is used as its key ID
+func KeyID(key *rsa.PublicKey) string {
+	thumbprint := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()))
+	sum := sha256.Sum256([]byte(thumbprint))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// PublicKeySet returns the JSON Web Key Set with the public keys of the signing keys
+func PublicKeySet(keys ...*rsa.PrivateKey) ([]byte, error) {
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{}}
+
+	for _, key := range keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "RSA",
+			Kid: KeyID(&key.PublicKey),
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	return json.MarshalIndent(set, "", "    ")
+}
+
+// Sign returns a token with the claims signed with the key using RS256
+func Sign(claims Claims, key *rsa.PrivateKey) (string, error) {
+
+	h, err := json.Marshal(header{Alg: "RS256", Kid: KeyID(&key.PublicKey)})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
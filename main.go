@@ -9,7 +9,6 @@ import (
 	_ "net/http/pprof"
 
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/sys/windows/svc"
 )
 
 func main() {
@@ -18,7 +17,8 @@ func main() {
 	globals.InitGlobals()
 	timeservice.InitTimeService()
 
-	inService, err := svc.IsWindowsService()
+	// Started by the Windows service control manager or by systemd
+	inService, err := cmd.InService()
 
 	if err != nil {
 		log.Fatalf("Failed to determine if we are running in service: %v", err)
@@ -0,0 +1,149 @@
+package mockams
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"flightresourcerestapi/globals"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher sends the flight notifications of the mock AMS
+type Publisher interface {
+	Publish(ctx context.Context, message string) error
+	Close()
+}
+
+type rabbitMQPublisher struct {
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	exchange string
+	topic    string
+}
+
+// NewRabbitMQPublisher connects to the RabbitMQ exchange configured for the repository in test.json
+func (s *Server) NewRabbitMQPublisher() (Publisher, error) {
+
+	repo := s.config.Repository
+
+	conn, err := amqp.Dial(repo.RabbitMQConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to RabbitMQ: %w", err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not open a RabbitMQ channel: %w", err)
+	}
+
+	// Declared the same way as the listener of the service
+	err = ch.ExchangeDeclare(repo.RabbitMQExchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		conn.Close()
+		return nil, fmt.Errorf("could not declare the RabbitMQ exchange %s: %w", repo.RabbitMQExchange, err)
+	}
+
+	return &rabbitMQPublisher{conn: conn, ch: ch, exchange: repo.RabbitMQExchange, topic: repo.RabbitMQTopic}, nil
+}
+
+func (p *rabbitMQPublisher) Publish(ctx context.Context, message string) error {
+	return p.ch.PublishWithContext(ctx, p.exchange, p.topic, false, false, amqp.Publishing{
+		ContentType: "text/xml",
+		Body:        []byte(message),
+	})
+}
+
+func (p *rabbitMQPublisher) Close() {
+	p.ch.Close()
+	p.conn.Close()
+}
+
+// EmitNotifications changes the schedule every interval until the context is cancelled and publishes
+// a notification for each change. Most changes are updates of the stand, gate and time of a flight,
+// the rest are new rotations and deleted flights
+func (s *Server) EmitNotifications(ctx context.Context, publisher Publisher, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, message := range s.nextChange() {
+			if err := publisher.Publish(ctx, message); err != nil {
+				globals.Logger.Error(fmt.Sprintf("Mock AMS: could not publish notification: %s", err))
+			}
+		}
+	}
+}
+
+// nextChange applies a random change to the schedule and returns the notifications for it
+func (s *Server) nextChange() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	airport := s.Airport()
+	roll := s.rnd.Intn(100)
+
+	// A new rotation today, numbered after the rotations of the generated schedule
+	if roll < 10 || len(s.flights) == 0 {
+		today := time.Now()
+		today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local)
+		seq := s.config.RotationsPerDay + s.created
+		s.created++
+
+		arr, dep := generateRotation(s.rnd, s.config, s.pools, today, s.rnd.Intn(s.config.RotationsPerDay), seq, &s.nextID)
+		s.flights[arr.UniqueID] = arr
+		s.flights[dep.UniqueID] = dep
+
+		globals.Logger.Info(fmt.Sprintf("Mock AMS: created %s%s and %s%s", arr.Airline, arr.Number, dep.Airline, dep.Number))
+		return []string{
+			s.templates.notification(arr, airport, "Created"),
+			s.templates.notification(dep, airport, "Created"),
+		}
+	}
+
+	flight := s.randomFlight()
+
+	if roll < 20 {
+		delete(s.flights, flight.UniqueID)
+		if flight.Linked != nil {
+			flight.Linked.Linked = nil
+		}
+
+		globals.Logger.Info(fmt.Sprintf("Mock AMS: deleted %s%s %s", flight.Airline, flight.Number, flight.sdo()))
+		return []string{s.templates.notification(flight, airport, "Deleted")}
+	}
+
+	// The scheduled date identifies the flight so it is not changed
+	if sto := flight.STO.Add(time.Duration(s.rnd.Intn(31)-10) * time.Minute); sto.Format("2006-01-02") == flight.sdo() {
+		flight.STO = sto
+	}
+	flight.Stand = s.pools.pick(s.rnd, "Stand")
+	flight.Gate = s.pools.pick(s.rnd, "Gate")
+	flight.DataVersion++
+
+	globals.Logger.Info(fmt.Sprintf("Mock AMS: updated %s%s %s", flight.Airline, flight.Number, flight.sdo()))
+	return []string{s.templates.notification(flight, airport, "Updated")}
+}
+
+// randomFlight must be called while holding the lock
+func (s *Server) randomFlight() *mockFlight {
+	n := s.rnd.Intn(len(s.flights))
+	for _, f := range s.flights {
+		if n == 0 {
+			return f
+		}
+		n--
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package mockams
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"flightresourcerestapi/timeservice"
+)
+
+type resource struct {
+	Name string
+	Area string
+}
+
+// mockFlight is a flight of the generated schedule. Arrivals and departures are generated in
+// pairs that share the aircraft and the stand
+type mockFlight struct {
+	UniqueID     int
+	Kind         string
+	Airline      string
+	Number       string
+	STO          time.Time
+	Route        string
+	Registration string
+	Linked       *mockFlight
+	DataVersion  int
+
+	Stand    resource
+	Gate     resource
+	Carousel resource
+	CheckIns []resource
+}
+
+func (f *mockFlight) sdo() string {
+	return f.STO.Format("2006-01-02")
+}
+
+// resourcePools are the fixed resources of the airport, by resource type
+type resourcePools map[string][]resource
+
+func (p resourcePools) pick(rnd *rand.Rand, resourceType string) resource {
+	pool := p[resourceType]
+	if len(pool) == 0 {
+		return resource{}
+	}
+	return pool[rnd.Intn(len(pool))]
+}
+
+// generateRotation creates an arrival and the departure of the same aircraft. The arrivals of a day are
+// spread from 05:00 by their slot. Flight numbers are derived from the sequence of the rotation in the
+// day so they are unique for the airline
+func generateRotation(rnd *rand.Rand, config *mockConfig, pools resourcePools, day time.Time, slot, seq int, nextID *int) (*mockFlight, *mockFlight) {
+
+	airline := config.Airlines[rnd.Intn(len(config.Airlines))]
+	sta := day.Add(5*time.Hour + time.Duration(slot)*18*time.Hour/time.Duration(config.RotationsPerDay) + time.Duration(rnd.Intn(10))*time.Minute)
+	std := sta.Add(time.Duration(60+rnd.Intn(7)*10) * time.Minute)
+	registration := fmt.Sprintf("A6-%c%c%c", 'A'+rnd.Intn(26), 'A'+rnd.Intn(26), 'A'+rnd.Intn(26))
+	stand := pools.pick(rnd, "Stand")
+
+	*nextID++
+	arr := &mockFlight{
+		UniqueID:     *nextID,
+		DataVersion:  1,
+		Kind:         "Arrival",
+		Airline:      airline,
+		Number:       fmt.Sprintf("%d", 100+seq*2),
+		STO:          sta,
+		Route:        config.Routes[rnd.Intn(len(config.Routes))],
+		Registration: registration,
+		Stand:        stand,
+		Gate:         pools.pick(rnd, "Gate"),
+		Carousel:     pools.pick(rnd, "Carousel"),
+	}
+
+	*nextID++
+	dep := &mockFlight{
+		UniqueID:     *nextID,
+		DataVersion:  1,
+		Kind:         "Departure",
+		Airline:      airline,
+		Number:       fmt.Sprintf("%d", 101+seq*2),
+		STO:          std,
+		Route:        config.Routes[rnd.Intn(len(config.Routes))],
+		Registration: registration,
+		Stand:        stand,
+		Gate:         pools.pick(rnd, "Gate"),
+		CheckIns:     []resource{pools.pick(rnd, "CheckIn"), pools.pick(rnd, "CheckIn")},
+	}
+
+	arr.Linked = dep
+	dep.Linked = arr
+
+	return arr, dep
+}
+
+// templates are the arrival and departure flight notification templates
+type templates struct {
+	arrival   string
+	departure string
+}
+
+func loadTemplates() (templates, error) {
+
+	arrival, err := readTemplate("arrival.template.xml")
+	if err != nil {
+		return templates{}, err
+	}
+	departure, err := readTemplate("departure.template.xml")
+	if err != nil {
+		return templates{}, err
+	}
+	return templates{arrival: arrival, departure: departure}, nil
+}
+
+// readTemplate reads the template from the working directory or the directory of the executable
+func readTemplate(name string) (string, error) {
+
+	data, err := os.ReadFile(name)
+	if err == nil {
+		return string(data), nil
+	}
+
+	exe, exeErr := os.Executable()
+	if exeErr != nil {
+		return "", err
+	}
+	data, err = os.ReadFile(filepath.Join(filepath.Dir(exe), name))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// notification renders the flight as a notification of the kind (Created, Updated or Deleted)
+func (t templates) notification(f *mockFlight, airport, kind string) string {
+
+	linked := f.Linked
+	if linked == nil {
+		linked = f
+	}
+
+	template := t.departure
+	var slots [3]string
+	if f.Kind == "Arrival" {
+		template = t.arrival
+		slots = [3]string{
+			slotsXML("Stand", []resource{f.Stand}, f.STO, f.STO.Add(45*time.Minute)),
+			slotsXML("Gate", []resource{f.Gate}, f.STO, f.STO.Add(20*time.Minute)),
+			slotsXML("Carousel", []resource{f.Carousel}, f.STO.Add(10*time.Minute), f.STO.Add(50*time.Minute)),
+		}
+	} else {
+		slots = [3]string{
+			slotsXML("Stand", []resource{f.Stand}, f.STO.Add(-60*time.Minute), f.STO),
+			slotsXML("Gate", []resource{f.Gate}, f.STO.Add(-45*time.Minute), f.STO.Add(-10*time.Minute)),
+			slotsXML("CheckIn", f.CheckIns, f.STO.Add(-3*time.Hour), f.STO.Add(-45*time.Minute)),
+		}
+	}
+
+	message := fmt.Sprintf(template,
+		f.Airline, f.Number, f.sdo(), airport, f.STO.Format(timeservice.Layout),
+		linked.Airline, linked.Number, linked.sdo(), airport, linked.STO.Format(timeservice.Layout), linked.UniqueID,
+		f.Registration, f.Route, f.UniqueID,
+		slots[0], slots[1], slots[2])
+
+	message = dataVersionElement.ReplaceAllString(message, fmt.Sprintf("${1}%d${2}", f.DataVersion))
+	return strings.ReplaceAll(message, "FlightUpdatedNotification", "Flight"+kind+"Notification")
+}
+
+var dataVersionElement = regexp.MustCompile(`(<DataVersion[^>]*>)\d+(</DataVersion>)`)
+
+var flightElement = regexp.MustCompile(`(?s)<Flight>.*</Flight>`)
+var flightChangesElement = regexp.MustCompile(`(?s)<FlightChanges[ >].*</FlightChanges>`)
+
+// flight renders the flight as returned by GetFlights, without the changes of a notification
+func (t templates) flight(f *mockFlight, airport string) string {
+	flight := flightElement.FindString(t.notification(f, airport, "Updated"))
+	return flightChangesElement.ReplaceAllString(flight, "")
+}
+
+// slotsXML renders the slots of the resources, all with the same start and end time
+func slotsXML(resourceType string, resources []resource, from, to time.Time) string {
+
+	var sb strings.Builder
+
+	sb.WriteString("<" + resourceType + "Slots>")
+	for _, r := range resources {
+		if r.Name == "" {
+			continue
+		}
+		sb.WriteString("<" + resourceType + "Slot>")
+		sb.WriteString(`<Value propertyName="StartTime">` + from.Format(timeservice.Layout) + `</Value>`)
+		sb.WriteString(`<Value propertyName="EndTime">` + to.Format(timeservice.Layout) + `</Value>`)
+		sb.WriteString("<" + resourceType + ">")
+		sb.WriteString(`<Value propertyName="Name">` + r.Name + `</Value>`)
+		sb.WriteString(`<Value propertyName="ExternalName">` + r.Name + `</Value>`)
+		sb.WriteString(`<Area><Value propertyName="Name">` + r.Area + `</Value></Area>`)
+		sb.WriteString("</" + resourceType + ">")
+		sb.WriteString("</" + resourceType + "Slot>")
+	}
+	sb.WriteString("</" + resourceType + "Slots>")
+
+	return sb.String()
+}
@@ -0,0 +1,337 @@
+package mockams
+
+/*
+
+A mock of the AMS web services for development without access to a SITA AMS. Serves the SOAP
+GetFlights and GetAirports operations and the REST fixed resource endpoints from a schedule
+generated from test.json, and publishes flight Created, Updated and Deleted notifications to
+RabbitMQ. Point the AMS URLs of an airport in airports.json at the mock to run the full load path
+
+*/
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+
+	"github.com/spf13/viper"
+)
+
+// mockConfig is the part of test.json used to generate the schedule
+type mockConfig struct {
+	Repository      *models.Repository
+	Airlines        []string
+	Routes          []string
+	Areas           map[string][]area
+	RotationsPerDay int
+}
+
+type area struct {
+	Area   string `json:"Area"`
+	Number int    `json:"Number"`
+}
+
+type testConfig struct {
+	TestConfig struct {
+		Repository    models.Repository `json:"Repository"`
+		CheckinAreas  []area            `json:"CheckinAreas"`
+		GateAreas     []area            `json:"GateAreas"`
+		StandAreas    []area            `json:"StandAreas"`
+		CarouselAreas []area            `json:"CarouselAreas"`
+		ChuteAreas    []area            `json:"ChuteAreas"`
+		Airlines      []string          `json:"Airlines"`
+		Routes        []string          `json:"Routes"`
+	} `json:"TestConfig"`
+}
+
+func loadConfig(rotationsPerDay int) (*mockConfig, error) {
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	testViper := viper.New()
+	testViper.SetConfigName("test")
+	testViper.SetConfigType("json")
+	testViper.AddConfigPath(".")
+	testViper.AddConfigPath(filepath.Dir(exe))
+	if err := testViper.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("could not read test.json config file: %w", err)
+	}
+
+	var tc testConfig
+	if err := testViper.Unmarshal(&tc); err != nil {
+		return nil, fmt.Errorf("could not read test.json config file: %w", err)
+	}
+
+	config := &mockConfig{
+		Repository: &tc.TestConfig.Repository,
+		Airlines:   tc.TestConfig.Airlines,
+		Routes:     tc.TestConfig.Routes,
+		Areas: map[string][]area{
+			"CheckIn":  tc.TestConfig.CheckinAreas,
+			"Gate":     tc.TestConfig.GateAreas,
+			"Stand":    tc.TestConfig.StandAreas,
+			"Carousel": tc.TestConfig.CarouselAreas,
+			"Chute":    tc.TestConfig.ChuteAreas,
+		},
+		RotationsPerDay: rotationsPerDay,
+	}
+
+	if len(config.Airlines) == 0 || len(config.Routes) == 0 {
+		return nil, fmt.Errorf("test.json must define at least one airline and one route")
+	}
+	if config.RotationsPerDay < 1 {
+		config.RotationsPerDay = 1
+	}
+
+	return config, nil
+}
+
+// The REST resource types and the resource type code of their resources
+var restResourceTypes = map[string]string{
+	"CheckIns":  "CheckIn",
+	"Gates":     "Gate",
+	"Stands":    "Stand",
+	"Carousels": "Carousel",
+	"Chutes":    "Chute",
+}
+
+// Server is the mock AMS
+type Server struct {
+	config    *mockConfig
+	templates templates
+	pools     resourcePools
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	flights map[int]*mockFlight
+	nextID  int
+	created int
+}
+
+// NewServer generates the schedule of the airport in test.json for the window of the repository,
+// with the number of arrival and departure rotations per day
+func NewServer(rotationsPerDay int) (*Server, error) {
+
+	config, err := loadConfig(rotationsPerDay)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := loadTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config:    config,
+		templates: tmpl,
+		pools:     resourcePools{},
+		rnd:       rand.New(rand.NewSource(1)),
+		flights:   make(map[int]*mockFlight),
+	}
+
+	for resourceType, areas := range config.Areas {
+		for _, a := range areas {
+			for i := 1; i <= a.Number; i++ {
+				s.pools[resourceType] = append(s.pools[resourceType], resource{Name: fmt.Sprintf("%s%d", a.Area, i), Area: a.Area})
+			}
+		}
+	}
+
+	today := time.Now()
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local)
+	for d := config.Repository.FlightSDOWindowMinimumInDaysFromNow; d <= config.Repository.FlightSDOWindowMaximumInDaysFromNow; d++ {
+		day := today.AddDate(0, 0, d)
+		for seq := 0; seq < config.RotationsPerDay; seq++ {
+			arr, dep := generateRotation(s.rnd, config, s.pools, day, seq, seq, &s.nextID)
+			s.flights[arr.UniqueID] = arr
+			s.flights[dep.UniqueID] = dep
+		}
+	}
+
+	return s, nil
+}
+
+// Airport is the code of the airport served by the mock
+func (s *Server) Airport() string {
+	return s.config.Repository.AMSAirport
+}
+
+// NumberOfFlights is the number of flights currently in the schedule
+func (s *Server) NumberOfFlights() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.flights)
+}
+
+// ListenAndServe serves the mock AMS web services on the address until the context is cancelled
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+
+	server := &http.Server{Addr: addr, Handler: s}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// ServeHTTP answers SOAP requests (POST) and the REST fixed resource requests (GET /.../{airport}/{resourceType})
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	globals.Logger.Debug(fmt.Sprintf("Mock AMS: %s %s", r.Method, r.URL.Path))
+
+	switch r.Method {
+	case http.MethodPost:
+		s.serveSOAP(w, r)
+	case http.MethodGet:
+		s.serveFixedResources(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type soapRequest struct {
+	Body struct {
+		GetFlights *struct {
+			SessionToken string `xml:"sessionToken"`
+			From         string `xml:"from"`
+			To           string `xml:"to"`
+			Airport      string `xml:"airport"`
+		} `xml:"GetFlights"`
+		GetAirports *struct {
+			SessionToken string `xml:"sessionToken"`
+		} `xml:"GetAirports"`
+	} `xml:"Body"`
+}
+
+const soapEnvelopeStart = `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`
+const soapEnvelopeEnd = `</s:Body></s:Envelope>`
+
+func (s *Server) serveSOAP(w http.ResponseWriter, r *http.Request) {
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeSOAPFault(w, "s:Client", "Could not read request")
+		return
+	}
+
+	var req soapRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeSOAPFault(w, "s:Client", "Invalid SOAP request")
+		return
+	}
+
+	switch {
+	case req.Body.GetFlights != nil:
+		op := req.Body.GetFlights
+		if op.SessionToken != s.config.Repository.AMSToken {
+			writeSOAPFault(w, "s:Client", "Invalid session token")
+			return
+		}
+		if op.Airport != s.Airport() {
+			writeSOAPFault(w, "s:Client", fmt.Sprintf("Unknown airport %s", op.Airport))
+			return
+		}
+		s.writeFlights(w, op.From, op.To)
+
+	case req.Body.GetAirports != nil:
+		if req.Body.GetAirports.SessionToken != s.config.Repository.AMSToken {
+			writeSOAPFault(w, "s:Client", "Invalid session token")
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+		fmt.Fprintf(w, `%s<GetAirportsResponse xmlns="http://www.sita.aero/ams6-xml-api-webservice"><GetAirportsResult><WebServiceResult><ApiResponse><Data><Airports><Airport><AirportId><AirportCode codeContext="IATA">%s</AirportCode></AirportId></Airport></Airports></Data></ApiResponse></WebServiceResult></GetAirportsResult></GetAirportsResponse>%s`,
+			soapEnvelopeStart, s.Airport(), soapEnvelopeEnd)
+
+	default:
+		writeSOAPFault(w, "s:Client", "Operation not supported by the mock AMS")
+	}
+}
+
+// writeFlights writes the GetFlights response with the flights with a scheduled date from "from" up to "to"
+func (s *Server) writeFlights(w http.ResponseWriter, from, to string) {
+
+	// The dates are sent as yyyy-mm-ddT00:00:00
+	from = strings.SplitN(from, "T", 2)[0]
+	to = strings.SplitN(to, "T", 2)[0]
+
+	s.mu.Lock()
+	flights := []*mockFlight{}
+	for _, f := range s.flights {
+		if sdo := f.sdo(); sdo >= from && sdo < to {
+			flights = append(flights, f)
+		}
+	}
+	sort.Slice(flights, func(i, j int) bool { return flights[i].UniqueID < flights[j].UniqueID })
+
+	var sb strings.Builder
+	for _, f := range flights {
+		sb.WriteString(s.templates.flight(f, s.Airport()))
+	}
+	s.mu.Unlock()
+
+	globals.Logger.Info(fmt.Sprintf("Mock AMS: GetFlights from %s to %s returned %d flights", from, to, len(flights)))
+
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	fmt.Fprintf(w, `%s<GetFlightsResponse xmlns="http://www.sita.aero/ams6-xml-api-webservice"><GetFlightsResult><WebServiceResult><ApiResponse><Data><Flights>%s</Flights></Data></ApiResponse></WebServiceResult></GetFlightsResult></GetFlightsResponse>%s`,
+		soapEnvelopeStart, sb.String(), soapEnvelopeEnd)
+}
+
+func writeSOAPFault(w http.ResponseWriter, code, message string) {
+
+	globals.Logger.Warn(fmt.Sprintf("Mock AMS: returning SOAP fault %s: %s", code, message))
+
+	w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `%s<s:Fault><faultcode>%s</faultcode><faultstring>%s</faultstring></s:Fault>%s`, soapEnvelopeStart, code, message, soapEnvelopeEnd)
+}
+
+func (s *Server) serveFixedResources(w http.ResponseWriter, r *http.Request) {
+
+	if r.Header.Get("Authorization") != s.config.Repository.AMSToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The path ends with /{airport}/{resourceType}. Any prefix is accepted
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 2 || segments[len(segments)-2] != s.Airport() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resourceTypeCode, ok := restResourceTypes[segments[len(segments)-1]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resources := models.FixedResources{}
+	for _, res := range s.pools[resourceTypeCode] {
+		resources.Values = append(resources.Values, models.FixedResource{ResourceTypeCode: resourceTypeCode, Name: res.Name, Area: res.Area})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(resources)
+}
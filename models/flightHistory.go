@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// FlightHistoryEntry is one version of a flight and the message that produced it
+type FlightHistoryEntry struct {
+	FlightID    string
+	Flight      *Flight
+	LastUpdate  time.Time
+	MessageType string
+}
+
+// FlightHistory holds every version of the flights of a repository, oldest first.
+// The flights are shared with the FlightList so, like the FlightList, they must be treated as read only
+type FlightHistory struct {
+	byID map[string][]FlightHistoryEntry
+}
+
+// Add appends the entry to the history of the flight. If maxVersions is greater than zero
+// only the most recent maxVersions entries of the flight are kept
+func (h *FlightHistory) Add(entry FlightHistoryEntry, maxVersions int) {
+	if h.byID == nil {
+		h.byID = make(map[string][]FlightHistoryEntry)
+	}
+
+	entries := append(h.byID[entry.FlightID], entry)
+	if maxVersions > 0 && len(entries) > maxVersions {
+		// Copy so the dropped versions can be collected
+		entries = append([]FlightHistoryEntry(nil), entries[len(entries)-maxVersions:]...)
+	}
+	h.byID[entry.FlightID] = entries
+}
+
+// Get returns a copy of the history of the flight, oldest first
+func (h *FlightHistory) Get(flightID string) []FlightHistoryEntry {
+	return append([]FlightHistoryEntry(nil), h.byID[flightID]...)
+}
+
+// RemoveExpired removes the history of the flights with a scheduled date of operation before "from"
+func (h *FlightHistory) RemoveExpired(from time.Time) {
+	for id, entries := range h.byID {
+		if len(entries) == 0 || entries[len(entries)-1].Flight.GetSDO().Before(from) {
+			delete(h.byID, id)
+		}
+	}
+}
+
+// Len returns the number of flights with a history
+func (h *FlightHistory) Len() int {
+	return len(h.byID)
+}
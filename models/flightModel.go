@@ -121,8 +121,6 @@ func (tid *AircraftTypeId) WriteJSON(fwb *bufio.Writer) error {
 	}
 	fwb.WriteString("}")
 
-	fwb.WriteString(",")
-
 	return nil
 }
 
@@ -459,7 +457,7 @@ func (d *FlightState) WriteJSON(fwb *bufio.Writer, userProfile *UserProfile) err
 
 	fwb.WriteString(",")
 
-	fwb.WriteString("\"AircraftType\"")
+	fwb.WriteString("\"AircraftType\":")
 	d.AircraftType.WriteJSON(fwb)
 	fwb.WriteString(",")
 
@@ -654,6 +652,7 @@ type Flight struct {
 	PrevNode      *Flight       `xml:"-" json:"-"`
 	NextNode      *Flight       `xml:"-" json:"-"`
 	Action        string        `xml:"Action" json:"Action"`
+	DataVersion   int64         `xml:"DataVersion" json:"DataVersion"`
 	FlightId      FlightId      `xml:"FlightId" json:"FlightId"`
 	FlightState   FlightState   `xml:"FlightState" json:"FlightState"`
 	FlightChanges FlightChanges `xml:"FlightChanges" json:"FlightChanges"`
@@ -879,6 +878,12 @@ func (f Flight) GetICAOAirline() string {
 	}
 	return ""
 }
+
+// IsOlderThan reports whether the AMS DataVersion of the flight is older than that of the other flight.
+// Flights without a DataVersion are never older
+func (f Flight) IsOlderThan(other *Flight) bool {
+	return other != nil && f.DataVersion > 0 && f.DataVersion < other.DataVersion
+}
 func (f Flight) GetFlightID() string {
 
 	airline := f.GetIATAAirline()
@@ -1069,14 +1074,12 @@ func (p GateSlot) GetResourceID() (name string, from time.Time, to time.Time) {
 	return name, from, to
 }
 
-func (r Repository) MinimumProperties(min int) {
+func (r *Repository) MinimumProperties(min int) {
 
 	fmt.Printf("Setting the number of Custom Fields in sample flights to %v", min)
-	if len(r.FlightLinkedList.Head.FlightState.Values) < min {
-
-		currentNode := r.FlightLinkedList.Head
 
-		for currentNode != nil {
+	r.FlightList.ForEach(func(currentNode *Flight) bool {
+		if len(currentNode.FlightState.Values) < min {
 			i := len(currentNode.FlightState.Values)
 			for len(currentNode.FlightState.Values) <= min {
 				prop := Value{
@@ -1086,16 +1089,11 @@ func (r Repository) MinimumProperties(min int) {
 				currentNode.FlightState.Values = append(currentNode.FlightState.Values, prop)
 				i++
 			}
-			currentNode = currentNode.NextNode
-		}
-	} else if min < len(r.FlightLinkedList.Head.FlightState.Values) {
-		currentNode := r.FlightLinkedList.Head
-
-		for currentNode != nil {
+		} else if min < len(currentNode.FlightState.Values) {
 			currentNode.FlightState.Values = currentNode.FlightState.Values[:min]
-			currentNode = currentNode.NextNode
 		}
-	}
+		return true
+	})
 
 	fmt.Printf(" - Completed\n")
 
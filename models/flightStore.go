@@ -0,0 +1,220 @@
+package models
+
+import (
+	"math/rand"
+	"time"
+
+	"flightresourcerestapi/timeservice"
+)
+
+// FlightIndexedList holds the flights of a repository.
+// Flights are indexed by their flight ID (hash index) and by their scheduled time
+// of operation (ordered index) so that lookups, replacements and time window scans
+// do not have to visit every flight in the repository.
+//
+// The ordered index is a skip list, so a flight is added or removed in O(log n). The flight ID
+// includes the scheduled time of operation, so the position of a flight in the ordered index
+// never changes when the flight is replaced by an update, and the replacement is O(1).
+// Flights without a valid scheduled time are indexed at the zero time, before all others.
+//
+// The list stores its own copy of each flight and never modifies it afterwards, so callers
+// must treat the returned *Flight as read only
+type FlightIndexedList struct {
+	byID   map[string]*stoIndexNode
+	head   *stoIndexNode
+	level  int
+	length int
+}
+
+type stoIndexNode struct {
+	sto    time.Time
+	id     string
+	flight *Flight
+	next   []*stoIndexNode
+}
+
+// The levels of the skip list. Each level has a quarter of the nodes of the level below, so 16
+// levels are enough for far more flights than a repository holds
+const (
+	stoIndexMaxLevel  = 16
+	stoIndexLevelBits = 2
+)
+
+func (ll *FlightIndexedList) init() {
+	if ll.byID == nil {
+		ll.byID = make(map[string]*stoIndexNode)
+		ll.head = &stoIndexNode{next: make([]*stoIndexNode, stoIndexMaxLevel)}
+		ll.level = 1
+	}
+}
+
+// indexTime returns the scheduled time of operation the flight is indexed by. GetSTO returns the
+// current time for a flight without a valid scheduled time, which would put it at a different
+// position each time, so those flights are given the zero time
+func indexTime(f *Flight) time.Time {
+	if sto, err := time.ParseInLocation("2006-01-02T15:04:05", f.FlightState.ScheduledTime, timeservice.Loc); err == nil {
+		return sto
+	}
+	return time.Time{}
+}
+
+// before reports whether the node is ordered before the STO and flight ID
+func (n *stoIndexNode) before(sto time.Time, id string) bool {
+	if n.sto.Equal(sto) {
+		return n.id < id
+	}
+	return n.sto.Before(sto)
+}
+
+// search returns, for each level, the last node ordered before the STO and flight ID
+func (ll *FlightIndexedList) search(sto time.Time, id string) (preceding [stoIndexMaxLevel]*stoIndexNode) {
+	n := ll.head
+	for level := ll.level - 1; level >= 0; level-- {
+		for n.next[level] != nil && n.next[level].before(sto, id) {
+			n = n.next[level]
+		}
+		preceding[level] = n
+	}
+	return preceding
+}
+
+func randomLevel() int {
+	level := 1
+	for bits := rand.Int63(); level < stoIndexMaxLevel && bits&(1<<stoIndexLevelBits-1) == 0; bits >>= stoIndexLevelBits {
+		level++
+	}
+	return level
+}
+
+// AddNode adds the flight to the list. If a flight with the same ID is already present it is replaced
+func (ll *FlightIndexedList) AddNode(newNode Flight) {
+	ll.ReplaceOrAddNode(newNode)
+}
+
+func (ll *FlightIndexedList) ReplaceOrAddNode(node Flight) {
+	ll.init()
+
+	node.PrevNode = nil
+	node.NextNode = nil
+
+	id := node.GetFlightID()
+
+	if current, ok := ll.byID[id]; ok {
+		// Replace the entire node, the position in the ordered index is unchanged
+		current.flight = &node
+		return
+	}
+
+	entry := &stoIndexNode{sto: indexTime(&node), id: id, flight: &node, next: make([]*stoIndexNode, randomLevel())}
+	preceding := ll.search(entry.sto, id)
+	for level := ll.level; level < len(entry.next); level++ {
+		preceding[level] = ll.head
+	}
+	if len(entry.next) > ll.level {
+		ll.level = len(entry.next)
+	}
+
+	for level := range entry.next {
+		entry.next[level] = preceding[level].next[level]
+		preceding[level].next[level] = entry
+	}
+	ll.byID[id] = entry
+	ll.length++
+}
+
+func (ll *FlightIndexedList) RemoveNode(removeNode Flight) {
+	id := removeNode.GetFlightID()
+
+	current, ok := ll.byID[id]
+	if !ok {
+		return
+	}
+	delete(ll.byID, id)
+
+	preceding := ll.search(current.sto, id)
+	for level := range current.next {
+		if preceding[level].next[level] == current {
+			preceding[level].next[level] = current.next[level]
+		}
+	}
+	ll.length--
+}
+
+func (ll *FlightIndexedList) GetFlight(flightID string) *Flight {
+	if e, ok := ll.byID[flightID]; ok {
+		return e.flight
+	}
+	return nil
+}
+
+func (ll *FlightIndexedList) Len() int {
+	return ll.length
+}
+
+// RemoveExpiredNode removes all the flights with a scheduled date of operation before "from".
+// The IDs of the removed flights are returned
+func (ll *FlightIndexedList) RemoveExpiredNode(from time.Time) (removed []string) {
+
+	if ll.head == nil {
+		return nil
+	}
+
+	// Every flight is visited, so the kept flights are relinked in one pass rather than searching
+	// for each removed flight
+	var last [stoIndexMaxLevel]*stoIndexNode
+	for level := range last {
+		last[level] = ll.head
+	}
+
+	for n := ll.head.next[0]; n != nil; n = n.next[0] {
+		if n.flight.GetSDO().Before(from) {
+			delete(ll.byID, n.id)
+			removed = append(removed, n.id)
+			continue
+		}
+		for level := range n.next {
+			last[level].next[level] = n
+			last[level] = n
+		}
+	}
+	for level := range last {
+		last[level].next[level] = nil
+	}
+	ll.length -= len(removed)
+
+	return removed
+}
+
+// Range calls fn, in order of scheduled time of operation, for each flight with a
+// scheduled time of operation between from and to (inclusive).
+// The scan stops if fn returns false
+func (ll *FlightIndexedList) Range(from, to time.Time, fn func(*Flight) bool) {
+
+	if ll.head == nil {
+		return
+	}
+
+	for n := ll.search(from, "")[0].next[0]; n != nil; n = n.next[0] {
+		if n.sto.After(to) {
+			return
+		}
+		if !fn(n.flight) {
+			return
+		}
+	}
+}
+
+// ForEach calls fn for every flight in the list in order of scheduled time of operation.
+// The scan stops if fn returns false
+func (ll *FlightIndexedList) ForEach(fn func(*Flight) bool) {
+
+	if ll.head == nil {
+		return
+	}
+
+	for n := ll.head.next[0]; n != nil; n = n.next[0] {
+		if !fn(n.flight) {
+			return
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package models
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"flightresourcerestapi/timeservice"
+)
+
+// Tests of the indexed flight store, and benchmarks of the operations the repository performs on its
+// flights against the indexed flight store and the original linked list it replaced
+
+const benchmarkNumFlights = 20000
+
+// flightStore is the set of operations the repository performs on its flights
+type flightStore interface {
+	AddNode(Flight)
+	ReplaceOrAddNode(Flight)
+	RemoveNode(Flight)
+	GetFlight(string) *Flight
+}
+
+func benchmarkFlights(numFlights int) []Flight {
+
+	if timeservice.Loc == nil {
+		timeservice.InitTimeService()
+	}
+
+	flights := make([]Flight, numFlights)
+	start := time.Now().Add(-3 * 24 * time.Hour)
+
+	for i := 0; i < numFlights; i++ {
+		sto := start.Add(time.Duration(i) * time.Minute)
+		flights[i] = Flight{
+			FlightId: FlightId{
+				FlightKind:        "Arrival",
+				AirlineDesignator: []AirlineDesignator{{CodeContext: "IATA", Text: "QF"}},
+				FlightNumber:      strconv.Itoa(i),
+				ScheduledDate:     sto.Format("2006-01-02"),
+				AirportCode:       []AirportCode{{CodeContext: "IATA", Text: "APT"}},
+			},
+			FlightState: FlightState{
+				ScheduledTime: sto.Format(timeservice.Layout),
+			},
+		}
+	}
+	return flights
+}
+
+// benchmarkStore returns the store filled with the benchmark flights
+func benchmarkStore(b *testing.B, store flightStore) []Flight {
+	flights := benchmarkFlights(benchmarkNumFlights)
+	for _, f := range flights {
+		store.AddNode(f)
+	}
+	b.ResetTimer()
+	return flights
+}
+
+func benchmarkGetFlight(b *testing.B, store flightStore) {
+	flights := benchmarkStore(b, store)
+	for i := 0; i < b.N; i++ {
+		store.GetFlight(flights[i%len(flights)].GetFlightID())
+	}
+}
+
+func benchmarkReplaceOrAddNode(b *testing.B, store flightStore) {
+	flights := benchmarkStore(b, store)
+	for i := 0; i < b.N; i++ {
+		store.ReplaceOrAddNode(flights[i%len(flights)])
+	}
+}
+
+func benchmarkRemoveAndAddNode(b *testing.B, store flightStore) {
+	flights := benchmarkStore(b, store)
+	for i := 0; i < b.N; i++ {
+		store.RemoveNode(flights[i%len(flights)])
+		store.AddNode(flights[i%len(flights)])
+	}
+}
+
+// benchmarkWindow returns a 24 hour window in the middle of the benchmark flights
+func benchmarkWindow(flights []Flight) (time.Time, time.Time) {
+	from := flights[len(flights)/2].GetSTO()
+	return from, from.Add(24 * time.Hour)
+}
+
+// testFlight returns an arrival with the flight number and scheduled time, which may be empty
+func testFlight(number int, sto string) Flight {
+	f := benchmarkFlights(1)[0]
+	f.FlightId.FlightNumber = strconv.Itoa(number)
+	f.FlightState.ScheduledTime = sto
+	if len(sto) >= 10 {
+		f.FlightId.ScheduledDate = sto[:10]
+	}
+	return f
+}
+
+// flightNumbers returns the flight numbers of the flights in the window, in the order they are ranged
+func flightNumbers(store *FlightIndexedList, from, to time.Time) []string {
+	numbers := []string{}
+	store.Range(from, to, func(f *Flight) bool {
+		numbers = append(numbers, f.FlightId.FlightNumber)
+		return true
+	})
+	return numbers
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func localTime(value string) time.Time {
+	t, _ := time.ParseInLocation(timeservice.Layout, value, timeservice.Loc)
+	return t
+}
+
+func TestFlightIndexedListRange(t *testing.T) {
+
+	store := &FlightIndexedList{}
+	store.AddNode(testFlight(3, "2026-10-17T12:00:00"))
+	store.AddNode(testFlight(1, "2026-10-17T10:00:00"))
+	store.AddNode(testFlight(4, "2026-10-17T13:00:00"))
+	store.AddNode(testFlight(2, "2026-10-17T11:00:00"))
+	store.AddNode(testFlight(22, "2026-10-17T11:00:00"))
+
+	// Flights at the same time are in order of their flight ID
+	tied := []string{"2", "22"}
+	if testFlight(22, "2026-10-17T11:00:00").GetFlightID() < testFlight(2, "2026-10-17T11:00:00").GetFlightID() {
+		tied = []string{"22", "2"}
+	}
+
+	tests := []struct {
+		from, to string
+		expected []string
+	}{
+		{"2026-10-17T00:00:00", "2026-10-18T00:00:00", []string{"1", tied[0], tied[1], "3", "4"}},
+		{"2026-10-17T11:00:00", "2026-10-17T12:00:00", []string{tied[0], tied[1], "3"}},
+		{"2026-10-17T11:30:00", "2026-10-17T11:45:00", []string{}},
+		{"2026-10-17T13:00:01", "2026-10-18T00:00:00", []string{}},
+		{"2026-10-16T00:00:00", "2026-10-17T09:59:59", []string{}},
+	}
+	for _, test := range tests {
+		if numbers := flightNumbers(store, localTime(test.from), localTime(test.to)); !equalStrings(numbers, test.expected) {
+			t.Errorf("Range(%s, %s) returned %v, expected %v", test.from, test.to, numbers, test.expected)
+		}
+	}
+
+	// The scan stops when fn returns false
+	visited := 0
+	store.Range(localTime("2026-10-17T00:00:00"), localTime("2026-10-18T00:00:00"), func(f *Flight) bool {
+		visited++
+		return visited < 2
+	})
+	if visited != 2 {
+		t.Errorf("Range visited %d flights after fn returned false, expected 2", visited)
+	}
+
+	// Ranging an empty list calls nothing
+	(&FlightIndexedList{}).Range(time.Time{}, time.Now(), func(f *Flight) bool {
+		t.Error("Range of an empty list called fn")
+		return true
+	})
+}
+
+func TestFlightIndexedListReplace(t *testing.T) {
+
+	store := &FlightIndexedList{}
+	store.AddNode(testFlight(1, "2026-10-17T10:00:00"))
+	store.AddNode(testFlight(2, "2026-10-17T11:00:00"))
+
+	updated := testFlight(1, "2026-10-17T10:00:00")
+	updated.FlightState.Values = []Value{{PropertyName: "Stand", Text: "A1"}}
+	store.ReplaceOrAddNode(updated)
+
+	if store.Len() != 2 {
+		t.Errorf("Len is %d after replacing a flight, expected 2", store.Len())
+	}
+	if f := store.GetFlight(updated.GetFlightID()); f == nil || f.GetProperty("Stand") != "A1" {
+		t.Errorf("GetFlight did not return the replacement")
+	}
+	count := 0
+	store.ForEach(func(f *Flight) bool {
+		count++
+		if f.FlightId.FlightNumber == "1" && f.GetProperty("Stand") != "A1" {
+			t.Errorf("ForEach returned the replaced flight")
+		}
+		return true
+	})
+	if count != 2 {
+		t.Errorf("ForEach visited %d flights, expected 2", count)
+	}
+
+	store.RemoveNode(updated)
+	if store.Len() != 1 || store.GetFlight(updated.GetFlightID()) != nil {
+		t.Errorf("flight still present after RemoveNode")
+	}
+	if numbers := flightNumbers(store, localTime("2026-10-17T00:00:00"), localTime("2026-10-18T00:00:00")); !equalStrings(numbers, []string{"2"}) {
+		t.Errorf("Range returned %v after RemoveNode, expected [2]", numbers)
+	}
+
+	// Removing a flight that is not in the list does nothing
+	store.RemoveNode(testFlight(9, "2026-10-17T10:00:00"))
+	if store.Len() != 1 {
+		t.Errorf("Len is %d after removing a missing flight, expected 1", store.Len())
+	}
+}
+
+// Flights without a valid scheduled time are kept at a fixed position, before the others
+func TestFlightIndexedListMissingSTO(t *testing.T) {
+
+	store := &FlightIndexedList{}
+	store.AddNode(testFlight(1, "2026-10-17T10:00:00"))
+	store.AddNode(testFlight(2, ""))
+	store.AddNode(testFlight(3, "not a time"))
+
+	order := []string{}
+	store.ForEach(func(f *Flight) bool {
+		order = append(order, f.FlightId.FlightNumber)
+		return true
+	})
+	if len(order) != 3 || order[2] != "1" {
+		t.Errorf("ForEach returned %v, expected the flights without a scheduled time first", order)
+	}
+
+	store.ReplaceOrAddNode(testFlight(2, ""))
+	store.RemoveNode(testFlight(3, "not a time"))
+	if store.Len() != 2 || store.GetFlight(testFlight(2, "").GetFlightID()) == nil {
+		t.Errorf("flight without a scheduled time could not be replaced or another removed")
+	}
+	if numbers := flightNumbers(store, localTime("2026-10-17T00:00:00"), localTime("2026-10-18T00:00:00")); !equalStrings(numbers, []string{"1"}) {
+		t.Errorf("Range returned %v, expected [1]", numbers)
+	}
+}
+
+func TestFlightIndexedListRemoveExpiredNode(t *testing.T) {
+
+	store := &FlightIndexedList{}
+	store.AddNode(testFlight(1, "2026-10-15T10:00:00"))
+	store.AddNode(testFlight(2, "2026-10-16T23:59:00"))
+	store.AddNode(testFlight(3, "2026-10-17T00:00:00"))
+	store.AddNode(testFlight(4, "2026-10-18T10:00:00"))
+
+	from, _ := time.Parse("2006-01-02", "2026-10-17")
+	removed := store.RemoveExpiredNode(from)
+	sort.Strings(removed)
+
+	expected := []string{testFlight(1, "2026-10-15T10:00:00").GetFlightID(), testFlight(2, "2026-10-16T23:59:00").GetFlightID()}
+	sort.Strings(expected)
+	if !equalStrings(removed, expected) {
+		t.Errorf("RemoveExpiredNode removed %v, expected %v", removed, expected)
+	}
+	if store.Len() != 2 {
+		t.Errorf("Len is %d, expected 2", store.Len())
+	}
+	for _, id := range expected {
+		if store.GetFlight(id) != nil {
+			t.Errorf("expired flight %s still present", id)
+		}
+	}
+	if numbers := flightNumbers(store, localTime("2026-10-01T00:00:00"), localTime("2026-10-31T00:00:00")); !equalStrings(numbers, []string{"3", "4"}) {
+		t.Errorf("Range returned %v after RemoveExpiredNode, expected [3 4]", numbers)
+	}
+
+	// The list can still be changed after the flights have been relinked
+	store.AddNode(testFlight(5, "2026-10-17T12:00:00"))
+	if numbers := flightNumbers(store, localTime("2026-10-01T00:00:00"), localTime("2026-10-31T00:00:00")); !equalStrings(numbers, []string{"3", "5", "4"}) {
+		t.Errorf("Range returned %v after adding a flight, expected [3 5 4]", numbers)
+	}
+
+	if removed := (&FlightIndexedList{}).RemoveExpiredNode(from); len(removed) != 0 {
+		t.Errorf("RemoveExpiredNode of an empty list removed %v", removed)
+	}
+}
+
+// TestFlightIndexedListRandom checks the list against a sorted copy of its flights after random changes
+func TestFlightIndexedListRandom(t *testing.T) {
+
+	flights := benchmarkFlights(2000)
+	rnd := rand.New(rand.NewSource(1))
+
+	store := &FlightIndexedList{}
+	present := map[int]bool{}
+	for i := 0; i < 20000; i++ {
+		n := rnd.Intn(len(flights))
+		if present[n] && rnd.Intn(2) == 0 {
+			store.RemoveNode(flights[n])
+			delete(present, n)
+		} else {
+			store.ReplaceOrAddNode(flights[n])
+			present[n] = true
+		}
+	}
+
+	expected := []int{}
+	for n := range present {
+		expected = append(expected, n)
+	}
+	sort.Ints(expected)
+
+	if store.Len() != len(expected) {
+		t.Fatalf("Len is %d, expected %d", store.Len(), len(expected))
+	}
+
+	// The benchmark flights are a minute apart in order of their index
+	from, to := flights[500].GetSTO(), flights[1500].GetSTO()
+	inWindow := []string{}
+	for _, n := range expected {
+		if n >= 500 && n <= 1500 {
+			inWindow = append(inWindow, strconv.Itoa(n))
+		}
+	}
+	if numbers := flightNumbers(store, from, to); !equalStrings(numbers, inWindow) {
+		t.Errorf("Range returned %d flights, expected %d", len(numbers), len(inWindow))
+	}
+}
+
+func BenchmarkFlightIndexedListGetFlight(b *testing.B) {
+	benchmarkGetFlight(b, &FlightIndexedList{})
+}
+
+func BenchmarkFlightIndexedListReplaceOrAddNode(b *testing.B) {
+	benchmarkReplaceOrAddNode(b, &FlightIndexedList{})
+}
+
+func BenchmarkFlightIndexedListRemoveAndAddNode(b *testing.B) {
+	benchmarkRemoveAndAddNode(b, &FlightIndexedList{})
+}
+
+// The window is scanned the same way filterFlights does
+func BenchmarkFlightIndexedListWindowScan(b *testing.B) {
+	store := &FlightIndexedList{}
+	from, to := benchmarkWindow(benchmarkStore(b, store))
+	for i := 0; i < b.N; i++ {
+		store.Range(from, to, func(f *Flight) bool {
+			return true
+		})
+	}
+}
+
+func BenchmarkFlightLinkedListGetFlight(b *testing.B) {
+	benchmarkGetFlight(b, &FlightLinkedList{})
+}
+
+func BenchmarkFlightLinkedListReplaceOrAddNode(b *testing.B) {
+	benchmarkReplaceOrAddNode(b, &FlightLinkedList{})
+}
+
+func BenchmarkFlightLinkedListRemoveAndAddNode(b *testing.B) {
+	benchmarkRemoveAndAddNode(b, &FlightLinkedList{})
+}
+
+// The window is scanned the same way filterFlights did before the flights were indexed
+func BenchmarkFlightLinkedListWindowScan(b *testing.B) {
+	store := &FlightLinkedList{}
+	from, to := benchmarkWindow(benchmarkStore(b, store))
+	for i := 0; i < b.N; i++ {
+		for f := store.Head; f != nil; f = f.NextNode {
+			if f.GetSTO().Before(from) || f.GetSTO().After(to) {
+				continue
+			}
+		}
+	}
+}
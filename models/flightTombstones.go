@@ -0,0 +1,74 @@
+package models
+
+// FlightTombstones remembers the DataVersion of deleted flights, so a notification older than the
+// delete that arrives after it does not bring the flight back. Only the most recently deleted flights
+// are kept. Like the FlightList, it is guarded by the lock of the repository
+type FlightTombstones struct {
+	byID  map[string]flightTombstone
+	order []flightTombstoneKey
+	seq   uint64
+}
+
+type flightTombstone struct {
+	dataVersion int64
+	seq         uint64
+}
+
+type flightTombstoneKey struct {
+	flightID string
+	seq      uint64
+}
+
+// Add records the delete of the flight at the DataVersion. If maxFlights is greater than zero only the
+// most recent maxFlights deletes are kept
+func (t *FlightTombstones) Add(flightID string, dataVersion int64, maxFlights int) {
+	if t.byID == nil {
+		t.byID = make(map[string]flightTombstone)
+	}
+
+	t.seq++
+	t.byID[flightID] = flightTombstone{dataVersion: dataVersion, seq: t.seq}
+	t.order = append(t.order, flightTombstoneKey{flightID: flightID, seq: t.seq})
+
+	// Entries for flights deleted again or created since are skipped, as they are no longer the tombstone
+	for maxFlights > 0 && len(t.byID) > maxFlights {
+		oldest := t.order[0]
+		t.order = t.order[1:]
+		if tombstone, ok := t.byID[oldest.flightID]; ok && tombstone.seq == oldest.seq {
+			delete(t.byID, oldest.flightID)
+		}
+	}
+	if len(t.order) > 2*len(t.byID)+16 {
+		t.compact()
+	}
+}
+
+// Remove forgets the delete of the flight, when a newer version of it has been added
+func (t *FlightTombstones) Remove(flightID string) {
+	delete(t.byID, flightID)
+	if len(t.order) > 2*len(t.byID)+16 {
+		t.compact()
+	}
+}
+
+// Get returns the DataVersion of the flight when it was deleted, if it has been
+func (t *FlightTombstones) Get(flightID string) (int64, bool) {
+	tombstone, ok := t.byID[flightID]
+	return tombstone.dataVersion, ok
+}
+
+// Len returns the number of deleted flights remembered
+func (t *FlightTombstones) Len() int {
+	return len(t.byID)
+}
+
+// compact drops the entries of the order that are no longer tombstones
+func (t *FlightTombstones) compact() {
+	order := make([]flightTombstoneKey, 0, len(t.byID))
+	for _, key := range t.order {
+		if tombstone, ok := t.byID[key.flightID]; ok && tombstone.seq == key.seq {
+			order = append(order, key)
+		}
+	}
+	t.order = order
+}
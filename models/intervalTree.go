@@ -0,0 +1,190 @@
+package models
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// AllocationIntervalTree holds the flight allocations of a single resource.
+// It is a treap ordered on the start time of the allocation where each node is augmented
+// with the latest end time in its subtree, so the allocations that overlap a time window
+// can be found without visiting every allocation of the resource
+type AllocationIntervalTree struct {
+	root *intervalNode
+	size int
+}
+
+type intervalNode struct {
+	item     AllocationItem
+	maxTo    time.Time
+	priority int64
+	left     *intervalNode
+	right    *intervalNode
+}
+
+// compareAllocations orders allocations by start time, then flight ID then end time
+func compareAllocations(a, b *AllocationItem) int {
+	if !a.From.Equal(b.From) {
+		if a.From.Before(b.From) {
+			return -1
+		}
+		return 1
+	}
+	if c := strings.Compare(a.FlightID, b.FlightID); c != 0 {
+		return c
+	}
+	if !a.To.Equal(b.To) {
+		if a.To.Before(b.To) {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func (n *intervalNode) update() {
+	n.maxTo = n.item.To
+	if n.left != nil && n.left.maxTo.After(n.maxTo) {
+		n.maxTo = n.left.maxTo
+	}
+	if n.right != nil && n.right.maxTo.After(n.maxTo) {
+		n.maxTo = n.right.maxTo
+	}
+}
+
+func rotateRight(n *intervalNode) *intervalNode {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	n.update()
+	l.update()
+	return l
+}
+
+func rotateLeft(n *intervalNode) *intervalNode {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	n.update()
+	r.update()
+	return r
+}
+
+func insertInterval(n *intervalNode, newNode *intervalNode) (*intervalNode, bool) {
+	if n == nil {
+		return newNode, true
+	}
+
+	var added bool
+	switch c := compareAllocations(&newNode.item, &n.item); {
+	case c == 0:
+		// Identical allocation, replace the details
+		n.item = newNode.item
+		n.update()
+		return n, false
+	case c < 0:
+		n.left, added = insertInterval(n.left, newNode)
+		if n.left.priority > n.priority {
+			n = rotateRight(n)
+		}
+	default:
+		n.right, added = insertInterval(n.right, newNode)
+		if n.right.priority > n.priority {
+			n = rotateLeft(n)
+		}
+	}
+	n.update()
+	return n, added
+}
+
+func removeInterval(n *intervalNode, item *AllocationItem) (*intervalNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	var removed bool
+	switch c := compareAllocations(item, &n.item); {
+	case c < 0:
+		n.left, removed = removeInterval(n.left, item)
+	case c > 0:
+		n.right, removed = removeInterval(n.right, item)
+	default:
+		// Rotate the node down until it has at most one child, then splice it out
+		if n.left == nil {
+			return n.right, true
+		}
+		if n.right == nil {
+			return n.left, true
+		}
+		if n.left.priority > n.right.priority {
+			n = rotateRight(n)
+			n.right, removed = removeInterval(n.right, item)
+		} else {
+			n = rotateLeft(n)
+			n.left, removed = removeInterval(n.left, item)
+		}
+	}
+	n.update()
+	return n, removed
+}
+
+// Insert adds the allocation to the tree. An identical allocation (same flight, start and end) is replaced
+func (t *AllocationIntervalTree) Insert(item AllocationItem) {
+	var added bool
+	t.root, added = insertInterval(t.root, &intervalNode{item: item, maxTo: item.To, priority: rand.Int63()})
+	if added {
+		t.size++
+	}
+}
+
+// Remove deletes the allocation with the same flight, start and end time as item
+func (t *AllocationIntervalTree) Remove(item AllocationItem) {
+	var removed bool
+	t.root, removed = removeInterval(t.root, &item)
+	if removed {
+		t.size--
+	}
+}
+
+// Overlapping calls fn, in order of start time, for each allocation that overlaps the window
+// from to (inclusive). The scan stops if fn returns false
+func (t *AllocationIntervalTree) Overlapping(from, to time.Time, fn func(*AllocationItem) bool) {
+	overlapping(t.root, from, to, fn)
+}
+
+func overlapping(n *intervalNode, from, to time.Time, fn func(*AllocationItem) bool) bool {
+	// Nothing in this subtree ends after the start of the window
+	if n == nil || n.maxTo.Before(from) {
+		return true
+	}
+	if !overlapping(n.left, from, to, fn) {
+		return false
+	}
+	// Everything to the right starts after this node, so if this one starts after the window so does the rest
+	if n.item.From.After(to) {
+		return true
+	}
+	if !n.item.To.Before(from) {
+		if !fn(&n.item) {
+			return false
+		}
+	}
+	return overlapping(n.right, from, to, fn)
+}
+
+// ForEach calls fn for every allocation in order of start time. The scan stops if fn returns false
+func (t *AllocationIntervalTree) ForEach(fn func(*AllocationItem) bool) {
+	forEachInterval(t.root, fn)
+}
+
+func forEachInterval(n *intervalNode, fn func(*AllocationItem) bool) bool {
+	if n == nil {
+		return true
+	}
+	return forEachInterval(n.left, fn) && fn(&n.item) && forEachInterval(n.right, fn)
+}
+
+func (t *AllocationIntervalTree) Len() int {
+	return t.size
+}
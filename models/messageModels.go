@@ -2,7 +2,10 @@ package models
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,11 +21,17 @@ type FixedResources struct {
 type FlightUpdateChannelMessage struct {
 	FlightID    string
 	AirportCode string
+
+	// The trace of the notification that changed the flight
+	Ctx context.Context
+}
+
+type FlightDeleteChannelMessage struct {
+	Flight Flight
+	Ctx    context.Context
 }
 
 type AllocationItem struct {
-	PrevNode             *AllocationItem `xml:"-" json:"-"`
-	NextNode             *AllocationItem `xml:"-" json:"-"`
 	ResourceID           string
 	From                 time.Time
 	To                   time.Time
@@ -48,73 +57,6 @@ type ConfiguredResourceResponseItem struct {
 	Area             string `xml:"Area"`
 }
 
-type AllocationLinkedList struct {
-	Head *AllocationItem
-	Tail *AllocationItem
-}
-
-func (ll *AllocationLinkedList) RemoveFlightAllocations(flightID string) {
-	currentNode := ll.Head
-
-	for currentNode != nil {
-		if currentNode.FlightID == flightID {
-
-			if currentNode.PrevNode != nil {
-				currentNode.PrevNode.NextNode = currentNode.NextNode
-			} else {
-				ll.Head = currentNode.NextNode
-			}
-
-			if currentNode.NextNode != nil {
-				currentNode.NextNode.PrevNode = currentNode.PrevNode
-			} else {
-				ll.Tail = currentNode.PrevNode
-			}
-
-			currentNode.PrevNode = nil
-			currentNode.NextNode = nil
-
-			//return // Node found and removed, exit the function
-		}
-
-		currentNode = currentNode.NextNode
-	}
-}
-
-func (ll *AllocationLinkedList) Len() int {
-	currentNode := ll.Head
-	count := 0
-
-	for currentNode != nil {
-		count++
-		currentNode = currentNode.NextNode
-	}
-
-	return count
-}
-func (ll *AllocationLinkedList) AddNode(newNode AllocationItem) {
-
-	newNode.PrevNode = ll.Tail
-	newNode.NextNode = nil
-
-	if ll.Tail != nil {
-		ll.Tail.NextNode = &newNode
-	}
-
-	ll.Tail = &newNode
-
-	if ll.Head == nil {
-		ll.Head = &newNode
-	}
-}
-
-type ResourceAllocationStruct struct {
-	PrevNode              *ResourceAllocationStruct
-	NextNode              *ResourceAllocationStruct
-	Resource              FixedResource
-	FlightAllocationsList AllocationLinkedList
-}
-
 type ParameterValuePair struct {
 	Parameter string `json:"Parameter,omitempty"`
 	Value     string `json:"Value,omitempty"`
@@ -137,6 +79,9 @@ type MetricsReport struct {
 	NumberOfCarouselAllocations int
 	NumberOfChutes              int
 	NumberOfChuteAllocations    int
+	NumberOfStaleUpdatesDropped int64
+	NumberOfStaleDeletesDropped int64
+	NumberOfDeletedFlightsKept  int
 	MemAllocMB                  int
 	MemHeapAllocMB              int
 	MemTotaAllocMB              int
@@ -144,10 +89,143 @@ type MetricsReport struct {
 	MemNumGC                    int
 }
 
+// HealthReport is the status of the service and of the components of each airport. Status is "ok",
+// "degraded" or "unavailable". The service is Ready once every airport has completed its first load from AMS
+type HealthReport struct {
+	Status      string           `json:"Status"`
+	Ready       bool             `json:"Ready"`
+	Version     string           `json:"Version"`
+	Airports    []AirportHealth  `json:"Airports"`
+	PushWorkers PushWorkerHealth `json:"PushWorkers"`
+}
+
+type AirportHealth struct {
+	Airport                      string          `json:"Airport"`
+	Status                       string          `json:"Status"`
+	Ready                        bool            `json:"Ready"`
+	AMSSOAP                      ComponentHealth `json:"AMSSOAP"`
+	AMSREST                      ComponentHealth `json:"AMSREST"`
+	Listener                     ListenerHealth  `json:"Listener"`
+	InitialLoad                  LoadProgress    `json:"InitialLoad"`
+	WindowLowerLimit             *time.Time      `json:"WindowLowerLimit,omitempty"`
+	WindowUpperLimit             *time.Time      `json:"WindowUpperLimit,omitempty"`
+	NumberOfFlights              int             `json:"NumberOfFlights"`
+	SnapshotStale                bool            `json:"SnapshotStale"`
+	LastNotification             *time.Time      `json:"LastNotification,omitempty"`
+	SecondsSinceLastNotification *int64          `json:"SecondsSinceLastNotification,omitempty"`
+	LastRefresh                  *time.Time      `json:"LastRefresh,omitempty"`
+	SecondsSinceLastRefresh      *int64          `json:"SecondsSinceLastRefresh,omitempty"`
+	LastRefreshComplete          bool            `json:"LastRefreshComplete"`
+	Refreshing                   bool            `json:"Refreshing"`
+	Problems                     []string        `json:"Problems,omitempty"`
+}
+
+// ComponentHealth is the result of the last check of a service the airport depends on
+type ComponentHealth struct {
+	Status    string     `json:"Status"`
+	Checked   *time.Time `json:"Checked,omitempty"`
+	LatencyMS int64      `json:"LatencyMS"`
+	Error     string     `json:"Error,omitempty"`
+}
+
+// ListenerHealth is the state of the notification listener, one of "not_configured", "starting",
+// "connected", "disconnected", "stopped" or "failed"
+type ListenerHealth struct {
+	Type                  string     `json:"Type"`
+	State                 string     `json:"State"`
+	Since                 *time.Time `json:"Since,omitempty"`
+	Error                 string     `json:"Error,omitempty"`
+	NotificationsReceived int64      `json:"NotificationsReceived"`
+}
+
+// LoadProgress is the progress of the first load of the repository, one of "waiting_for_ams",
+// "loading_resources", "loading_flights" or "loaded"
+type LoadProgress struct {
+	State        string     `json:"State"`
+	ChunksLoaded int        `json:"ChunksLoaded"`
+	ChunksTotal  int        `json:"ChunksTotal"`
+	Started      *time.Time `json:"Started,omitempty"`
+	Completed    *time.Time `json:"Completed,omitempty"`
+}
+
+type PushWorkerHealth struct {
+	Status                         string   `json:"Status"`
+	ChangePushOutboxOpen           bool     `json:"ChangePushOutboxOpen"`
+	ChangePushWorkers              int      `json:"ChangePushWorkers"`
+	ChangePushesSending            int      `json:"ChangePushesSending"`
+	ChangePushesPending            int      `json:"ChangePushesPending"`
+	OldestPendingChangePushSeconds int64    `json:"OldestPendingChangePushSeconds"`
+	FailingDestinations            []string `json:"FailingDestinations,omitempty"`
+	ScheduledPushWorkers           int      `json:"ScheduledPushWorkers"`
+	ScheduledPushQueueDepth        int      `json:"ScheduledPushQueueDepth"`
+	ScheduledPushQueueCapacity     int      `json:"ScheduledPushQueueCapacity"`
+	Problems                       []string `json:"Problems,omitempty"`
+}
+
+// DeadLetter is a notification that could not be parsed or applied
+type DeadLetter struct {
+	ID          int64     `json:"ID"`
+	Airport     string    `json:"Airport"`
+	Listener    string    `json:"Listener"`
+	Error       string    `json:"Error"`
+	Received    time.Time `json:"Received"`
+	Attempts    int       `json:"Attempts"`
+	LastAttempt time.Time `json:"LastAttempt"`
+	Message     string    `json:"Message,omitempty"`
+}
+
+// UserUsage is the use of the API by a user since the service started, and their limits. A limit of zero is no limit
+type UserUsage struct {
+	UserName              string     `json:"UserName"`
+	RateLimitPerSecond    float64    `json:"RateLimitPerSecond"`
+	RateLimitBurst        int        `json:"RateLimitBurst"`
+	TokensAvailable       float64    `json:"TokensAvailable"`
+	MaxConcurrentRequests int        `json:"MaxConcurrentRequests"`
+	ConcurrentRequests    int        `json:"ConcurrentRequests"`
+	DailyRequestQuota     int        `json:"DailyRequestQuota"`
+	RequestsToday         int        `json:"RequestsToday"`
+	TotalRequests         int64      `json:"TotalRequests"`
+	RateLimited           int64      `json:"RateLimited"`
+	ConcurrencyLimited    int64      `json:"ConcurrencyLimited"`
+	QuotaExceeded         int64      `json:"QuotaExceeded"`
+	LastRequest           *time.Time `json:"LastRequest,omitempty"`
+}
+
+// Subscription is a change or push subscription of a user with the Change or Push definition set.
+// Subscriptions from users.json have no ID and can only be changed by editing the file
+type Subscription struct {
+	ID       int64                   `json:"ID"`
+	UserName string                  `json:"UserName"`
+	Type     string                  `json:"Type"`
+	Source   string                  `json:"Source"`
+	Created  *time.Time              `json:"Created,omitempty"`
+	Updated  *time.Time              `json:"Updated,omitempty"`
+	Change   *UserChangeSubscription `json:"Change,omitempty"`
+	Push     *UserPushSubscription   `json:"Push,omitempty"`
+}
+
+// UserAccount is a user profile as shown to the administrator, without the key or its hash.
+// Users from users.json have no Created or Updated time and can only be changed by editing the file
+type UserAccount struct {
+	Source  string      `json:"Source"`
+	Created *time.Time  `json:"Created,omitempty"`
+	Updated *time.Time  `json:"Updated,omitempty"`
+	User    UserProfile `json:"User"`
+}
+
 type UserProfile struct {
 	Enabled                      bool                     `json:"Enabled"`
 	UserName                     string                   `json:"UserName"`
 	Key                          string                   `json:"Key"`
+	KeyHash                      string                   `json:"KeyHash,omitempty"`
+	KeyPrefix                    string                   `json:"KeyPrefix,omitempty"`
+	KeyExpires                   string                   `json:"KeyExpires,omitempty"`
+	ClientID                     string                   `json:"ClientID,omitempty"`
+	Roles                        []string                 `json:"Roles,omitempty"`
+	RateLimitPerSecond           float64                  `json:"RateLimitPerSecond,omitempty"`
+	RateLimitBurst               int                      `json:"RateLimitBurst,omitempty"`
+	MaxConcurrentRequests        int                      `json:"MaxConcurrentRequests,omitempty"`
+	DailyRequestQuota            int                      `json:"DailyRequestQuota,omitempty"`
 	AllowedAirports              []string                 `json:"AllowedAirports"`
 	AllowedAirlines              []string                 `json:"AllowedAirlines"`
 	AllowedCustomFields          []string                 `json:"AllowedCustomFields"`
@@ -155,6 +233,9 @@ type UserProfile struct {
 	DefaultQueryableCustomFields []ParameterValuePair     `json:"DefaultQueryableCustomFields"`
 	UserPushSubscriptions        []UserPushSubscription   `json:"UserPushSubscriptions"`
 	UserChangeSubscriptions      []UserChangeSubscription `json:"UserChangeSubscriptions"`
+
+	// Set for bearer token clients given the profile of a role in JWTRoleProfiles, which have no user of their own
+	RoleMapped bool `json:"-"`
 }
 
 type UserPushSubscription struct {
@@ -177,6 +258,10 @@ type UserPushSubscription struct {
 	Route                 string
 	Direction             string
 	TrustBadCertificates  bool
+	SigningSecret         string
+
+	// The ID of the subscription in the subscription store, zero for those in the user's profile
+	SubscriptionID int64 `json:"-"`
 }
 
 type UserChangeSubscription struct {
@@ -197,78 +282,18 @@ type UserChangeSubscription struct {
 	All                      bool
 	ParameterChange          []string
 	TrustBadCertificates     bool
+	SigningSecret            string
+
+	// The user the subscription belongs to and the ID of the subscription in the subscription store,
+	// zero for those in the user's profile
+	UserName       string `json:"-"`
+	SubscriptionID int64  `json:"-"`
 }
 
 type Users struct {
 	Users []UserProfile `json:"users"`
 }
 
-type ResourceLinkedList struct {
-	Head *ResourceAllocationStruct
-	Tail *ResourceAllocationStruct
-}
-
-func (ll *ResourceLinkedList) AddAllocation(node AllocationItem) {
-	currentNode := ll.Head
-
-	for currentNode != nil {
-		if currentNode.Resource.Name == node.ResourceID {
-			currentNode.FlightAllocationsList.AddNode(node)
-			break
-		}
-		currentNode = currentNode.NextNode
-	}
-}
-func (ll *ResourceLinkedList) AddNodes(nodes []FixedResource) {
-	for _, node := range nodes {
-		newNode := ResourceAllocationStruct{Resource: node}
-		ll.AddNode(newNode)
-	}
-}
-func (ll *ResourceLinkedList) AddNode(newNode ResourceAllocationStruct) {
-
-	newNode.PrevNode = ll.Tail
-	newNode.NextNode = nil
-
-	if ll.Tail != nil {
-		ll.Tail.NextNode = &newNode
-	}
-
-	ll.Tail = &newNode
-
-	if ll.Head == nil {
-		ll.Head = &newNode
-	}
-}
-func (ll *ResourceLinkedList) RemoveFlightAllocation(flightID string) {
-	currentNode := ll.Head
-
-	for currentNode != nil {
-		currentNode.FlightAllocationsList.RemoveFlightAllocations(flightID)
-		currentNode = currentNode.NextNode
-	}
-}
-func (ll *ResourceLinkedList) Len() int {
-	currentNode := ll.Head
-	count := 0
-
-	for currentNode != nil {
-		count++
-		currentNode = currentNode.NextNode
-	}
-
-	return count
-}
-func (ll *ResourceLinkedList) NumberOfFlightAllocations() (n int) {
-	currentNode := ll.Head
-
-	for currentNode != nil {
-		n = n + currentNode.FlightAllocationsList.Len()
-		currentNode = currentNode.NextNode
-	}
-	return
-}
-
 type FlightResponseItem struct {
 	FlightPtr *Flight
 	STO       time.Time
@@ -334,8 +359,11 @@ func (ll *FlightLinkedList) GetFlight(flightID string) *Flight {
 	return nil
 }
 
+// GetFlight returns the flight or nil if it is not in the repository. Must not be called while holding the write lock
 func (rep *Repository) GetFlight(flightID string) *Flight {
-	return rep.FlightLinkedList.GetFlight(flightID)
+	rep.RLock()
+	defer rep.RUnlock()
+	return rep.FlightList.GetFlight(flightID)
 }
 
 func (ll *FlightLinkedList) Len() int {
@@ -436,16 +464,46 @@ type Repository struct {
 	RabbitMQConnectionString            string `json:"RabbitMQConnectionString"`
 	RabbitMQExchange                    string `json:"RabbitMQExchange"`
 	RabbitMQTopic                       string `json:"RabbitMQTopic"`
+	RabbitMQQueue                       string `json:"RabbitMQQueue"`
+	RabbitMQPrefetch                    int    `json:"RabbitMQPrefetch"`
 	NotificationListenerQueue           string `json:"NotificationListenerQueue"`
+	NotificationDirectory               string `json:"NotificationDirectory"`
+	NotificationIngestToken             string `json:"NotificationIngestToken"`
 	LoadFlightChunkSizeInDays           int    `json:"LoadFlightChunkSizeInDays"`
-	FlightLinkedList                    FlightLinkedList
+	FlightList                          FlightIndexedList
 	CurrentLowerLimit                   time.Time
 	CurrentUpperLimit                   time.Time
-	CheckInList                         ResourceLinkedList
-	StandList                           ResourceLinkedList
-	GateList                            ResourceLinkedList
-	CarouselList                        ResourceLinkedList
-	ChuteList                           ResourceLinkedList
+	CheckInList                         ResourceIndexedList
+	StandList                           ResourceIndexedList
+	GateList                            ResourceIndexedList
+	CarouselList                        ResourceIndexedList
+	ChuteList                           ResourceIndexedList
+	FlightHistory                       FlightHistory
+	FlightTombstones                    FlightTombstones
+	snapshotStale                       int32
+	staleUpdatesDropped                 int64
+	staleDeletesDropped                 int64
+	mu                                  sync.RWMutex
+}
+
+// Each repository has its own lock so queries against different airports never contend.
+// Writers (notifications and the scheduled refresh) hold the write lock while they change the
+// flights, allocations and limits. Queries hold the read lock only while they take their snapshot.
+//
+// Flights are never modified once they have been added to the FlightList, an update replaces the
+// flight with a new one, so a *Flight taken under the read lock remains a consistent view of the
+// flight after the lock is released
+func (r *Repository) Lock() {
+	r.mu.Lock()
+}
+func (r *Repository) Unlock() {
+	r.mu.Unlock()
+}
+func (r *Repository) RLock() {
+	r.mu.RLock()
+}
+func (r *Repository) RUnlock() {
+	r.mu.RUnlock()
 }
 
 func (r *Repository) RemoveFlightAllocation(flightID string) {
@@ -462,6 +520,37 @@ func (r *Repository) UpdateUpperLimit(t time.Time) {
 	r.CurrentUpperLimit = t
 }
 
+// SetSnapshotStale marks whether the repository content was loaded from the local snapshot
+// and has not yet been reconciled with AMS
+func (r *Repository) SetSnapshotStale(stale bool) {
+	if stale {
+		atomic.StoreInt32(&r.snapshotStale, 1)
+	} else {
+		atomic.StoreInt32(&r.snapshotStale, 0)
+	}
+}
+func (r *Repository) IsSnapshotStale() bool {
+	return atomic.LoadInt32(&r.snapshotStale) == 1
+}
+
+// CountStaleUpdateDropped records a notification that was dropped because the repository
+// already held a newer version of the flight
+func (r *Repository) CountStaleUpdateDropped() {
+	atomic.AddInt64(&r.staleUpdatesDropped, 1)
+}
+func (r *Repository) StaleUpdatesDropped() int64 {
+	return atomic.LoadInt64(&r.staleUpdatesDropped)
+}
+
+// CountStaleDeleteDropped records a delete notification that was dropped because the repository
+// already held a newer version of the flight
+func (r *Repository) CountStaleDeleteDropped() {
+	atomic.AddInt64(&r.staleDeletesDropped, 1)
+}
+func (r *Repository) StaleDeletesDropped() int64 {
+	return atomic.LoadInt64(&r.staleDeletesDropped)
+}
+
 type Repositories struct {
 	Repositories []Repository `json:"airports"`
 }
@@ -520,6 +609,9 @@ func (r *Response) AddWarning(w string) {
 func (r *Response) AddError(w string) {
 	r.Errors = append(r.Errors, w)
 }
+func (r *ResourceResponse) AddWarning(w string) {
+	r.Warnings = append(r.Warnings, w)
+}
 
 func (d ResourceResponse) WriteJSON(fwb *bufio.Writer) error {
 
@@ -607,10 +699,10 @@ func (r *GetFlightsError) Error() string {
 type ChangePushJob struct {
 	Sub    UserChangeSubscription
 	Flight *Flight
+	Ctx    context.Context
 }
 type SchedulePushJob struct {
 	Sub         UserPushSubscription
-	UserToken   string
 	UserName    string
 	UserProfile *UserProfile
 }
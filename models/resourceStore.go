@@ -0,0 +1,117 @@
+package models
+
+import "time"
+
+type ResourceAllocationStruct struct {
+	Resource          FixedResource
+	FlightAllocations AllocationIntervalTree
+}
+
+// ResourceIndexedList holds the configured resources of one resource type and the flights allocated to them.
+// Resources are indexed by name and each resource keeps its allocations in an interval tree.
+// An index of flight ID to the resources the flight is allocated to means removing the
+// allocations of a flight only touches those resources
+type ResourceIndexedList struct {
+	byName   map[string]*ResourceAllocationStruct
+	ordered  []*ResourceAllocationStruct
+	byFlight map[string][]AllocationItem
+}
+
+func (ll *ResourceIndexedList) init() {
+	if ll.byName == nil {
+		ll.byName = make(map[string]*ResourceAllocationStruct)
+		ll.byFlight = make(map[string][]AllocationItem)
+	}
+}
+
+// AddAllocation adds the allocation to the resource named by node.ResourceID.
+// Allocations to resources that have not been configured are ignored
+func (ll *ResourceIndexedList) AddAllocation(node AllocationItem) {
+	ll.init()
+
+	r, ok := ll.byName[node.ResourceID]
+	if !ok {
+		return
+	}
+	r.FlightAllocations.Insert(node)
+	ll.byFlight[node.FlightID] = append(ll.byFlight[node.FlightID], node)
+}
+
+// AddNodes adds the resources. New entries will be added, existing entries will be left untouched
+func (ll *ResourceIndexedList) AddNodes(nodes []FixedResource) {
+	for _, node := range nodes {
+		ll.AddNode(ResourceAllocationStruct{Resource: node})
+	}
+}
+
+func (ll *ResourceIndexedList) AddNode(newNode ResourceAllocationStruct) {
+	ll.init()
+
+	if _, ok := ll.byName[newNode.Resource.Name]; ok {
+		return
+	}
+	ll.byName[newNode.Resource.Name] = &newNode
+	ll.ordered = append(ll.ordered, &newNode)
+}
+
+func (ll *ResourceIndexedList) RemoveFlightAllocation(flightID string) {
+
+	for _, alloc := range ll.byFlight[flightID] {
+		if r, ok := ll.byName[alloc.ResourceID]; ok {
+			r.FlightAllocations.Remove(alloc)
+		}
+	}
+	delete(ll.byFlight, flightID)
+}
+
+// FlightAllocations returns a copy of the allocations of the flight to resources in this list
+func (ll *ResourceIndexedList) FlightAllocations(flightID string) []AllocationItem {
+	return append([]AllocationItem(nil), ll.byFlight[flightID]...)
+}
+
+// GetResource returns the named resource or nil if it is not configured
+func (ll *ResourceIndexedList) GetResource(name string) *ResourceAllocationStruct {
+	return ll.byName[name]
+}
+
+// ForEach calls fn for each resource in the order they were configured. The scan stops if fn returns false
+func (ll *ResourceIndexedList) ForEach(fn func(*ResourceAllocationStruct) bool) {
+	for _, r := range ll.ordered {
+		if !fn(r) {
+			return
+		}
+	}
+}
+
+// Overlapping calls fn for each allocation that overlaps the window from to (inclusive).
+// If resource is not empty, only the allocations of that resource are visited
+func (ll *ResourceIndexedList) Overlapping(resource string, from, to time.Time, fn func(*ResourceAllocationStruct, *AllocationItem) bool) {
+
+	visit := func(r *ResourceAllocationStruct) bool {
+		cont := true
+		r.FlightAllocations.Overlapping(from, to, func(a *AllocationItem) bool {
+			cont = fn(r, a)
+			return cont
+		})
+		return cont
+	}
+
+	if resource != "" {
+		if r := ll.byName[resource]; r != nil {
+			visit(r)
+		}
+		return
+	}
+	ll.ForEach(visit)
+}
+
+func (ll *ResourceIndexedList) Len() int {
+	return len(ll.ordered)
+}
+
+func (ll *ResourceIndexedList) NumberOfFlightAllocations() (n int) {
+	for _, r := range ll.ordered {
+		n = n + r.FlightAllocations.Len()
+	}
+	return
+}
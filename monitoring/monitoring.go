@@ -0,0 +1,135 @@
+package monitoring
+
+/*
+
+The Prometheus metrics of the service, exposed in the Prometheus text format at /metrics.
+
+The metrics measured as the service runs are defined here and updated where the work is done. The
+metrics that describe the current state of the service, like the size of the repositories and the
+depth of the queues, are read when the metrics are scraped by collectors registered with Register.
+The Go runtime and process metrics are included
+
+*/
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "frapi"
+
+// The buckets of the durations of the filtering and sorting of flights and allocations, which are
+// usually much faster than a request
+var filterBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+var (
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the API requests by route, method and status",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	UserRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "API requests by user",
+	}, []string{"user"})
+
+	FilterDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "filter_duration_seconds",
+		Help:      "Duration of filtering and sorting the flights and allocations of a request, by operation and airport",
+		Buckets:   filterBuckets,
+	}, []string{"operation", "airport"})
+
+	NotificationsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "notifications",
+		Name:      "received_total",
+		Help:      "Notifications received from AMS by airport and type",
+	}, []string{"airport", "type"})
+
+	NotificationsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "notifications",
+		Name:      "processed_total",
+		Help:      "Notifications processed by airport, type and result (applied or failed)",
+	}, []string{"airport", "type", "result"})
+
+	ChangePushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "change_push",
+		Name:      "attempts_total",
+		Help:      "Attempts to deliver change pushes by destination host and result (success, failure or expired)",
+	}, []string{"destination", "result"})
+
+	ScheduledPushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scheduled_push",
+		Name:      "attempts_total",
+		Help:      "Scheduled pushes sent by destination host and result (success or failure)",
+	}, []string{"destination", "result"})
+
+	AMSRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ams",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the calls to AMS, including retries, by airport and operation",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"airport", "operation"})
+
+	AMSRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ams",
+		Name:      "request_errors_total",
+		Help:      "Failed calls to AMS by airport, operation and reason",
+	}, []string{"airport", "operation", "reason"})
+
+	AMSRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ams",
+		Name:      "request_retries_total",
+		Help:      "Retries of calls to AMS after transient failures by airport and operation",
+	}, []string{"airport", "operation"})
+)
+
+// Register adds a collector of metrics read when the metrics are scraped
+func Register(collector prometheus.Collector) {
+	if err := prometheus.Register(collector); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if !errors.As(err, &registered) {
+			panic(err)
+		}
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Result returns the result label of an operation that failed if there is an error
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Destination returns the host of the destination URL of a push, so the labels do not include paths
+// or query parameters that may carry credentials
+func Destination(destinationURL string) string {
+	u, err := url.Parse(destinationURL)
+	if err != nil || u.Host == "" {
+		return "invalid"
+	}
+	return u.Host
+}
@@ -0,0 +1,49 @@
+package repo
+
+import (
+	"sync"
+
+	"flightresourcerestapi/ams"
+	"flightresourcerestapi/models"
+)
+
+// NewAMSClient creates the client used to access AMS for the repository. Replace it to substitute a fake AMS
+var NewAMSClient = func(repo *models.Repository) ams.Client {
+	return ams.NewClient(ams.ConfigFromRepository(repo))
+}
+
+var amsClients = make(map[string]ams.Client)
+var amsClientsMutex = &sync.Mutex{}
+
+// getAMSClient returns the AMS client of the airport, creating it on first use
+func getAMSClient(airportCode string) ams.Client {
+	amsClientsMutex.Lock()
+	defer amsClientsMutex.Unlock()
+
+	client := amsClients[airportCode]
+	if client == nil {
+		client = NewAMSClient(GetRepo(airportCode))
+		amsClients[airportCode] = client
+	}
+	return client
+}
+
+// resetAMSClient discards the AMS client of the airport so the next call picks up a changed configuration
+func resetAMSClient(airportCode string) {
+	amsClientsMutex.Lock()
+	defer amsClientsMutex.Unlock()
+
+	delete(amsClients, airportCode)
+}
+
+// AMSMetrics returns the metrics of the calls made to AMS for the airport, by operation
+func AMSMetrics(airportCode string) map[string]ams.OperationMetrics {
+	amsClientsMutex.Lock()
+	client := amsClients[airportCode]
+	amsClientsMutex.Unlock()
+
+	if client == nil {
+		return map[string]ams.OperationMetrics{}
+	}
+	return client.Metrics()
+}
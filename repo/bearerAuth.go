@@ -0,0 +1,194 @@
+package repo
+
+/*
+
+Users can be authenticated with a JWT bearer token issued by an identity provider in place of the
+Token header. Tokens are accepted when JWTJWKSFile or JWTJWKSURL is configured.
+
+The token's client ID claim (JWTClientIDClaim, default "client_id", falling back to "azp" and "sub")
+selects the user whose ClientID is the client ID. If there is no such user, the first of the token's
+roles (JWTRolesClaim, default "roles") in JWTRoleProfiles selects the user whose profile is used,
+with the client ID as the user name. The token's roles in JWTRoleMappings are mapped to the roles of
+the service, which are added to the Roles of the profile. Other roles of the token give no permissions.
+If the token has an airline claim (JWTAirlineClaim, default "airline"), the allowed airlines are
+limited to the airlines in the claim
+
+*/
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/jwtauth"
+	"flightresourcerestapi/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var bearerValidator *jwtauth.Validator
+var bearerValidatorOnce sync.Once
+
+// getBearerValidator returns the validator for bearer tokens, or nil if no key set is configured
+func getBearerValidator() *jwtauth.Validator {
+
+	bearerValidatorOnce.Do(func() {
+
+		file := globals.ConfigViper.GetString("JWTJWKSFile")
+		url := globals.ConfigViper.GetString("JWTJWKSURL")
+		if file == "" && url == "" {
+			return
+		}
+
+		refresh := globals.ConfigViper.GetInt("JWTJWKSRefreshInMinutes")
+		if refresh < 1 {
+			refresh = 60
+		}
+		leeway := jwtauth.DefaultLeeway
+		if globals.ConfigViper.IsSet("JWTLeewayInSeconds") {
+			leeway = time.Duration(globals.ConfigViper.GetInt("JWTLeewayInSeconds")) * time.Second
+		}
+
+		bearerValidator = &jwtauth.Validator{
+			Keys:     &jwtauth.KeySource{File: file, URL: url, Refresh: time.Duration(refresh) * time.Minute},
+			Issuer:   globals.ConfigViper.GetString("JWTIssuer"),
+			Audience: globals.ConfigViper.GetString("JWTAudience"),
+			Leeway:   leeway,
+		}
+		globals.Logger.Info(fmt.Sprintf("Bearer token authentication enabled. Issuer: %s Audience: %s", bearerValidator.Issuer, bearerValidator.Audience))
+	})
+
+	return bearerValidator
+}
+
+// bearerToken returns the token of the Authorization header if it is a bearer token
+func bearerToken(c *gin.Context) (string, bool) {
+	auth := c.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:]), true
+	}
+	return "", false
+}
+
+// userProfileForBearer returns the profile of the user for the token. An empty profile, which is not
+// enabled, is returned if the token is not valid or does not map to a user
+func userProfileForBearer(token string) models.UserProfile {
+
+	validator := getBearerValidator()
+	if validator == nil {
+		globals.Logger.Warn("Bearer token received but bearer token authentication is not configured")
+		return models.UserProfile{}
+	}
+
+	claims, err := validator.Validate(token)
+	if err != nil {
+		globals.Logger.Warn(fmt.Sprintf("Bearer token rejected: %s", err))
+		return models.UserProfile{}
+	}
+
+	clientID := claims.String(configString("JWTClientIDClaim", "client_id"))
+	if clientID == "" {
+		clientID = claims.String("azp")
+	}
+	if clientID == "" {
+		clientID = claims.String("sub")
+	}
+	roles := claims.Strings(configString("JWTRolesClaim", "roles"))
+
+	profile, ok := profileForClient(clientID, roles)
+	if !ok {
+		globals.Logger.Warn(fmt.Sprintf("Bearer token for client %s with roles %v does not map to a user", clientID, roles))
+		return models.UserProfile{}
+	}
+
+	profile.Key = ""
+	profile.KeyHash = ""
+	for _, role := range serviceRoles(roles) {
+		if !globals.Contains(profile.Roles, role) {
+			profile.Roles = append(profile.Roles, role)
+		}
+	}
+	if airlines := claims.Strings(configString("JWTAirlineClaim", "airline")); airlines != nil {
+		restrictAirlines(&profile, airlines)
+	}
+	return profile
+}
+
+// serviceRoles returns the roles of the service the roles of the token are mapped to in JWTRoleMappings,
+// a map of the token's role to a role or list of roles of the service
+func serviceRoles(tokenRoles []string) []string {
+
+	// Viper keys are not case sensitive so the roles are matched without case
+	mappings := globals.ConfigViper.GetStringMapStringSlice("JWTRoleMappings")
+
+	roles := []string{}
+	for _, tokenRole := range tokenRoles {
+		for _, role := range mappings[strings.ToLower(tokenRole)] {
+			if !globals.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// profileForClient returns the profile of the user with the client ID or, failing that, the profile
+// mapped to the first of the roles in JWTRoleProfiles
+func profileForClient(clientID string, roles []string) (models.UserProfile, bool) {
+
+	if clientID == "" {
+		return models.UserProfile{}, false
+	}
+
+	users := userProfiles()
+	for _, u := range users {
+		if u.ClientID == clientID {
+			return u, true
+		}
+	}
+
+	// Viper keys are not case sensitive so the roles are matched without case
+	roleProfiles := globals.ConfigViper.GetStringMapString("JWTRoleProfiles")
+	for _, role := range roles {
+		userName, ok := roleProfiles[strings.ToLower(role)]
+		if !ok {
+			continue
+		}
+		for _, u := range users {
+			if u.UserName == userName {
+				u.UserName = clientID
+				u.UserPushSubscriptions = nil
+				u.UserChangeSubscriptions = nil
+				u.RoleMapped = true
+				return u, true
+			}
+		}
+		globals.Logger.Warn(fmt.Sprintf("User %s for role %s in JWTRoleProfiles not found", userName, role))
+	}
+	return models.UserProfile{}, false
+}
+
+// restrictAirlines limits the allowed airlines of the profile, where no list allows all, to the airlines of the token
+func restrictAirlines(profile *models.UserProfile, airlines []string) {
+
+	allowed := []string{}
+	for _, airline := range airlines {
+		if profile.AllowedAirlines == nil || globals.Contains(profile.AllowedAirlines, airline) || globals.Contains(profile.AllowedAirlines, "*") {
+			allowed = append(allowed, airline)
+		}
+	}
+	profile.AllowedAirlines = allowed
+
+	if !globals.Contains(allowed, profile.DefaultAirline) {
+		profile.DefaultAirline = ""
+	}
+}
+
+func configString(key, defaultValue string) string {
+	if value := globals.ConfigViper.GetString(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,457 @@
+package repo
+
+/*
+
+Change pushes are written to an outbox, a SQLite database in the PersistenceDirectory, before they are
+sent, so pushes that could not be delivered survive a restart. Each destination URL has its own lane
+that sends its pushes one at a time in the order they were queued. A failed push is retried with an
+exponential backoff and jitter, holding back the later pushes to the same destination, until it is
+delivered or is older than ChangePushMaxAgeInMinutes
+
+*/
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/monitoring"
+	"flightresourcerestapi/signing"
+	"flightresourcerestapi/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const outboxSchema = `
+CREATE TABLE IF NOT EXISTS outbox(id INTEGER PRIMARY KEY AUTOINCREMENT, destination TEXT, airport TEXT, flightid TEXT,
+	username TEXT, subscriptionid INTEGER, deliveryid TEXT, tracecontext TEXT, payload BLOB, created TEXT, attempts INTEGER, nextattempt TEXT, lasterror TEXT);
+CREATE INDEX IF NOT EXISTS outbox_destination ON outbox(destination, id);
+`
+
+// The wait before retrying a lane after the outbox could not be read
+const outboxErrorRetryInterval = 5 * time.Second
+
+type outboxEntry struct {
+	id             int64
+	destination    string
+	airport        string
+	flightID       string
+	userName       string
+	subscriptionID int64
+	deliveryID     string
+	traceContext   string
+	payload        []byte
+	created        time.Time
+	attempts       int
+	nextAttempt    time.Time
+}
+
+type outboxLane struct {
+	destination string
+	wake        chan struct{}
+
+	// Guarded by the outbox mutex
+	delivered int64
+	retried   int64
+	expired   int64
+	lastError string
+}
+
+type changePushOutbox struct {
+	db      *sql.DB
+	sending chan struct{}
+
+	mu    sync.Mutex
+	lanes map[string]*outboxLane
+}
+
+var outbox *changePushOutbox
+var outboxOnce sync.Once
+
+// Why the outbox could not be opened, reported by the health endpoints
+var outboxError error
+
+// StartChangePushWorkerPool opens the outbox and starts the lanes of the pushes that were not delivered
+// before the last shutdown. At most numWorkers pushes are sent at a time
+func StartChangePushWorkerPool(numWorkers int) {
+
+	outboxOnce.Do(func() {
+		if numWorkers < 1 {
+			numWorkers = 1
+		}
+
+		dir := globals.ConfigViper.GetString("PersistenceDirectory")
+		if dir == "" {
+			dir = "."
+		}
+		dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL", filepath.Join(dir, "outbox.db"))
+
+		db, err := sql.Open("sqlite3", dsn)
+		if err == nil {
+			db.SetMaxOpenConns(1)
+			_, err = db.Exec(outboxSchema)
+		}
+		if err != nil {
+			outboxError = err
+			globals.Logger.Error(fmt.Sprintf("Could not open the change push outbox. Change pushes will not be sent: %s", err))
+			return
+		}
+
+		outbox = &changePushOutbox{db: db, sending: make(chan struct{}, numWorkers), lanes: make(map[string]*outboxLane)}
+
+		rows, err := db.Query("SELECT DISTINCT destination FROM outbox")
+		if err != nil {
+			globals.Logger.Error(fmt.Sprintf("Could not read the change push outbox: %s", err))
+			return
+		}
+		destinations := []string{}
+		for rows.Next() {
+			var destination string
+			if rows.Scan(&destination) == nil {
+				destinations = append(destinations, destination)
+			}
+		}
+		rows.Close()
+
+		for _, destination := range destinations {
+			globals.Logger.Info(fmt.Sprintf("Resuming change pushes to %s", destination))
+			outbox.wakeLane(destination)
+		}
+	})
+}
+
+// queueChangePush writes the push to the outbox. The flight is serialised now so the push carries the
+// flight as it was when it changed
+func queueChangePush(job models.ChangePushJob) {
+
+	// Changes can be received before the push schedules of the airport have been set up
+	StartChangePushWorkerPool(globals.ConfigViper.GetInt("NumberOfChangePushWorkers"))
+
+	if outbox == nil {
+		globals.Logger.Error(fmt.Sprintf("Change Push to %s dropped, the outbox is not available", job.Sub.DestinationURL))
+		return
+	}
+
+	payload, err := json.Marshal(*job.Flight)
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Change Push to %s dropped, could not serialise the flight: %s", job.Sub.DestinationURL, err))
+		return
+	}
+	now := time.Now().Format(snapshotTimeLayout)
+
+	// The trace is stored with the push so its delivery, which may be after a restart, is in the trace
+	ctx, span := tracing.StartSpan(job.Ctx, "queueChangePush", trace.WithAttributes(attribute.String("flight.id", job.Flight.GetFlightID()), attribute.String("destination", monitoring.Destination(job.Sub.DestinationURL))))
+	defer span.End()
+
+	// The delivery ID is kept for the retries so the receiver can discard duplicates. The signing secret and
+	// headers are not stored, they are taken from the subscription when the push is sent
+	_, err = outbox.db.Exec("INSERT INTO outbox(destination, airport, flightid, username, subscriptionid, deliveryid, tracecontext, payload, created, attempts, nextattempt, lasterror) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, '')",
+		job.Sub.DestinationURL, job.Flight.GetIATAAirport(), job.Flight.GetFlightID(), job.Sub.UserName, job.Sub.SubscriptionID, signing.NewDeliveryID(), tracing.Encode(ctx), payload, now, now)
+	if err != nil {
+		tracing.End(span, err)
+		globals.Logger.Error(fmt.Sprintf("Change Push to %s dropped, could not write to the outbox: %s", job.Sub.DestinationURL, err))
+		return
+	}
+
+	outbox.wakeLane(job.Sub.DestinationURL)
+}
+
+// wakeLane tells the lane of the destination there is a push to send, starting the lane if required
+func (o *changePushOutbox) wakeLane(destination string) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	lane := o.lanes[destination]
+	if lane == nil {
+		// The lanes are registered with the shutdown wait group so none are started once stopping
+		if globals.Ctx.Err() != nil {
+			return
+		}
+		lane = &outboxLane{destination: destination, wake: make(chan struct{}, 1)}
+		o.lanes[destination] = lane
+		globals.ShutdownWg.Add(1)
+		go o.runLane(lane)
+	}
+
+	select {
+	case lane.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runLane sends the pushes to the destination in order until the service is stopped. Pushes not yet
+// delivered remain in the outbox and are sent after the restart
+func (o *changePushOutbox) runLane(lane *outboxLane) {
+
+	defer globals.ShutdownWg.Done()
+
+	maxAge := time.Duration(globals.ConfigViper.GetInt("ChangePushMaxAgeInMinutes")) * time.Minute
+	if maxAge <= 0 {
+		maxAge = time.Hour
+	}
+
+	for {
+		entry, err := o.next(lane.destination)
+		if err != nil {
+			globals.Logger.Error(fmt.Sprintf("Could not read the change push outbox for %s: %s", lane.destination, err))
+			if !o.wait(lane, outboxErrorRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		// Nothing to send until woken by the next push
+		if entry == nil {
+			if !o.wait(lane, -1) {
+				return
+			}
+			continue
+		}
+
+		if time.Since(entry.created) > maxAge {
+			globals.Logger.Warn(fmt.Sprintf("Change Push of %s to %s abandoned after %d attempts, older than %s", entry.flightID, lane.destination, entry.attempts, maxAge))
+			o.remove(entry.id)
+			o.mu.Lock()
+			lane.expired++
+			o.mu.Unlock()
+			monitoring.ChangePushes.WithLabelValues(monitoring.Destination(lane.destination), "expired").Inc()
+			continue
+		}
+
+		if delay := time.Until(entry.nextAttempt); delay > 0 {
+			if !o.wait(lane, delay) {
+				return
+			}
+			continue
+		}
+
+		// The subscription may have been removed or disabled while the push was waiting
+		sub, subscribed := outboxSubscription(entry)
+		if !subscribed {
+			globals.Logger.Warn(fmt.Sprintf("Change Push of %s to %s abandoned, the subscription of %s is no longer enabled", entry.flightID, lane.destination, entry.userName))
+			o.remove(entry.id)
+			o.mu.Lock()
+			lane.expired++
+			o.mu.Unlock()
+			monitoring.ChangePushes.WithLabelValues(monitoring.Destination(lane.destination), "expired").Inc()
+			continue
+		}
+
+		select {
+		case o.sending <- struct{}{}:
+		case <-globals.Ctx.Done():
+			return
+		}
+		err = deliverChangePush(entry, sub)
+		<-o.sending
+		monitoring.ChangePushes.WithLabelValues(monitoring.Destination(lane.destination), monitoring.Result(err)).Inc()
+
+		if err == nil {
+			o.remove(entry.id)
+			o.mu.Lock()
+			lane.delivered++
+			o.mu.Unlock()
+			continue
+		}
+
+		entry.attempts++
+		backoff := changePushBackoff(entry.attempts)
+		globals.Logger.Error(fmt.Sprintf("Change Push of %s to %s failed (attempt %d), retrying in %s: %s", entry.flightID, lane.destination, entry.attempts, backoff.Round(time.Millisecond), err))
+
+		_, dbErr := o.db.Exec("UPDATE outbox SET attempts = ?, nextattempt = ?, lasterror = ? WHERE id = ?",
+			entry.attempts, time.Now().Add(backoff).Format(snapshotTimeLayout), err.Error(), entry.id)
+		if dbErr != nil {
+			globals.Logger.Error(fmt.Sprintf("Could not update the change push outbox: %s", dbErr))
+		}
+		o.mu.Lock()
+		lane.retried++
+		lane.lastError = err.Error()
+		o.mu.Unlock()
+	}
+}
+
+// wait waits for the lane to be woken, for the delay if it is not negative, or for the service to stop.
+// Returns false if the service is stopping
+func (o *changePushOutbox) wait(lane *outboxLane, delay time.Duration) bool {
+
+	var timer <-chan time.Time
+	if delay >= 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case <-lane.wake:
+	case <-timer:
+	case <-globals.Ctx.Done():
+		return false
+	}
+	return true
+}
+
+// next returns the oldest push to the destination, or nil if there are none
+func (o *changePushOutbox) next(destination string) (*outboxEntry, error) {
+
+	var entry outboxEntry
+	var created, nextAttempt string
+
+	err := o.db.QueryRow("SELECT id, destination, airport, flightid, username, subscriptionid, deliveryid, tracecontext, payload, created, attempts, nextattempt FROM outbox WHERE destination = ? ORDER BY id LIMIT 1", destination).
+		Scan(&entry.id, &entry.destination, &entry.airport, &entry.flightID, &entry.userName, &entry.subscriptionID, &entry.deliveryID, &entry.traceContext, &entry.payload, &created, &entry.attempts, &nextAttempt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry.created, _ = time.Parse(snapshotTimeLayout, created)
+	entry.nextAttempt, _ = time.Parse(snapshotTimeLayout, nextAttempt)
+
+	return &entry, nil
+}
+
+func (o *changePushOutbox) remove(id int64) {
+	if _, err := o.db.Exec("DELETE FROM outbox WHERE id = ?", id); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not remove push %d from the change push outbox: %s", id, err))
+	}
+}
+
+// changePushBackoff is the wait before the next attempt, doubling from ChangePushRetryBackoffInSeconds
+// for each failed attempt up to ChangePushMaxRetryBackoffInSeconds. A random jitter of up to half the
+// wait is taken off so destinations that failed together do not retry together
+func changePushBackoff(attempts int) time.Duration {
+
+	base := time.Duration(globals.ConfigViper.GetInt("ChangePushRetryBackoffInSeconds")) * time.Second
+	if base <= 0 {
+		base = 2 * time.Second
+	}
+	maxBackoff := time.Duration(globals.ConfigViper.GetInt("ChangePushMaxRetryBackoffInSeconds")) * time.Second
+	if maxBackoff < base {
+		maxBackoff = 5 * time.Minute
+	}
+
+	backoff := maxBackoff
+	if attempts < 30 && base<<(attempts-1) < maxBackoff {
+		backoff = base << (attempts - 1)
+	}
+
+	return backoff - time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// outboxSubscription returns the change subscription the push was queued for, the subscription in the
+// store with its ID or, for a subscription in the user's profile, the one with the same destination and
+// airport. Returns false if the subscription, or its user, is no longer enabled
+func outboxSubscription(entry *outboxEntry) (models.UserChangeSubscription, bool) {
+
+	globals.UserChangeSubscriptionsMutex.RLock()
+	defer globals.UserChangeSubscriptionsMutex.RUnlock()
+
+	for _, sub := range globals.UserChangeSubscriptions {
+		if sub.UserName != entry.userName || sub.SubscriptionID != entry.subscriptionID {
+			continue
+		}
+		if sub.DestinationURL != entry.destination || sub.Airport != entry.airport {
+			continue
+		}
+		return sub, sub.Enabled
+	}
+	return models.UserChangeSubscription{}, false
+}
+
+func deliverChangePush(entry *outboxEntry, sub models.UserChangeSubscription) (err error) {
+
+	globals.Logger.Debug(fmt.Sprintf("Executing Change Push of %s to %s", entry.flightID, entry.destination))
+
+	ctx, span := tracing.StartSpan(tracing.Decode(entry.traceContext), "change push", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", http.MethodPost), attribute.String("server.address", monitoring.Destination(entry.destination)),
+			attribute.String("flight.id", entry.flightID), attribute.Int("attempt", entry.attempts+1), attribute.String("delivery.id", entry.deliveryID),
+			attribute.Int64("queued.ms", time.Since(entry.created).Milliseconds())))
+	defer func() { tracing.End(span, err) }()
+
+	// Cut off by the shutdown deadline, not by the stop signal, so a push in progress can complete
+	req, err := http.NewRequestWithContext(globals.DrainCtx, http.MethodPost, entry.destination, bytes.NewReader(entry.payload))
+	if err != nil {
+		return fmt.Errorf("could not create change request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for _, pair := range sub.HeaderParameters {
+		req.Header.Add(pair.Parameter, pair.Value)
+	}
+	tracing.Inject(ctx, req.Header)
+	signing.SignRequest(req, sub.SigningSecret, entry.deliveryID, entry.payload)
+
+	r, err := destinationClient(sub.TrustBadCertificates, sub.SubscriptionID != 0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	span.SetAttributes(attribute.Int("http.response.status_code", r.StatusCode))
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return fmt.Errorf("returned status code %v", r.StatusCode)
+	}
+	return nil
+}
+
+// OutboxMetrics are the pushes waiting in the outbox for a destination and the outcome of those sent
+type OutboxMetrics struct {
+	Pending   int
+	Delivered int64
+	Retried   int64
+	Expired   int64
+	LastError string
+}
+
+// ChangePushOutboxMetrics returns the state of the outbox for each destination
+func ChangePushOutboxMetrics() map[string]OutboxMetrics {
+
+	metrics := map[string]OutboxMetrics{}
+	if outbox == nil {
+		return metrics
+	}
+
+	pending := map[string]int{}
+	rows, err := outbox.db.Query("SELECT destination, COUNT(*) FROM outbox GROUP BY destination")
+	if err == nil {
+		for rows.Next() {
+			var destination string
+			var n int
+			if rows.Scan(&destination, &n) == nil {
+				pending[destination] = n
+			}
+		}
+		rows.Close()
+	}
+
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	for destination, lane := range outbox.lanes {
+		metrics[destination] = OutboxMetrics{
+			Pending:   pending[destination],
+			Delivered: lane.delivered,
+			Retried:   lane.retried,
+			Expired:   lane.expired,
+			LastError: lane.lastError,
+		}
+	}
+	for destination, n := range pending {
+		if _, ok := metrics[destination]; !ok {
+			metrics[destination] = OutboxMetrics{Pending: n}
+		}
+	}
+
+	return metrics
+}
@@ -0,0 +1,232 @@
+package repo
+
+/*
+
+Change streams deliver the flight changes of an airport to the clients connected to /stream/{airport}
+as they happen, over Server-Sent Events or WebSocket.
+
+Each change is given an ID and kept in a replay buffer of the airport, so a client that reconnects with
+the ID of the last change it received is sent the changes it missed. The IDs start from the time the
+service started, in microseconds, so they keep increasing across restarts. A client that is further
+behind than the replay buffer is sent a Reset event and should reload the flights with /getFlights.
+
+A client that does not keep up with the changes is disconnected rather than holding up the others
+
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+)
+
+// The stream events
+const (
+	streamResetEvent     = "Reset"
+	streamKeepAliveEvent = "KeepAlive"
+)
+
+// streamEvent is a change to a flight published to the change streams of the airport
+type streamEvent struct {
+	id     int64
+	kind   string
+	flight models.Flight
+}
+
+// streamClient is a connected change stream. Events that match its filter are queued on events,
+// which is closed if the client falls behind
+type streamClient struct {
+	filter  models.UserChangeSubscription
+	profile models.UserProfile
+	events  chan streamEvent
+}
+
+type changeStreamHub struct {
+	mu        sync.Mutex
+	lastID    int64
+	recent    []streamEvent
+	clients   map[*streamClient]struct{}
+	published int64
+	overflows int64
+}
+
+var streamHubs = map[string]*changeStreamHub{}
+var streamHubsMutex sync.Mutex
+
+// The first stream ID. Later IDs are allocated in sequence from it
+var streamIDBase = time.Now().UnixMicro()
+
+func getChangeStreamHub(airportCode string) *changeStreamHub {
+
+	streamHubsMutex.Lock()
+	defer streamHubsMutex.Unlock()
+
+	hub := streamHubs[airportCode]
+	if hub == nil {
+		hub = &changeStreamHub{lastID: streamIDBase, clients: map[*streamClient]struct{}{}}
+		streamHubs[airportCode] = hub
+	}
+	return hub
+}
+
+// publishFlightChange publishes the current state of the created or updated flight to the change streams
+func publishFlightChange(kind string, mess models.FlightUpdateChannelMessage) {
+
+	repo := GetRepo(mess.AirportCode)
+	if repo == nil {
+		return
+	}
+	flt := repo.GetFlight(mess.FlightID)
+	if flt == nil {
+		// Deleted before the change could be processed
+		return
+	}
+	publishChangeStreamEvent(kind, flt)
+}
+
+// publishChangeStreamEvent adds the change to the replay buffer of the airport and queues it for the
+// connected clients that are interested in it
+func publishChangeStreamEvent(kind string, flt *models.Flight) {
+
+	if !withinChangeHorizon(flt) {
+		return
+	}
+
+	hub := getChangeStreamHub(flt.GetIATAAirport())
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.lastID++
+	hub.published++
+	event := streamEvent{id: hub.lastID, kind: kind, flight: *flt}
+
+	bufferSize := globals.ConfigViper.GetInt("StreamReplayBufferSize")
+	if bufferSize < 1 {
+		bufferSize = 1000
+	}
+	hub.recent = append(hub.recent, event)
+	if len(hub.recent) > bufferSize {
+		hub.recent = append(hub.recent[:0], hub.recent[len(hub.recent)-bufferSize:]...)
+	}
+
+	for client := range hub.clients {
+		if !client.wants(&event) {
+			continue
+		}
+		select {
+		case client.events <- event:
+		default:
+			globals.Logger.Warn(fmt.Sprintf("Change stream client %s for %s disconnected, it has fallen behind", client.profile.UserName, flt.GetIATAAirport()))
+			hub.overflows++
+			hub.remove(client)
+		}
+	}
+}
+
+// subscribe connects the client to the change stream of the airport. The changes after lastID that are
+// still in the replay buffer are returned to be sent first. reset is true if some of the changes after
+// lastID are no longer in the buffer. A lastID of zero means no changes are replayed
+func (hub *changeStreamHub) subscribe(client *streamClient, lastID int64) (replay []streamEvent, reset bool) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.clients[client] = struct{}{}
+
+	if lastID <= 0 || lastID >= hub.lastID {
+		return nil, false
+	}
+
+	// Changes published before the service was started were lost with the replay buffer
+	if lastID < streamIDBase || len(hub.recent) == 0 || hub.recent[0].id > lastID+1 {
+		reset = true
+	}
+
+	for _, event := range hub.recent {
+		if event.id > lastID && client.wants(&event) {
+			replay = append(replay, event)
+		}
+	}
+	return replay, reset
+}
+
+// unsubscribe disconnects the client from the change stream
+func (hub *changeStreamHub) unsubscribe(client *streamClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.remove(client)
+}
+
+// remove must be called with the hub locked
+func (hub *changeStreamHub) remove(client *streamClient) {
+	if _, ok := hub.clients[client]; ok {
+		delete(hub.clients, client)
+		close(client.events)
+	}
+}
+
+// wants reports whether the change is of interest to the client and the client is allowed to see it
+func (client *streamClient) wants(event *streamEvent) bool {
+
+	airlines := client.profile.AllowedAirlines
+	if airlines != nil && !globals.Contains(airlines, "*") && !globals.Contains(airlines, event.flight.GetIATAAirline()) {
+		return false
+	}
+	return changeSubscriptionMatches(client.filter, &event.flight)
+}
+
+// streamEventName is the name of the event sent to the clients
+func streamEventName(kind string) string {
+	return strings.TrimSuffix(kind, "Notification")
+}
+
+// json serialises the event for the client, with the custom fields pruned to those the user is allowed to see
+func (event *streamEvent) json(profile *models.UserProfile) []byte {
+
+	var buf bytes.Buffer
+	fwb := bufio.NewWriter(&buf)
+
+	fwb.WriteString("{\"ID\":" + strconv.FormatInt(event.id, 10) + ",")
+	fwb.WriteString("\"Event\":\"" + streamEventName(event.kind) + "\",")
+	fwb.WriteString("\"Airport\":\"" + event.flight.GetIATAAirport() + "\",")
+	fwb.WriteString("\"Flight\":")
+	event.flight.WriteJSON(fwb, profile)
+	fwb.WriteString("}")
+	fwb.Flush()
+
+	return buf.Bytes()
+}
+
+// StreamMetrics are the connected clients and changes published for the change streams of an airport
+type StreamMetrics struct {
+	Clients      int
+	Published    int64
+	Disconnected int64
+	ReplayBuffer int
+	LastEventID  int64
+}
+
+// ChangeStreamMetrics returns the metrics of the change streams of the airport
+func ChangeStreamMetrics(airportCode string) StreamMetrics {
+
+	hub := getChangeStreamHub(airportCode)
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	return StreamMetrics{
+		Clients:      len(hub.clients),
+		Published:    hub.published,
+		Disconnected: hub.overflows,
+		ReplayBuffer: len(hub.recent),
+		LastEventID:  hub.lastID,
+	}
+}
@@ -0,0 +1,223 @@
+package repo
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/timeservice"
+)
+
+const concurrencyTestAirport = "CCT"
+
+// TestConcurrentNotificationsAndQueries runs flight notifications concurrently with flight and resource
+// queries against an in memory repository and checks that every query sees a consistent snapshot. Run
+// it with go test -race to have any unsynchronised access reported
+func TestConcurrentNotificationsAndQueries(t *testing.T) {
+
+	const numFlights, numWriters, numReaders = 500, 4, 6
+	duration := 3 * time.Second
+	if testing.Short() {
+		duration = time.Second
+	}
+
+	timeservice.InitTimeService()
+
+	rep := &models.Repository{
+		AMSAirport:                          concurrencyTestAirport,
+		FlightSDOWindowMinimumInDaysFromNow: -1,
+		FlightSDOWindowMaximumInDaysFromNow: 3,
+	}
+	addRepo(rep)
+
+	addResource("G", 20, "Gate", &rep.GateList)
+	addResource("S", 20, "Stand", &rep.StandList)
+
+	rep.Lock()
+	rep.CurrentLowerLimit = time.Now().Add(-24 * time.Hour)
+	rep.CurrentUpperLimit = time.Now().Add(4 * 24 * time.Hour)
+	rep.Unlock()
+
+	// Nothing else is consuming the notification channels
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-globals.FlightUpdatedChannel:
+			case <-globals.FlightCreatedChannel:
+			case <-globals.FlightDeletedChannel:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+
+	start := time.Now().Truncate(time.Minute)
+	for i := 0; i < numFlights; i++ {
+		if err := UpdateFlightEntry(concurrencyTestMessage("Updated", start, i, 0), false); err != nil {
+			t.Fatalf("could not add flight %d: %s", i, err)
+		}
+	}
+
+	var updates, deletes, queries, allocations, failures int64
+	deadline := time.Now().Add(duration)
+	wg := sync.WaitGroup{}
+
+	// Writers cycle through the flights. Every update changes the number and times of the gate
+	// and stand slots so that a reader that sees a flight without its allocations will notice
+	for w := 0; w < numWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for version := 1; time.Now().Before(deadline); version++ {
+				i := (version*numWriters + w) % numFlights
+				if version%10 == 0 {
+					deleteFlightEntry(concurrencyTestMessage("Deleted", start, i, version))
+					createFlightEntry(concurrencyTestMessage("Created", start, i, version))
+					atomic.AddInt64(&deletes, 1)
+					continue
+				}
+				UpdateFlightEntry(concurrencyTestMessage("Updated", start, i, version), false)
+				atomic.AddInt64(&updates, 1)
+			}
+		}(w)
+	}
+
+	for r := 0; r < numReaders; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				var ok bool
+				switch r % 3 {
+				case 0:
+					ok = concurrencyTestFlightQuery(rep)
+				case 1:
+					ok = concurrencyTestSnapshotCheck(rep)
+				default:
+					atomic.AddInt64(&allocations, int64(concurrencyTestResourceQuery(rep)))
+					ok = true
+				}
+				if !ok {
+					atomic.AddInt64(&failures, 1)
+				}
+				atomic.AddInt64(&queries, 1)
+			}
+		}(r)
+	}
+
+	wg.Wait()
+
+	t.Logf("Updates: %d, Deletes and Creates: %d, Queries: %d, Allocations Read: %d", updates, deletes, queries, allocations)
+	if failures > 0 {
+		t.Errorf("%d queries observed an inconsistent snapshot", failures)
+	}
+}
+
+// concurrencyTestMessage creates a notification of the kind (Updated, Created or Deleted) for flight i.
+// The version determines the slots of the flight
+func concurrencyTestMessage(kind string, start time.Time, i, version int) string {
+
+	sto := start.Add(time.Duration(i) * time.Minute)
+
+	flight := models.Flight{}
+	flight.FlightId = models.FlightId{
+		FlightKind:        "Departure",
+		AirlineDesignator: []models.AirlineDesignator{{CodeContext: "IATA", Text: "QF"}},
+		FlightNumber:      strconv.Itoa(i),
+		ScheduledDate:     sto.Format("2006-01-02"),
+		AirportCode:       []models.AirportCode{{CodeContext: "IATA", Text: concurrencyTestAirport}},
+	}
+	flight.FlightState.ScheduledTime = sto.Format(timeservice.Layout)
+
+	for s := 0; s <= version%3; s++ {
+		from := sto.Add(time.Duration(version%60+s) * time.Minute)
+		slot := []models.Value{
+			{PropertyName: "StartTime", Text: from.Format(timeservice.Layout)},
+			{PropertyName: "EndTime", Text: from.Add(time.Hour).Format(timeservice.Layout)},
+		}
+		flight.FlightState.GateSlots.GateSlot = append(flight.FlightState.GateSlots.GateSlot,
+			models.GateSlot{Value: slot, Gate: models.Gate{Value: []models.Value{{PropertyName: "Name", Text: fmt.Sprintf("G%d", (i+s)%20+1)}}}})
+		flight.FlightState.StandSlots.StandSlot = append(flight.FlightState.StandSlots.StandSlot,
+			models.StandSlot{Value: slot, Stand: models.Stand{Value: []models.Value{{PropertyName: "Name", Text: fmt.Sprintf("S%d", (i+s)%20+1)}}}})
+	}
+
+	data, _ := xml.Marshal(flight)
+	return fmt.Sprintf("<Envelope><Content><Flight%sNotification>%s</Flight%sNotification></Content></Envelope>", kind, data, kind)
+}
+
+// concurrencyTestFlightQuery runs the same filter as a flights query and then writes the
+// flights out after the lock has been released, as the API does
+func concurrencyTestFlightQuery(rep *models.Repository) bool {
+
+	request := models.Request{From: "-24", To: "96", UserProfile: models.UserProfile{AllowedAirlines: []string{"*"}}}
+
+	rep.RLock()
+	response, err := filterFlights(request, models.Response{}, &rep.FlightList, nil, rep)
+	rep.RUnlock()
+
+	if err != nil {
+		return false
+	}
+
+	fwb := bufio.NewWriter(io.Discard)
+	models.WriteFlightsInJSON(fwb, response.ResponseFlights, &request.UserProfile)
+	fwb.Flush()
+
+	return true
+}
+
+// concurrencyTestSnapshotCheck checks that every flight in the snapshot has exactly the allocations its slots describe
+func concurrencyTestSnapshotCheck(rep *models.Repository) bool {
+
+	rep.RLock()
+	defer rep.RUnlock()
+
+	ok := true
+	rep.FlightList.ForEach(func(f *models.Flight) bool {
+		gates := rep.GateList.FlightAllocations(f.GetFlightID())
+		stands := rep.StandList.FlightAllocations(f.GetFlightID())
+		slots := f.FlightState.GateSlots.GateSlot
+
+		if len(gates) != len(slots) || len(stands) != len(f.FlightState.StandSlots.StandSlot) {
+			ok = false
+			return false
+		}
+		for idx, slot := range slots {
+			_, from, _ := slot.GetResourceID()
+			if !gates[idx].From.Equal(from) {
+				ok = false
+				return false
+			}
+		}
+		return true
+	})
+
+	return ok
+}
+
+func concurrencyTestResourceQuery(rep *models.Repository) (n int) {
+
+	from := time.Now().Add(-24 * time.Hour)
+	to := time.Now().Add(96 * time.Hour)
+
+	rep.RLock()
+	defer rep.RUnlock()
+
+	for _, list := range []*models.ResourceIndexedList{&rep.GateList, &rep.StandList} {
+		list.Overlapping("", from, to, func(r *models.ResourceAllocationStruct, a *models.AllocationItem) bool {
+			n++
+			return true
+		})
+	}
+	return n
+}
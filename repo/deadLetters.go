@@ -0,0 +1,227 @@
+package repo
+
+/*
+
+Notifications that can not be parsed or applied are kept in the dead letter store, a SQLite database
+in the PersistenceDirectory, with the error, the airport of the listener that received them and the
+time. They can be inspected, replayed once the cause has been fixed, and purged by the admin API
+
+*/
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const deadLetterSchema = `
+CREATE TABLE IF NOT EXISTS deadletters(id INTEGER PRIMARY KEY AUTOINCREMENT, airport TEXT, listener TEXT, error TEXT,
+	received TEXT, attempts INTEGER, lastattempt TEXT, message BLOB);
+CREATE INDEX IF NOT EXISTS deadletters_airport ON deadletters(airport);
+`
+
+// ErrDeadLetterNotFound is returned for a dead letter that is not in the store
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+var deadLetterDB *sql.DB
+var deadLetterDBErr error
+var deadLetterDBOnce sync.Once
+
+// getDeadLetterDB opens (creating if required) the dead letter database on first use
+func getDeadLetterDB() (*sql.DB, error) {
+
+	deadLetterDBOnce.Do(func() {
+		dir := globals.ConfigViper.GetString("PersistenceDirectory")
+		if dir == "" {
+			dir = "."
+		}
+		dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL", filepath.Join(dir, "deadletters.db"))
+
+		db, err := sql.Open("sqlite3", dsn)
+		if err != nil {
+			deadLetterDBErr = err
+			return
+		}
+		db.SetMaxOpenConns(1)
+
+		if _, err = db.Exec(deadLetterSchema); err != nil {
+			db.Close()
+			deadLetterDBErr = err
+			return
+		}
+		deadLetterDB = db
+	})
+
+	return deadLetterDB, deadLetterDBErr
+}
+
+// recordDeadLetter stores the notification that failed. The oldest dead letters are removed once
+// there are more than DeadLetterMaxEntries
+func recordDeadLetter(airportCode, listener, message string, cause error) {
+
+	globals.Logger.Warn(fmt.Sprintf("Notification received by the %s listener for %s moved to the dead letter store: %s", listener, airportCode, cause))
+
+	db, err := getDeadLetterDB()
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not open the dead letter store: %s", err))
+		return
+	}
+
+	now := time.Now().Format(snapshotTimeLayout)
+	_, err = db.Exec("INSERT INTO deadletters(airport, listener, error, received, attempts, lastattempt, message) VALUES(?, ?, ?, ?, 1, ?, ?)",
+		airportCode, listener, cause.Error(), now, now, message)
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not record dead letter for %s: %s", airportCode, err))
+		return
+	}
+
+	maxEntries := globals.ConfigViper.GetInt("DeadLetterMaxEntries")
+	if maxEntries < 1 {
+		maxEntries = 10000
+	}
+	_, err = db.Exec("DELETE FROM deadletters WHERE id <= (SELECT id FROM deadletters ORDER BY id DESC LIMIT 1 OFFSET ?)", maxEntries)
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not prune the dead letter store: %s", err))
+	}
+}
+
+// ListDeadLetters returns the dead letters of the airport, or of all airports if no airport is given,
+// oldest first and without their messages
+func ListDeadLetters(airportCode string) ([]models.DeadLetter, error) {
+
+	db, err := getDeadLetterDB()
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT id, airport, listener, error, received, attempts, lastattempt FROM deadletters"
+	args := []interface{}{}
+	if airportCode != "" {
+		query += " WHERE airport = ?"
+		args = append(args, airportCode)
+	}
+	query += " ORDER BY id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := []models.DeadLetter{}
+	for rows.Next() {
+		var dl models.DeadLetter
+		var received, lastAttempt string
+		if err := rows.Scan(&dl.ID, &dl.Airport, &dl.Listener, &dl.Error, &received, &dl.Attempts, &lastAttempt); err != nil {
+			return nil, err
+		}
+		dl.Received, _ = time.Parse(snapshotTimeLayout, received)
+		dl.LastAttempt, _ = time.Parse(snapshotTimeLayout, lastAttempt)
+		deadLetters = append(deadLetters, dl)
+	}
+
+	return deadLetters, rows.Err()
+}
+
+// GetDeadLetter returns the dead letter with its message
+func GetDeadLetter(id int64) (models.DeadLetter, error) {
+
+	var dl models.DeadLetter
+
+	db, err := getDeadLetterDB()
+	if err != nil {
+		return dl, err
+	}
+
+	var received, lastAttempt string
+	err = db.QueryRow("SELECT id, airport, listener, error, received, attempts, lastattempt, message FROM deadletters WHERE id = ?", id).
+		Scan(&dl.ID, &dl.Airport, &dl.Listener, &dl.Error, &received, &dl.Attempts, &lastAttempt, &dl.Message)
+	if err == sql.ErrNoRows {
+		return dl, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return dl, err
+	}
+	dl.Received, _ = time.Parse(snapshotTimeLayout, received)
+	dl.LastAttempt, _ = time.Parse(snapshotTimeLayout, lastAttempt)
+
+	return dl, nil
+}
+
+// ReplayDeadLetter applies the message of the dead letter again. It is removed from the store if it
+// is applied, otherwise the error and the number of attempts are updated and the error returned
+func ReplayDeadLetter(id int64) error {
+
+	dl, err := GetDeadLetter(id)
+	if err != nil {
+		return err
+	}
+
+	db, _ := getDeadLetterDB()
+
+	ctx, span := tracing.StartSpan(context.Background(), "deadletter.replay", trace.WithAttributes(attribute.String("airport", dl.Airport), attribute.Int64("deadletter.id", id)))
+	cause := dispatchNotification(ctx, dl.Message)
+	tracing.End(span, cause)
+	if cause == nil {
+		globals.Logger.Info(fmt.Sprintf("Dead letter %d for %s replayed", id, dl.Airport))
+		_, err = db.Exec("DELETE FROM deadletters WHERE id = ?", id)
+		return err
+	}
+
+	_, err = db.Exec("UPDATE deadletters SET error = ?, attempts = attempts + 1, lastattempt = ? WHERE id = ?",
+		cause.Error(), time.Now().Format(snapshotTimeLayout), id)
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not update dead letter %d: %s", id, err))
+	}
+	return cause
+}
+
+// PurgeDeadLetters removes the dead letters of the airport, or of all airports if no airport is given,
+// and returns the number removed
+func PurgeDeadLetters(airportCode string) (int64, error) {
+
+	db, err := getDeadLetterDB()
+	if err != nil {
+		return 0, err
+	}
+
+	var result sql.Result
+	if airportCode == "" {
+		result, err = db.Exec("DELETE FROM deadletters")
+	} else {
+		result, err = db.Exec("DELETE FROM deadletters WHERE airport = ?", airportCode)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteDeadLetter removes the dead letter
+func DeleteDeadLetter(id int64) error {
+
+	db, err := getDeadLetterDB()
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec("DELETE FROM deadletters WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+)
+
+// Files modified more recently than this may still be being written and are left for the next poll
+const directoryListenerSettleTime = time.Second
+
+func init() {
+	RegisterListener("DIRECTORY", func() NotificationListener { return &directoryListener{} })
+}
+
+// directoryListener processes the AMS notification XML files dropped into the NotificationDirectory
+// of the airport. Processed files are moved to the "processed" sub directory and files that could
+// not be processed to the "failed" sub directory
+type directoryListener struct{}
+
+func (l *directoryListener) Listen(ctx context.Context, repo *models.Repository, handle NotificationHandler) error {
+
+	dir := repo.NotificationDirectory
+	if dir == "" {
+		return fmt.Errorf("no NotificationDirectory configured")
+	}
+
+	processedDir := filepath.Join(dir, "processed")
+	failedDir := filepath.Join(dir, "failed")
+	for _, d := range []string{dir, processedDir, failedDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	interval := time.Duration(globals.ConfigViper.GetInt("DirectoryListenerPollIntervalInSeconds")) * time.Second
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+
+	globals.Logger.Info(fmt.Sprintf("Watching %s for notifications for %s", dir, repo.AMSAirport))
+	setListenerState(repo.AMSAirport, ListenerConnected, nil)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, file := range readyNotificationFiles(dir) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			processNotificationFile(dir, file, processedDir, failedDir, handle)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// readyNotificationFiles returns the XML files in the directory that are no longer being written,
+// oldest first
+func readyNotificationFiles(dir string) []os.FileInfo {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not read notification directory %s: %s", dir, err))
+		return nil
+	}
+
+	files := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".xml") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < directoryListenerSettleTime {
+			continue
+		}
+		files = append(files, info)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].ModTime().Equal(files[j].ModTime()) {
+			return files[i].ModTime().Before(files[j].ModTime())
+		}
+		return files[i].Name() < files[j].Name()
+	})
+
+	return files
+}
+
+func processNotificationFile(dir string, file os.FileInfo, processedDir, failedDir string, handle NotificationHandler) {
+
+	path := filepath.Join(dir, file.Name())
+	target := processedDir
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = handle(context.Background(), string(data))
+	}
+	if err != nil {
+		globals.Logger.Warn(fmt.Sprintf("Could not process notification file %s: %s", path, err))
+		target = failedDir
+	}
+
+	if err := os.Rename(path, filepath.Join(target, file.Name())); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not move notification file %s to %s: %s", path, target, err))
+	}
+}
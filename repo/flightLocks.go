@@ -0,0 +1,73 @@
+package repo
+
+import (
+	"sort"
+	"sync"
+)
+
+// Notifications for the same flight are applied one at a time, from the version check through to
+// persistence, so a newer version can not be overtaken by an older one received at the same time.
+// Notifications for different flights are still applied concurrently
+
+type flightLock struct {
+	sync.Mutex
+	refs int
+}
+
+var flightLocks = make(map[string]*flightLock)
+var flightLocksMutex = &sync.Mutex{}
+
+// lockFlight waits until no other notification for the flight is being applied. The returned
+// function releases the lock
+func lockFlight(airportCode, flightID string) func() {
+
+	key := airportCode + "/" + flightID
+
+	flightLocksMutex.Lock()
+	lock := flightLocks[key]
+	if lock == nil {
+		lock = &flightLock{}
+		flightLocks[key] = lock
+	}
+	lock.refs++
+	flightLocksMutex.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		flightLocksMutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(flightLocks, key)
+		}
+		flightLocksMutex.Unlock()
+	}
+}
+
+// lockFlights locks each of the flights, in order so two callers locking overlapping sets of flights
+// can not deadlock. The returned function releases the locks
+func lockFlights(airportCode string, flightIDs []string) func() {
+
+	ids := make([]string, 0, len(flightIDs))
+	locked := make(map[string]bool)
+	for _, flightID := range flightIDs {
+		if !locked[flightID] {
+			locked[flightID] = true
+			ids = append(ids, flightID)
+		}
+	}
+	sort.Strings(ids)
+
+	unlocks := make([]func(), 0, len(ids))
+	for _, flightID := range ids {
+		unlocks = append(unlocks, lockFlight(airportCode, flightID))
+	}
+
+	return func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+}
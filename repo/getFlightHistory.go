@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetFlightHistoryAPI returns every version of the flight that has been recorded, oldest first
+func GetFlightHistoryAPI(c *gin.Context) {
+
+	defer globals.ExeTime(fmt.Sprintf("Get Flight History Processing time for %s", c.Request.RequestURI))()
+
+	userProfile := GetUserProfile(c, "")
+	if !userProfile.Enabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"Error": "User Access Has Been Disabled"})
+		return
+	}
+	globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", userProfile.UserName, c.RemoteIP(), c.Request.RequestURI))
+
+	apt := c.Param("apt")
+	flightID := c.Param("flightId")
+
+	//Check that the user is allowed to access the requested airport
+	if !globals.Contains(userProfile.AllowedAirports, apt) &&
+		!globals.Contains(userProfile.AllowedAirports, "*") {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "User is not allowed to access requested airport"})
+		return
+	}
+
+	repo := GetRepo(apt)
+	if repo == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Airport %s not found", apt)})
+		return
+	}
+
+	repo.RLock()
+	history := repo.FlightHistory.Get(flightID)
+	repo.RUnlock()
+
+	if len(history) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"Error": fmt.Sprintf("No history found for flight %s", flightID)})
+		return
+	}
+
+	// Filter out airlines that the user is not allowed to see
+	// "*" entry in AllowedAirlines allows all.
+	airline := history[len(history)-1].Flight.GetIATAAirline()
+	if userProfile.AllowedAirlines != nil &&
+		!globals.Contains(userProfile.AllowedAirlines, airline) &&
+		!globals.Contains(userProfile.AllowedAirlines, "*") {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "User is not allowed to access the requested flight"})
+		return
+	}
+
+	response := flightHistoryResponse{
+		Airport:          apt,
+		FlightID:         flightID,
+		NumberOfVersions: fmt.Sprintf("%v", len(history)),
+		Warnings:         []string{},
+	}
+	if repo.IsSnapshotStale() {
+		response.Warnings = append(response.Warnings, snapshotStaleWarning)
+	}
+
+	var err error
+	if response.History, err = flightHistoryVersions(history, &userProfile); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"Error": "error creating response"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+type flightHistoryResponse struct {
+	Airport          string
+	FlightID         string
+	NumberOfVersions string
+	Warnings         []string
+	History          []flightHistoryVersion
+}
+
+type flightHistoryVersion struct {
+	Version     string
+	MessageType string
+	LastUpdate  string
+	Action      string
+	Flight      json.RawMessage
+}
+
+// flightHistoryVersions returns the versions of the flight. The custom fields and custom field
+// changes of each version are pruned to those the user is allowed to see
+func flightHistoryVersions(history []models.FlightHistoryEntry, userProfile *models.UserProfile) ([]flightHistoryVersion, error) {
+
+	versions := make([]flightHistoryVersion, 0, len(history))
+
+	for idx, entry := range history {
+		var buf bytes.Buffer
+		fwb := bufio.NewWriter(&buf)
+		entry.Flight.WriteJSON(fwb, userProfile)
+		if err := fwb.Flush(); err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, flightHistoryVersion{
+			Version:     fmt.Sprintf("%v", idx+1),
+			MessageType: entry.MessageType,
+			LastUpdate:  entry.LastUpdate.Format(time.RFC3339),
+			Action:      entry.Flight.Action,
+			Flight:      buf.Bytes(),
+		})
+	}
+
+	return versions, nil
+}
@@ -13,38 +13,55 @@ import (
 
 	"flightresourcerestapi/globals"
 	"flightresourcerestapi/models"
+	"flightresourcerestapi/monitoring"
 	"flightresourcerestapi/timeservice"
 
 	"github.com/gin-gonic/gin"
 )
 
+// The context key of the profile of the user making the request, so it is only looked up once
+const userProfileContextKey = "userProfile"
+
+// GetUserProfile returns the profile of the user for the Token header of the request, or for the bearer
+// token in the Authorization header if there is no Token header. Requests with neither use the "default"
+// user unless AllowDefaultUser is false
 func GetUserProfile(c *gin.Context, userToken string) models.UserProfile {
 
 	defer globals.ExeTime("Getting User Profile")()
 
-	key := userToken
-
-	if c != nil {
-		keys := c.Request.Header["Token"]
-		key = "default"
-
-		if keys != nil {
-			key = keys[0]
-		}
-
+	if c == nil {
+		return userProfileForKey(userToken)
+	}
+	if profile, ok := c.Get(userProfileContextKey); ok {
+		return profile.(models.UserProfile)
 	}
-	users := globals.GetUserProfiles()
-	userProfile := models.UserProfile{}
 
-	for _, u := range users {
-		if key == u.Key {
-			userProfile = u
-			break
-		}
+	var profile models.UserProfile
+	if keys := c.Request.Header["Token"]; keys != nil {
+		profile = userProfileForKey(keys[0])
+	} else if token, ok := bearerToken(c); ok {
+		profile = userProfileForBearer(token)
+	} else if !globals.ConfigViper.IsSet("AllowDefaultUser") || globals.ConfigViper.GetBool("AllowDefaultUser") {
+		profile = userProfileForKey("default")
 	}
 
-	return userProfile
+	c.Set(userProfileContextKey, profile)
+	return profile
+}
+
+// RequestUserName returns the name of the user whose profile was used for the request, or "" if no
+// profile was looked up
+func RequestUserName(c *gin.Context) string {
+	if profile, ok := c.Get(userProfileContextKey); ok {
+		return profile.(models.UserProfile).UserName
+	}
+	return ""
+}
 
+// HasCredentials reports whether the request has a Token header or a bearer token
+func HasCredentials(c *gin.Context) bool {
+	_, ok := bearerToken(c)
+	return ok || c.GetHeader("Token") != ""
 }
 
 func GetRequestedFlightsAPI(c *gin.Context) {
@@ -76,7 +93,7 @@ func GetRequestedFlightsAPI(c *gin.Context) {
 		route = c.Query("r")
 	}
 
-	response, _ := GetRequestedFlightsCommon(apt, direction, airline, flt, from, to, route, "", c, nil)
+	response, _ := GetRequestedFlightsCommon(apt, direction, airline, flt, from, to, route, nil, c, nil)
 
 	fileName, err := writeFlightResponseToFile(response, &userProfile)
 
@@ -110,7 +127,7 @@ func GetRequestedFlightsAPI(c *gin.Context) {
 	}
 }
 
-func GetRequestedFlightsSub(sub models.UserPushSubscription, userToken string) (models.Response, models.GetFlightsError) {
+func GetRequestedFlightsSub(sub models.UserPushSubscription, userProfile *models.UserProfile) (models.Response, models.GetFlightsError) {
 	apt := sub.Airport
 	direction := strings.ToUpper(sub.Direction)
 	airline := sub.Airline
@@ -119,10 +136,13 @@ func GetRequestedFlightsSub(sub models.UserPushSubscription, userToken string) (
 	route := strings.ToUpper(sub.Route)
 	qf := sub.QueryableCustomFields
 
-	return GetRequestedFlightsCommon(apt, direction, airline, "", strconv.Itoa(from), strconv.Itoa(to), route, userToken, nil, qf)
+	return GetRequestedFlightsCommon(apt, direction, airline, "", strconv.Itoa(from), strconv.Itoa(to), route, userProfile, nil, qf)
 
 }
-func GetRequestedFlightsCommon(apt, direction, airline, flt, from, to, route, userToken string, c *gin.Context, qf []models.ParameterValuePair) (models.Response, models.GetFlightsError) {
+
+// GetRequestedFlightsCommon returns the flights for the user making the request, or for the user of the
+// push subscription if the profile is given
+func GetRequestedFlightsCommon(apt, direction, airline, flt, from, to, route string, profile *models.UserProfile, c *gin.Context, qf []models.ParameterValuePair) (models.Response, models.GetFlightsError) {
 
 	// Create the response object so we can return early if required
 	response := models.Response{}
@@ -142,7 +162,12 @@ func GetRequestedFlightsCommon(apt, direction, airline, flt, from, to, route, us
 	response.Route = route
 
 	// Get the profile of the user making the request
-	userProfile := GetUserProfile(c, userToken)
+	var userProfile models.UserProfile
+	if profile != nil {
+		userProfile = *profile
+	} else {
+		userProfile = GetUserProfile(c, "")
+	}
 	response.User = userProfile.UserName
 
 	if apt == "" {
@@ -160,6 +185,10 @@ func GetRequestedFlightsCommon(apt, direction, airline, flt, from, to, route, us
 		}
 	}
 
+	if GetRepo(apt).IsSnapshotStale() {
+		response.AddWarning(snapshotStaleWarning)
+	}
+
 	// Set Default airline if none set
 	if airline == "" && userProfile.DefaultAirline != "" {
 		airline = userProfile.DefaultAirline
@@ -202,11 +231,12 @@ func GetRequestedFlightsCommon(apt, direction, airline, flt, from, to, route, us
 
 	var err error
 
-	// Get the filtered and pruned flights for the request
-	globals.MapMutex.Lock()
-	flights := GetRepo(apt).FlightLinkedList
-	response, err = filterFlights(request, response, flights, c, GetRepo(apt))
-	globals.MapMutex.Unlock()
+	// Get the filtered and pruned flights for the request.
+	// The read lock is only held while the snapshot of the matching flights is taken
+	repo := GetRepo(apt)
+	repo.RLock()
+	response, err = filterFlights(request, response, &repo.FlightList, c, repo)
+	repo.RUnlock()
 
 	if err == nil {
 		return response, models.GetFlightsError{
@@ -277,7 +307,7 @@ func processCustomFieldQueries(request models.Request, response models.Response,
 
 	return request, response
 }
-func filterFlights(request models.Request, response models.Response, flightsLinkedList models.FlightLinkedList, c *gin.Context, repo *models.Repository) (models.Response, error) {
+func filterFlights(request models.Request, response models.Response, flights *models.FlightIndexedList, c *gin.Context, repo *models.Repository) (models.Response, error) {
 
 	//defer exeTime("Filter, Prune and Sort Flights")()
 	//returnFlights := []models.Flight{}
@@ -331,62 +361,43 @@ func filterFlights(request models.Request, response models.Response, flightsLink
 
 	filterStart := time.Now()
 
-	currentFlight := flightsLinkedList.Head
-
-NextFlight:
-	for currentFlight != nil {
-
-		if currentFlight.GetSTO().Before(from) {
-			currentFlight = currentFlight.NextNode
-			continue
-		}
-
-		if currentFlight.GetSTO().After(to) {
-			currentFlight = currentFlight.NextNode
-			continue
-		}
+	// Only the flights in the requested window are visited, in order of scheduled time
+	flights.Range(from, to, func(currentFlight *models.Flight) bool {
 
 		for _, queryableParameter := range request.PresentQueryableParameters {
 			queryValue := queryableParameter.Value
 			flightValue := currentFlight.GetProperty(queryableParameter.Parameter)
 
 			if flightValue == "" || queryValue != flightValue {
-				currentFlight = currentFlight.NextNode
-				continue NextFlight
+				return true
 			}
 		}
 
 		// Flight direction filter
 		if strings.HasPrefix(request.Direction, "D") && currentFlight.IsArrival() {
-			currentFlight = currentFlight.NextNode
-			continue
+			return true
 		}
 		if strings.HasPrefix(request.Direction, "A") && !currentFlight.IsArrival() {
-			currentFlight = currentFlight.NextNode
-			continue
+			return true
 		}
 
 		// Requested Airline Code filter
 		if request.Airline != "" && currentFlight.GetIATAAirline() != request.Airline {
-			currentFlight = currentFlight.NextNode
-			continue
+			return true
 		}
 
 		// RequestedRoute filter
 		if request.Route != "" && !strings.Contains(currentFlight.GetFlightRoute(), request.Route) {
-			currentFlight = currentFlight.NextNode
-			continue
+			return true
 		}
 
 		if request.FltNum != "" && !strings.Contains(currentFlight.GetFlightID(), request.FltNum) {
-			currentFlight = currentFlight.NextNode
-			continue
+			return true
 		}
 
 		if request.UpdatedSince != "" {
 			if currentFlight.LastUpdate.Before(updatedSinceTime) {
-				currentFlight = currentFlight.NextNode
-				continue
+				return true
 			}
 		}
 
@@ -395,21 +406,22 @@ NextFlight:
 		if !allowedAllAirline {
 			if request.UserProfile.AllowedAirlines != nil {
 				if !globals.Contains(request.UserProfile.AllowedAirlines, currentFlight.GetIATAAirline()) {
-					currentFlight = currentFlight.NextNode
-					continue
+					return true
 				}
 			}
 		}
 
 		// Made it here without being filtered out, so add it to the flights to be returned.
-		currentFlight.Action = globals.StatusAction
-		//	response.ResponseFlights.AddNode(models.FlightResponseItem{FlightPtr: currentFlight})
-		response.ResponseFlights = append(response.ResponseFlights, models.FlightResponseItem{FlightPtr: currentFlight, STO: currentFlight.GetSTO()})
+		// The stored flight is shared with other readers, so the response gets its own copy
+		flight := *currentFlight
+		flight.Action = globals.StatusAction
+		response.ResponseFlights = append(response.ResponseFlights, models.FlightResponseItem{FlightPtr: &flight, STO: flight.GetSTO()})
 
-		currentFlight = currentFlight.NextNode
-	}
+		return true
+	})
 
 	globals.MetricsLogger.Info(fmt.Sprintf("Filter Flights execution time: %s", time.Since(filterStart)))
+	monitoring.FilterDuration.WithLabelValues("filter_flights", repo.AMSAirport).Observe(time.Since(filterStart).Seconds())
 
 	//***Important
 	//Pruning is now done at the output to avoid creating additional copies of the data structure
@@ -417,9 +429,11 @@ NextFlight:
 	response.NumberOfFlights = len(response.ResponseFlights)
 
 	defer globals.ExeTime(fmt.Sprintf("Sorting %v Filtered Flights", response.NumberOfFlights))()
+	sortStart := time.Now()
 	sort.Slice(response.ResponseFlights, func(i, j int) bool {
 		return response.ResponseFlights[i].STO.Before(response.ResponseFlights[j].STO)
 	})
+	monitoring.FilterDuration.WithLabelValues("sort_flights", repo.AMSAirport).Observe(time.Since(sortStart).Seconds())
 
 	response.CustomFieldQuery = request.PresentQueryableParameters
 
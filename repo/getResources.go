@@ -13,12 +13,13 @@ import (
 
 	"flightresourcerestapi/globals"
 	"flightresourcerestapi/models"
+	"flightresourcerestapi/monitoring"
 	"flightresourcerestapi/timeservice"
 
 	"github.com/gin-gonic/gin"
 )
 
-func GetResourceSub(sub models.UserPushSubscription, userToken string) (models.ResourceResponse, models.GetFlightsError) {
+func GetResourceSub(sub models.UserPushSubscription, userProfile *models.UserProfile) (models.ResourceResponse, models.GetFlightsError) {
 
 	apt := sub.Airport
 	flightID := ""
@@ -30,7 +31,7 @@ func GetResourceSub(sub models.UserPushSubscription, userToken string) (models.R
 	updatedSince := ""
 	sortBy := "time"
 
-	return getResourcesCommon(apt, flightID, airline, resourceType, resource, strconv.Itoa(from), strconv.Itoa(to), updatedSince, sortBy, userToken, nil)
+	return getResourcesCommon(apt, flightID, airline, resourceType, resource, strconv.Itoa(from), strconv.Itoa(to), updatedSince, sortBy, userProfile, nil)
 }
 
 func GetResourceAPI(c *gin.Context) {
@@ -75,7 +76,7 @@ func GetResourceAPI(c *gin.Context) {
 	to := c.Query("to")
 	updatedSince := c.Query("updatedSince")
 
-	response, error := getResourcesCommon(apt, flightID, airline, resourceType, resource, from, to, updatedSince, sortBy, "", c)
+	response, error := getResourcesCommon(apt, flightID, airline, resourceType, resource, from, to, updatedSince, sortBy, nil, c)
 
 	fileName, err := writeResourceResponseToFile(response, &userProfile)
 
@@ -100,7 +101,9 @@ func GetResourceAPI(c *gin.Context) {
 	}
 }
 
-func getResourcesCommon(apt, flightID, airline, resourceType, resource, from, to, updatedSince, sortBy, userToken string, c *gin.Context) (models.ResourceResponse, models.GetFlightsError) {
+// getResourcesCommon returns the allocations for the user making the request, or for the user of the
+// push subscription if the profile is given
+func getResourcesCommon(apt, flightID, airline, resourceType, resource, from, to, updatedSince, sortBy string, profile *models.UserProfile, c *gin.Context) (models.ResourceResponse, models.GetFlightsError) {
 
 	response := models.ResourceResponse{}
 	//	c.Writer.Header().Set("Content-Type", "application/json")
@@ -161,7 +164,12 @@ func getResourcesCommon(apt, flightID, airline, resourceType, resource, from, to
 	}
 
 	// Get the profile of the user making the request
-	userProfile := GetUserProfile(c, userToken)
+	var userProfile models.UserProfile
+	if profile != nil {
+		userProfile = *profile
+	} else {
+		userProfile = GetUserProfile(c, "")
+	}
 	response.User = userProfile.UserName
 
 	// Set Default airport if none set
@@ -193,18 +201,20 @@ func getResourcesCommon(apt, flightID, airline, resourceType, resource, from, to
 
 	response.AirportCode = apt
 
-	var alloc = []models.AllocationResponseItem{}
+	if GetRepo(apt).IsSnapshotStale() {
+		response.AddWarning(snapshotStaleWarning)
+	}
 
-	globals.MapMutex.Lock()
-	defer globals.MapMutex.Unlock()
+	var alloc = []models.AllocationResponseItem{}
 
 	repo := GetRepo(apt)
-	allocMaps := []models.ResourceLinkedList{
-		repo.CheckInList,
-		repo.GateList,
-		repo.StandList,
-		repo.ChuteList,
-		repo.CarouselList}
+	repo.RLock()
+	allocMaps := []*models.ResourceIndexedList{
+		&repo.CheckInList,
+		&repo.GateList,
+		&repo.StandList,
+		&repo.ChuteList,
+		&repo.CarouselList}
 
 	filterStart := time.Now()
 	for idx, allocMap := range allocMaps {
@@ -228,77 +238,55 @@ func getResourcesCommon(apt, flightID, airline, resourceType, resource, from, to
 			}
 		}
 
-		r := allocMap.Head
-		for r != nil {
-
-			//If a specific resource has been requested, ignore the rest
-			if resource != "" && r.Resource.Name != resource {
-				r = r.NextNode
-				continue
-			}
-
-			list := r.FlightAllocationsList
+		// Only the allocations overlapping the requested window are visited.
+		// If a specific resource has been requested, only that resource is visited
+		allocMap.Overlapping(resource, fromTime, toTime, func(r *models.ResourceAllocationStruct, v *models.AllocationItem) bool {
 
-			v := list.Head
+			test := false
 
-			for v != nil {
-
-				test := false
-
-				if airline != "" && strings.HasPrefix(v.FlightID, airline) {
-					test = true
-				}
-				if flightID != "" && strings.Contains(v.FlightID, flightID) {
-					test = true
-				}
-
-				if airline == "" && flightID == "" {
-					test = true
-				}
-
-				if !test {
-					v = v.NextNode
-					continue
-				}
+			if airline != "" && strings.HasPrefix(v.FlightID, airline) {
+				test = true
+			}
+			if flightID != "" && strings.Contains(v.FlightID, flightID) {
+				test = true
+			}
 
-				if v.To.Before(fromTime) {
-					v = v.NextNode
-					continue
-				}
+			if airline == "" && flightID == "" {
+				test = true
+			}
 
-				if v.From.After(toTime) {
-					v = v.NextNode
-					continue
-				}
+			if !test {
+				return true
+			}
 
-				if updatedSinceErr == nil {
-					if v.LastUpdate.Before(updatedSinceTime) {
-						v = v.NextNode
-						continue
-					}
+			if updatedSinceErr == nil {
+				if v.LastUpdate.Before(updatedSinceTime) {
+					return true
 				}
+			}
 
-				n := models.AllocationResponseItem{
-					AllocationItem: models.AllocationItem{From: v.From,
-						To:                   v.To,
-						FlightID:             v.FlightID,
-						Direction:            v.Direction,
-						Route:                v.Route,
-						AircraftType:         v.AircraftType,
-						AircraftRegistration: v.AircraftRegistration,
-						LastUpdate:           v.LastUpdate},
-					ResourceType: r.Resource.ResourceTypeCode,
-					Name:         r.Resource.Name,
-					Area:         r.Resource.Area,
-				}
-				alloc = append(alloc, n)
-				v = v.NextNode
+			n := models.AllocationResponseItem{
+				AllocationItem: models.AllocationItem{From: v.From,
+					To:                   v.To,
+					FlightID:             v.FlightID,
+					Direction:            v.Direction,
+					Route:                v.Route,
+					AircraftType:         v.AircraftType,
+					AircraftRegistration: v.AircraftRegistration,
+					LastUpdate:           v.LastUpdate},
+				ResourceType: r.Resource.ResourceTypeCode,
+				Name:         r.Resource.Name,
+				Area:         r.Resource.Area,
 			}
-			r = r.NextNode
-		}
+			alloc = append(alloc, n)
+			return true
+		})
 	}
 
+	repo.RUnlock()
+
 	globals.MetricsLogger.Info(fmt.Sprintf("Filter Resources execution time: %s", time.Since(filterStart)))
+	monitoring.FilterDuration.WithLabelValues("filter_resources", apt).Observe(time.Since(filterStart).Seconds())
 
 	sortStart := time.Now()
 	if strings.ToLower(sortBy) == "time" {
@@ -321,6 +309,7 @@ func getResourcesCommon(apt, flightID, airline, resourceType, resource, from, to
 	}
 
 	globals.MetricsLogger.Info(fmt.Sprintf("Sort Resources execution time: %s", time.Since(sortStart)))
+	monitoring.FilterDuration.WithLabelValues("sort_resources", apt).Observe(time.Since(sortStart).Seconds())
 
 	response.Allocations = alloc
 
@@ -393,12 +382,13 @@ func GetConfiguredResources(c *gin.Context) {
 	var alloc = []models.ConfiguredResourceResponseItem{}
 
 	repo := GetRepo(apt)
-	allocMaps := []models.ResourceLinkedList{
-		repo.CheckInList,
-		repo.GateList,
-		repo.StandList,
-		repo.ChuteList,
-		repo.CarouselList}
+	repo.RLock()
+	allocMaps := []*models.ResourceIndexedList{
+		&repo.CheckInList,
+		&repo.GateList,
+		&repo.StandList,
+		&repo.ChuteList,
+		&repo.CarouselList}
 
 	for idx, allocMap := range allocMaps {
 
@@ -421,9 +411,7 @@ func GetConfiguredResources(c *gin.Context) {
 			}
 		}
 
-		struc := allocMap.Head
-
-		for struc != nil {
+		allocMap.ForEach(func(struc *models.ResourceAllocationStruct) bool {
 
 			n := models.ConfiguredResourceResponseItem{
 				ResourceTypeCode: struc.Resource.ResourceTypeCode,
@@ -431,10 +419,12 @@ func GetConfiguredResources(c *gin.Context) {
 				Area:             struc.Resource.Area,
 			}
 			alloc = append(alloc, n)
-			struc = struc.NextNode
-		}
+			return true
+		})
 	}
 
+	repo.RUnlock()
+
 	response.ConfiguredResources = alloc
 
 	// Get the filtered and pruned flights for the request
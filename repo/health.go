@@ -0,0 +1,441 @@
+package repo
+
+/*
+
+The health of each airport for the /healthz and /readyz endpoints. The components record their
+state here as they run: the listeners their connection, the loads from AMS their progress and the
+dispatcher the time of the last notification. The reachability of the AMS SOAP and REST services is
+checked when the repository is initialised and then every HealthCheckIntervalInSeconds
+
+*/
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/monitoring"
+	"flightresourcerestapi/version"
+)
+
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+const (
+	ListenerNotConfigured = "not_configured"
+	ListenerStarting      = "starting"
+	ListenerConnected     = "connected"
+	ListenerDisconnected  = "disconnected"
+	ListenerStopped       = "stopped"
+	ListenerFailed        = "failed"
+)
+
+const (
+	LoadWaitingForAMS    = "waiting_for_ams"
+	LoadLoadingResources = "loading_resources"
+	LoadLoadingFlights   = "loading_flights"
+	LoadLoaded           = "loaded"
+)
+
+type componentCheck struct {
+	reachable bool
+	checked   time.Time
+	latency   time.Duration
+	err       string
+}
+
+type airportHealth struct {
+	amsSOAP componentCheck
+	amsREST componentCheck
+
+	listenerType  string
+	listenerState string
+	listenerSince time.Time
+	listenerError string
+
+	notifications    int64
+	lastNotification time.Time
+
+	loadState     string
+	loadStarted   time.Time
+	loadCompleted time.Time
+	chunksLoaded  int
+	chunksTotal   int
+
+	refreshing          bool
+	lastRefresh         time.Time
+	lastRefreshComplete bool
+}
+
+var healthByAirport = make(map[string]*airportHealth)
+var healthMutex = &sync.Mutex{}
+
+// updateHealth changes the health of the airport while holding the lock
+func updateHealth(airportCode string, update func(h *airportHealth)) {
+
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	h := healthByAirport[airportCode]
+	if h == nil {
+		h = &airportHealth{listenerState: ListenerStarting, loadState: LoadWaitingForAMS}
+		healthByAirport[airportCode] = h
+	}
+	update(h)
+}
+
+func setListenerState(airportCode, state string, err error) {
+	updateHealth(airportCode, func(h *airportHealth) {
+		if h.listenerState != state {
+			h.listenerSince = time.Now()
+		}
+		h.listenerState = state
+		h.listenerError = ""
+		if err != nil {
+			h.listenerError = err.Error()
+		}
+	})
+}
+
+func recordNotificationReceived(airportCode string) {
+	updateHealth(airportCode, func(h *airportHealth) {
+		h.notifications++
+		h.lastNotification = time.Now()
+	})
+}
+
+// recordAMSCheck records the result of a check of the AMS SOAP or REST service of the airport
+func recordAMSCheck(airportCode string, soap bool, latency time.Duration, err error) {
+	updateHealth(airportCode, func(h *airportHealth) {
+		check := componentCheck{reachable: err == nil, checked: time.Now(), latency: latency}
+		if err != nil {
+			check.err = err.Error()
+		}
+		if soap {
+			h.amsSOAP = check
+		} else {
+			h.amsREST = check
+		}
+	})
+}
+
+// startInitialLoad marks the repository as waiting for AMS before its first load
+func startInitialLoad(airportCode string) {
+	updateHealth(airportCode, func(h *airportHealth) {
+		h.loadState = LoadWaitingForAMS
+		h.loadStarted = time.Now()
+		h.loadCompleted = time.Time{}
+		h.chunksLoaded = 0
+		h.chunksTotal = 0
+	})
+}
+
+func setLoadState(airportCode, state string) {
+	updateHealth(airportCode, func(h *airportHealth) {
+		if h.loadState != LoadLoaded {
+			h.loadState = state
+		}
+	})
+}
+
+func startRefresh(airportCode string, chunks int) {
+	updateHealth(airportCode, func(h *airportHealth) {
+		h.refreshing = true
+		if h.loadState != LoadLoaded {
+			h.loadState = LoadLoadingFlights
+			h.chunksLoaded = 0
+			h.chunksTotal = chunks
+		}
+	})
+}
+
+func recordChunkLoaded(airportCode string) {
+	updateHealth(airportCode, func(h *airportHealth) {
+		if h.loadState != LoadLoaded {
+			h.chunksLoaded++
+		}
+	})
+}
+
+// completeRefresh records the end of a load of the flights from AMS. The first load is complete even
+// if some chunks could not be retrieved, as the API is then serving the flights from AMS
+func completeRefresh(airportCode string, complete bool) {
+	updateHealth(airportCode, func(h *airportHealth) {
+		h.refreshing = false
+		h.lastRefresh = time.Now()
+		h.lastRefreshComplete = complete
+		if h.loadState != LoadLoaded {
+			h.loadState = LoadLoaded
+			h.loadCompleted = time.Now()
+		}
+	})
+}
+
+// checkAMSHealth checks that the AMS SOAP and REST services of the airport can each be reached within the timeout
+func checkAMSHealth(airportCode string, timeout time.Duration) {
+	for _, test := range []func(context.Context, string) bool{testNativeAPIConnectivity, testRestAPIConnectivity} {
+		ctx, cancel := context.WithTimeout(globals.Ctx, timeout)
+		test(ctx, airportCode)
+		cancel()
+	}
+}
+
+// monitorAMSHealth checks the AMS services of the airports that have completed their first load every
+// HealthCheckIntervalInSeconds until the service is stopped. Airports that are still waiting for AMS
+// are checked by their initialisation
+func monitorAMSHealth() {
+
+	interval := time.Duration(globals.ConfigViper.GetInt("HealthCheckIntervalInSeconds")) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	timeout := time.Duration(globals.ConfigViper.GetInt("HealthCheckTimeoutInSeconds")) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-globals.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, airportCode := range loadedAirports() {
+			checkAMSHealth(airportCode, timeout)
+		}
+	}
+}
+
+func loadedAirports() []string {
+
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	airports := []string{}
+	for airportCode, h := range healthByAirport {
+		if h.loadState == LoadLoaded {
+			airports = append(airports, airportCode)
+		}
+	}
+	return airports
+}
+
+// HealthReport returns the status of each airport and of the push workers
+func HealthReport() models.HealthReport {
+
+	report := models.HealthReport{Status: HealthOK, Ready: true, Version: version.Version, Airports: []models.AirportHealth{}}
+
+	globals.RepoListMutex.RLock()
+	repos := append([]*models.Repository{}, globals.RepoList...)
+	globals.RepoListMutex.RUnlock()
+
+	for _, r := range repos {
+		airport := airportHealthReport(r)
+		report.Airports = append(report.Airports, airport)
+
+		if !airport.Ready {
+			report.Ready = false
+		}
+		report.Status = worstHealth(report.Status, airport.Status)
+	}
+	sort.Slice(report.Airports, func(i, j int) bool { return report.Airports[i].Airport < report.Airports[j].Airport })
+
+	// Pushes that can not be sent do not stop the API from serving requests
+	report.PushWorkers = pushWorkerHealth()
+	if report.PushWorkers.Status != HealthOK {
+		report.Status = worstHealth(report.Status, HealthDegraded)
+	}
+
+	if globals.Ctx.Err() != nil {
+		report.Ready = false
+		report.Status = HealthUnavailable
+	}
+	return report
+}
+
+func airportHealthReport(r *models.Repository) models.AirportHealth {
+
+	now := time.Now()
+	apt := r.AMSAirport
+
+	report := models.AirportHealth{Airport: apt, Status: HealthOK}
+
+	r.RLock()
+	if !r.CurrentLowerLimit.IsZero() {
+		lower := r.CurrentLowerLimit
+		report.WindowLowerLimit = &lower
+	}
+	if !r.CurrentUpperLimit.IsZero() {
+		upper := r.CurrentUpperLimit
+		report.WindowUpperLimit = &upper
+	}
+	report.NumberOfFlights = r.FlightList.Len()
+	r.RUnlock()
+	report.SnapshotStale = r.IsSnapshotStale()
+
+	healthMutex.Lock()
+	h := healthByAirport[apt]
+	if h == nil {
+		h = &airportHealth{listenerState: ListenerStarting, loadState: LoadWaitingForAMS}
+	}
+	state := *h
+	healthMutex.Unlock()
+
+	report.AMSSOAP = componentHealth(state.amsSOAP)
+	report.AMSREST = componentHealth(state.amsREST)
+
+	report.Listener = models.ListenerHealth{Type: state.listenerType, State: state.listenerState, Error: state.listenerError, NotificationsReceived: state.notifications}
+	report.Listener.Since = optionalTime(state.listenerSince)
+
+	report.InitialLoad = models.LoadProgress{State: state.loadState, ChunksLoaded: state.chunksLoaded, ChunksTotal: state.chunksTotal}
+	report.InitialLoad.Started = optionalTime(state.loadStarted)
+	report.InitialLoad.Completed = optionalTime(state.loadCompleted)
+
+	report.LastNotification = optionalTime(state.lastNotification)
+	if !state.lastNotification.IsZero() {
+		seconds := int64(now.Sub(state.lastNotification).Seconds())
+		report.SecondsSinceLastNotification = &seconds
+	}
+	report.LastRefresh = optionalTime(state.lastRefresh)
+	if !state.lastRefresh.IsZero() {
+		seconds := int64(now.Sub(state.lastRefresh).Seconds())
+		report.SecondsSinceLastRefresh = &seconds
+	}
+	report.LastRefreshComplete = state.lastRefreshComplete
+	report.Refreshing = state.refreshing
+
+	// An airport is ready once it has been loaded from AMS. Problems after that leave it serving
+	// the flights it has, so it is degraded rather than unavailable
+	report.Ready = state.loadState == LoadLoaded
+	if !report.Ready {
+		report.Status = HealthUnavailable
+		report.Problems = append(report.Problems, fmt.Sprintf("Initial load %s", state.loadState))
+	}
+	if report.AMSSOAP.Status == HealthUnavailable {
+		report.Problems = append(report.Problems, "AMS SOAP service not reachable")
+	}
+	if report.AMSREST.Status == HealthUnavailable {
+		report.Problems = append(report.Problems, "AMS REST service not reachable")
+	}
+	if state.listenerState != ListenerConnected && state.listenerState != ListenerNotConfigured && report.Ready {
+		report.Problems = append(report.Problems, fmt.Sprintf("Notification listener %s", state.listenerState))
+	}
+	if !state.lastRefresh.IsZero() && !state.lastRefreshComplete {
+		report.Problems = append(report.Problems, "Last refresh from AMS incomplete")
+	}
+	if maxAge := time.Duration(globals.ConfigViper.GetInt("HealthMaxNotificationAgeInMinutes")) * time.Minute; maxAge > 0 && report.Ready &&
+		state.listenerState != ListenerNotConfigured && now.Sub(latest(state.lastNotification, state.listenerSince)) > maxAge {
+		report.Problems = append(report.Problems, fmt.Sprintf("No notification received for more than %s", maxAge))
+	}
+	if len(report.Problems) > 0 {
+		report.Status = worstHealth(report.Status, HealthDegraded)
+	}
+
+	return report
+}
+
+func componentHealth(check componentCheck) models.ComponentHealth {
+	if check.checked.IsZero() {
+		return models.ComponentHealth{Status: "unknown"}
+	}
+	health := models.ComponentHealth{Status: HealthOK, LatencyMS: check.latency.Milliseconds(), Error: check.err}
+	health.Checked = optionalTime(check.checked)
+	if !check.reachable {
+		health.Status = HealthUnavailable
+	}
+	return health
+}
+
+func worstHealth(a, b string) string {
+	rank := map[string]int{HealthOK: 0, HealthDegraded: 1, HealthUnavailable: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// pushWorkerHealth returns the state of the change push outbox and the scheduled push workers. Pushes
+// waiting to be retried count as failing destinations
+func pushWorkerHealth() models.PushWorkerHealth {
+
+	health := models.PushWorkerHealth{
+		Status:                     HealthOK,
+		ScheduledPushWorkers:       int(atomic.LoadInt32(&scheduledPushWorkers)),
+		ScheduledPushQueueDepth:    len(schedulePushJobChannel),
+		ScheduledPushQueueCapacity: cap(schedulePushJobChannel),
+	}
+
+	if health.ScheduledPushQueueDepth >= health.ScheduledPushQueueCapacity {
+		health.Problems = append(health.Problems, "Scheduled push queue full")
+	}
+
+	// The outbox is opened when the pushes of the first airport are scheduled
+	if outbox == nil {
+		if outboxError != nil {
+			health.Problems = append(health.Problems, fmt.Sprintf("Change push outbox not available: %s", outboxError))
+		}
+	} else {
+		health.ChangePushOutboxOpen = true
+		health.ChangePushWorkers = cap(outbox.sending)
+		health.ChangePushesSending = len(outbox.sending)
+
+		var oldest sql.NullString
+		if err := outbox.db.QueryRow("SELECT COUNT(*), MIN(created) FROM outbox").Scan(&health.ChangePushesPending, &oldest); err != nil {
+			health.Problems = append(health.Problems, fmt.Sprintf("Change push outbox could not be read: %s", err))
+		}
+		if created, err := time.Parse(snapshotTimeLayout, oldest.String); err == nil {
+			health.OldestPendingChangePushSeconds = int64(time.Since(created).Seconds())
+		}
+
+		failing := map[string]bool{}
+		rows, err := outbox.db.Query("SELECT DISTINCT destination FROM outbox WHERE attempts > 0")
+		if err == nil {
+			for rows.Next() {
+				var destination string
+				if rows.Scan(&destination) == nil {
+					failing[monitoring.Destination(destination)] = true
+				}
+			}
+			rows.Close()
+		}
+		for destination := range failing {
+			health.FailingDestinations = append(health.FailingDestinations, destination)
+		}
+		sort.Strings(health.FailingDestinations)
+		if len(health.FailingDestinations) > 0 {
+			health.Problems = append(health.Problems, fmt.Sprintf("Change pushes failing to %d destinations", len(health.FailingDestinations)))
+		}
+	}
+
+	if len(health.Problems) > 0 {
+		health.Status = HealthDegraded
+	}
+	return health
+}
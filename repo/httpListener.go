@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	RegisterListener("HTTP", func() NotificationListener { return &httpListener{} })
+}
+
+// The airports receiving notifications through the ingest endpoint and the handler of each
+var ingestHandlers = make(map[string]NotificationHandler)
+var ingestHandlersMutex = &sync.RWMutex{}
+
+// httpListener receives the notifications POSTed to /notifications/{airport} by the middleware of
+// the site. The sender must present the NotificationIngestToken of the airport in the "Token" header
+type httpListener struct{}
+
+func (l *httpListener) Listen(ctx context.Context, repo *models.Repository, handle NotificationHandler) error {
+
+	if repo.NotificationIngestToken == "" {
+		return fmt.Errorf("no NotificationIngestToken configured")
+	}
+
+	ingestHandlersMutex.Lock()
+	ingestHandlers[repo.AMSAirport] = handle
+	ingestHandlersMutex.Unlock()
+
+	globals.Logger.Info(fmt.Sprintf("Accepting notifications for %s on /notifications/%s", repo.AMSAirport, repo.AMSAirport))
+	setListenerState(repo.AMSAirport, ListenerConnected, nil)
+
+	<-ctx.Done()
+
+	ingestHandlersMutex.Lock()
+	delete(ingestHandlers, repo.AMSAirport)
+	ingestHandlersMutex.Unlock()
+
+	return nil
+}
+
+// IngestNotificationAPI applies an AMS notification POSTed for the airport. The response is sent once
+// the notification has been applied to the repository
+func IngestNotificationAPI(c *gin.Context) {
+
+	apt := c.Param("apt")
+
+	ingestHandlersMutex.RLock()
+	handle := ingestHandlers[apt]
+	ingestHandlersMutex.RUnlock()
+
+	repo := GetRepo(apt)
+	if handle == nil || repo == nil {
+		c.JSON(http.StatusNotFound, gin.H{"Error": fmt.Sprintf("Airport %s is not accepting notifications", apt)})
+		return
+	}
+
+	token := c.GetHeader("Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(repo.NotificationIngestToken)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"Error": "Not Authorized"})
+		return
+	}
+
+	globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", "notification ingest", c.RemoteIP(), c.Request.RequestURI))
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxNotificationSize()))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"Error": fmt.Sprintf("The notification is larger than %d bytes", tooLarge.Limit)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "Could not read the notification"})
+		return
+	}
+
+	// The token only allows notifications for the flights of its airport
+	if err := handle(withExpectedAirport(c.Request.Context(), apt), string(body)); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errWrongAirport) {
+			status = http.StatusForbidden
+		}
+		c.JSON(status, gin.H{"Error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"Status": "Notification applied"})
+}
+
+// maxNotificationSize is the largest notification accepted, MaxNotificationSizeInKB (default 10240)
+func maxNotificationSize() int64 {
+	if kb := globals.ConfigViper.GetInt64("MaxNotificationSizeInKB"); kb > 0 {
+		return kb * 1024
+	}
+	return 10240 * 1024
+}
@@ -0,0 +1,125 @@
+package repo
+
+/*
+
+Notification listeners receive the AMS flight notifications of an airport and hand them to the
+dispatcher, which applies them to the repository. The listener of an airport is chosen by the
+ListenerType in airports.json from the listeners registered here
+
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NotificationHandler applies a notification to the repository. The context carries the trace of the
+// notification, if the sender started one
+type NotificationHandler func(ctx context.Context, message string) error
+
+// NotificationListener receives the notifications of an airport
+type NotificationListener interface {
+	// Listen receives the notifications of the repository and passes each one to the handler
+	// until the context is cancelled
+	Listen(ctx context.Context, repo *models.Repository, handle NotificationHandler) error
+}
+
+var listenerRegistry = make(map[string]func() NotificationListener)
+var listenerRegistryMutex = &sync.RWMutex{}
+
+// RegisterListener makes the listener available to airports with the ListenerType
+func RegisterListener(listenerType string, factory func() NotificationListener) {
+	listenerRegistryMutex.Lock()
+	defer listenerRegistryMutex.Unlock()
+
+	listenerRegistry[strings.ToUpper(listenerType)] = factory
+}
+
+// newListener returns a new listener of the type, or nil if no listener of that type is registered
+func newListener(listenerType string) NotificationListener {
+	listenerRegistryMutex.RLock()
+	defer listenerRegistryMutex.RUnlock()
+
+	factory := listenerRegistry[strings.ToUpper(listenerType)]
+	if factory == nil {
+		return nil
+	}
+	return factory()
+}
+
+func registeredListenerTypes() []string {
+	listenerRegistryMutex.RLock()
+	defer listenerRegistryMutex.RUnlock()
+
+	types := []string{}
+	for t := range listenerRegistry {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// listen runs the listener configured for the airport until the service is stopped
+func listen(airportCode string) {
+
+	repo := GetRepo(airportCode)
+
+	updateHealth(airportCode, func(h *airportHealth) { h.listenerType = strings.ToUpper(repo.ListenerType) })
+
+	// The repository is only refreshed by the scheduled updates
+	if repo.ListenerType == "" || strings.EqualFold(repo.ListenerType, "NONE") {
+		globals.Logger.Info(fmt.Sprintf("No notification listener configured for %s", airportCode))
+		setListenerState(airportCode, ListenerNotConfigured, nil)
+		return
+	}
+
+	listener := newListener(repo.ListenerType)
+	if listener == nil {
+		globals.Logger.Error(fmt.Sprintf("No notification listener of type \"%s\" for %s. Available types are %s",
+			repo.ListenerType, airportCode, strings.Join(registeredListenerTypes(), ", ")))
+		setListenerState(airportCode, ListenerFailed, fmt.Errorf("no notification listener of type %s", repo.ListenerType))
+		return
+	}
+	setListenerState(airportCode, ListenerStarting, nil)
+
+	globals.ShutdownWg.Add(1)
+	defer globals.ShutdownWg.Done()
+
+	globals.Logger.Info(fmt.Sprintf("Starting %s notification listener for %s", strings.ToUpper(repo.ListenerType), airportCode))
+
+	// Notifications that can not be applied are kept in the dead letter store
+	listenerType := strings.ToUpper(repo.ListenerType)
+	handle := func(ctx context.Context, message string) error {
+		recordNotificationReceived(airportCode)
+
+		ctx, span := tracing.StartSpan(ctx, "notification.receive", trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(attribute.String("airport", airportCode), attribute.String("listener", listenerType), attribute.Int("message.size", len(message))))
+
+		err := dispatchNotification(ctx, message)
+		if err != nil && !errors.Is(err, errPipelineStopped) && !errors.Is(err, errWrongAirport) {
+			recordDeadLetter(airportCode, listenerType, message, err)
+		}
+		tracing.End(span, err)
+		return err
+	}
+
+	if err := listener.Listen(globals.Ctx, repo, handle); err != nil {
+		globals.Logger.Error(fmt.Sprintf("%s notification listener for %s stopped: %s", strings.ToUpper(repo.ListenerType), airportCode, err))
+		setListenerState(airportCode, ListenerFailed, err)
+		return
+	}
+	setListenerState(airportCode, ListenerStopped, nil)
+
+	globals.Logger.Info(fmt.Sprintf("Closed %s notification listener for %s", strings.ToUpper(repo.ListenerType), airportCode))
+}
@@ -1,181 +1,295 @@
 package repo
 
 import (
-	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 
 	"time"
 
 	"flightresourcerestapi/globals"
 	"flightresourcerestapi/models"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
-func UpdateFlightEntry(message string, append bool) {
+func UpdateFlightEntry(message string, append bool) error {
 
 	var envel models.FlightUpdatedNotificationEnvelope
-	xml.Unmarshal([]byte(message), &envel)
+	if err := xml.Unmarshal([]byte(message), &envel); err != nil {
+		return fmt.Errorf("could not parse %s: %w", globals.FlightUpdatedMessage, err)
+	}
 
-	flight := envel.Content.FlightUpdatedNotification.Flight
+	return applyFlightUpdate(context.Background(), envel.Content.FlightUpdatedNotification.Flight, append)
+}
 
-	airportCode := flight.GetIATAAirport()
-	repo := GetRepo(airportCode)
+// applyFlightUpdate replaces the flight in the repository, or adds it if append is set
+func applyFlightUpdate(ctx context.Context, flight models.Flight, append bool) error {
 
-	if repo == nil {
-		globals.Logger.Warn(fmt.Sprintf("Message for unmanaged airport %s received", airportCode))
-		return
+	repo, err := notificationRepository(flight)
+	if err != nil {
+		return err
 	}
+	airportCode := repo.AMSAirport
 
 	sdot := flight.GetSDO()
 
 	if sdot.Before(time.Now().AddDate(0, 0, repo.FlightSDOWindowMinimumInDaysFromNow-2)) {
 		globals.Logger.Debugf("Update for Flight Before Window. Flight ID: %s", flight.GetFlightID())
-		return
+		return nil
 	}
 	if sdot.After(time.Now().AddDate(0, 0, repo.FlightSDOWindowMaximumInDaysFromNow+2)) {
 		globals.Logger.Debugf("Update for Flight After Window. Flight ID: %s", flight.GetFlightID())
-		return
+		return nil
 	}
 
 	flight.LastUpdate = time.Now()
 	flight.Action = globals.UpdateAction
 
-	globals.MapMutex.Lock()
+	defer lockFlight(airportCode, flight.GetFlightID())()
+
+	repo.Lock()
+	if isStale(repo, flight) {
+		repo.Unlock()
+		return nil
+	}
 	if append {
-		repo.FlightLinkedList.AddNode(flight)
+		repo.FlightList.AddNode(flight)
 		upadateAllocation(flight, airportCode, true)
 
 	} else {
-		repo.FlightLinkedList.ReplaceOrAddNode(flight)
+		repo.FlightList.ReplaceOrAddNode(flight)
 		upadateAllocation(flight, airportCode, false)
 
 	}
-	globals.MapMutex.Unlock()
-
-	globals.FlightUpdatedChannel <- models.FlightUpdateChannelMessage{FlightID: flight.GetFlightID(), AirportCode: airportCode}
+	repo.FlightTombstones.Remove(flight.GetFlightID())
+	entry := recordFlightHistory(repo, repo.FlightList.GetFlight(flight.GetFlightID()), globals.FlightUpdatedMessage)
+	repo.Unlock()
 
-	// db, err := sql.Open("sqlite3", airportCode+".db")
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
+	persistFlight(airportCode, flight)
+	persistFlightHistory(airportCode, []models.FlightHistoryEntry{entry})
 
-	// defer db.Close()
-
-	// tx, err := db.Begin()
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
-
-	// stmt, err := tx.Prepare("INSERT INTO flights(flightid, jsonflight) VALUES(  ?, ? )")
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// defer stmt.Close() // Prepared statements take up server resources and should be closed after use.
-
-	// if _, err := stmt.Exec(flight.GetFlightID()); err != nil {
-	// 	log.Fatal(err)
-	// }
+	globals.FlightUpdatedChannel <- models.FlightUpdateChannelMessage{FlightID: flight.GetFlightID(), AirportCode: airportCode, Ctx: ctx}
+	return nil
+}
+func createFlightEntry(message string) error {
 
-	// if err := tx.Commit(); err != nil {
-	// 	log.Fatal(err)
-	// } else {
-	// 	fmt.Println("Wrote Flight to database")
-	// }
+	var envel models.FlightCreatedNotificationEnvelope
+	if err := xml.Unmarshal([]byte(message), &envel); err != nil {
+		return fmt.Errorf("could not parse %s: %w", globals.FlightCreatedMessage, err)
+	}
 
+	return applyFlightCreate(context.Background(), envel.Content.FlightCreatedNotification.Flight)
 }
-func createFlightEntry(message string) {
 
-	var envel models.FlightCreatedNotificationEnvelope
-	xml.Unmarshal([]byte(message), &envel)
+func applyFlightCreate(ctx context.Context, flight models.Flight) error {
 
-	flight := envel.Content.FlightCreatedNotification.Flight
 	flight.LastUpdate = time.Now()
 	flight.Action = globals.CreateAction
 
-	airportCode := flight.GetIATAAirport()
-	repo := GetRepo(airportCode)
+	repo, err := notificationRepository(flight)
+	if err != nil {
+		return err
+	}
+	airportCode := repo.AMSAirport
+
 	sdot := flight.GetSDO()
 
-	if sdot.Before(time.Now().AddDate(0, 0, GetRepo(airportCode).FlightSDOWindowMinimumInDaysFromNow-2)) {
+	if sdot.Before(time.Now().AddDate(0, 0, repo.FlightSDOWindowMinimumInDaysFromNow-2)) {
 		log.Println("Create for Flight Before Window")
-		return
+		return nil
 	}
-	if sdot.After(time.Now().AddDate(0, 0, GetRepo(airportCode).FlightSDOWindowMaximumInDaysFromNow+2)) {
+	if sdot.After(time.Now().AddDate(0, 0, repo.FlightSDOWindowMaximumInDaysFromNow+2)) {
 		log.Println("Create for Flight After Window")
-		return
+		return nil
 	}
-	//globals.MapMutex.Lock()
-	repo.FlightLinkedList.ReplaceOrAddNode(flight)
+
+	defer lockFlight(airportCode, flight.GetFlightID())()
+
+	repo.Lock()
+	if isStale(repo, flight) {
+		repo.Unlock()
+		return nil
+	}
+	repo.FlightList.ReplaceOrAddNode(flight)
 	upadateAllocation(flight, airportCode, false)
-	//globals.MapMutex.Unlock()
+	repo.FlightTombstones.Remove(flight.GetFlightID())
+	entry := recordFlightHistory(repo, repo.FlightList.GetFlight(flight.GetFlightID()), globals.FlightCreatedMessage)
+	repo.Unlock()
 
-	globals.FlightCreatedChannel <- models.FlightUpdateChannelMessage{FlightID: flight.GetFlightID(), AirportCode: airportCode}
+	persistFlight(airportCode, flight)
+	persistFlightHistory(airportCode, []models.FlightHistoryEntry{entry})
+
+	globals.FlightCreatedChannel <- models.FlightUpdateChannelMessage{FlightID: flight.GetFlightID(), AirportCode: airportCode, Ctx: ctx}
+	return nil
 }
-func deleteFlightEntry(message string) {
+func deleteFlightEntry(message string) error {
 
 	var envel models.FlightDeletedNotificationEnvelope
-	xml.Unmarshal([]byte(message), &envel)
+	if err := xml.Unmarshal([]byte(message), &envel); err != nil {
+		return fmt.Errorf("could not parse %s: %w", globals.FlightDeletedMessage, err)
+	}
+
+	return applyFlightDelete(context.Background(), envel.Content.FlightDeletedNotification.Flight)
+}
+
+func applyFlightDelete(ctx context.Context, flight models.Flight) error {
+
+	repo, err := notificationRepository(flight)
+	if err != nil {
+		return err
+	}
+
+	deleteFlight(ctx, repo, flight, globals.FlightDeletedMessage, nil)
+	return nil
+}
+
+// deleteFlight removes the flight from the repository, records the delete in its history and sends it to
+// the push manager. If remove is given, the flight is only deleted if remove returns true for the version
+// in the repository. The DataVersion of the delete is kept so older notifications for the flight that
+// arrive later are dropped. Returns whether the flight was deleted
+func deleteFlight(ctx context.Context, repo *models.Repository, flight models.Flight, messageType string, remove func(current *models.Flight) bool) bool {
 
-	flight := envel.Content.FlightDeletedNotification.Flight
+	airportCode := repo.AMSAirport
 	flight.Action = globals.DeleteAction
 
+	// The deleted flight is kept in the history so the timeline shows when it was deleted
+	deleted := flight
+	deleted.LastUpdate = time.Now()
+
+	defer lockFlight(airportCode, flight.GetFlightID())()
+
+	repo.Lock()
+	current := repo.FlightList.GetFlight(flight.GetFlightID())
+	if remove != nil && (current == nil || !remove(current)) {
+		repo.Unlock()
+		return false
+	}
+	if newest := newestVersion(repo, flight.GetFlightID()); flight.IsOlderThan(newest) {
+		repo.Unlock()
+		repo.CountStaleDeleteDropped()
+		globals.Logger.Debugf("Dropped stale delete for Flight ID: %s. DataVersion %d is older than %d", flight.GetFlightID(), flight.DataVersion, newest.DataVersion)
+		return false
+	}
+
+	dataVersion := flight.DataVersion
+	if current != nil && current.DataVersion > dataVersion {
+		dataVersion = current.DataVersion
+	}
+	if maxFlights := flightTombstoneMaxFlights(); dataVersion > 0 && maxFlights > 0 {
+		repo.FlightTombstones.Add(flight.GetFlightID(), dataVersion, maxFlights)
+	}
+
+	(*repo).FlightList.RemoveNode(flight)
+	(*repo).RemoveFlightAllocation(flight.GetFlightID())
+	entry := recordFlightHistory(repo, &deleted, messageType)
+	repo.Unlock()
+
+	persistFlightDelete(airportCode, flight.GetFlightID())
+	persistFlightHistory(airportCode, []models.FlightHistoryEntry{entry})
+
+	globals.FlightDeletedChannel <- models.FlightDeleteChannelMessage{Flight: flight, Ctx: ctx}
+	return true
+}
+
+var errNoFlight = errors.New("the notification does not identify a flight")
+
+// notificationRepository returns the repository of the airport of the flight in a notification
+func notificationRepository(flight models.Flight) (*models.Repository, error) {
+
 	airportCode := flight.GetIATAAirport()
+	if airportCode == "" || flight.FlightId.FlightNumber == "" {
+		return nil, errNoFlight
+	}
+
 	repo := GetRepo(airportCode)
+	if repo == nil {
+		return nil, fmt.Errorf("message for unmanaged airport %s", airportCode)
+	}
+	return repo, nil
+}
 
-	(*repo).FlightLinkedList.RemoveNode(flight)
-	(*repo).RemoveFlightAllocation(flight.GetFlightID())
+// isStale reports whether the repository already holds a newer version of the flight, or deleted a
+// newer version, in which case the notification is dropped. Must be called while holding the write
+// lock of the repository
+func isStale(repo *models.Repository, flight models.Flight) bool {
+
+	current := newestVersion(repo, flight.GetFlightID())
+	if !flight.IsOlderThan(current) {
+		return false
+	}
+
+	repo.CountStaleUpdateDropped()
+	globals.Logger.Debugf("Dropped stale notification for Flight ID: %s. DataVersion %d is older than %d", flight.GetFlightID(), flight.DataVersion, current.DataVersion)
+	return true
+}
+
+// newestVersion returns the flight held by the repository or, if it has been deleted, a flight with
+// the DataVersion it was deleted at. Must be called while holding the lock of the repository
+func newestVersion(repo *models.Repository, flightID string) *models.Flight {
+	if current := repo.FlightList.GetFlight(flightID); current != nil {
+		return current
+	}
+	if dataVersion, ok := repo.FlightTombstones.Get(flightID); ok {
+		return &models.Flight{DataVersion: dataVersion}
+	}
+	return nil
+}
 
-	globals.FlightDeletedChannel <- flight
+// flightTombstoneMaxFlights is the number of deleted flights whose DataVersion is kept by each repository
+func flightTombstoneMaxFlights() int {
+	if globals.ConfigViper.IsSet("FlightTombstoneMaxFlights") {
+		return globals.ConfigViper.GetInt("FlightTombstoneMaxFlights")
+	}
+	return 10000
 }
-func getFlights(airportCode string, values ...int) []byte {
+
+// getFlights gets the flights of the airport from AMS. The optional values are the start and end of the
+// window in days from now, otherwise the window of the repository is used
+func getFlights(airportCode string, values ...int) ([]models.Flight, error) {
 
 	repo := GetRepo(airportCode)
-	from := time.Now().AddDate(0, 0, repo.FlightSDOWindowMinimumInDaysFromNow).Format("2006-01-02")
-	to := time.Now().AddDate(0, 0, repo.FlightSDOWindowMaximumInDaysFromNow+1).Format("2006-01-02")
+	from := time.Now().AddDate(0, 0, repo.FlightSDOWindowMinimumInDaysFromNow)
+	to := time.Now().AddDate(0, 0, repo.FlightSDOWindowMaximumInDaysFromNow+1)
 
 	// Change the window based on optional inout parameters
 	if len(values) >= 1 {
-		from = time.Now().AddDate(0, 0, values[0]).Format("2006-01-02")
+		from = time.Now().AddDate(0, 0, values[0])
 	}
 
 	// Add in a sneaky extra day
 	if len(values) >= 2 {
-		to = time.Now().AddDate(0, 0, values[1]+1).Format("2006-01-02")
+		to = time.Now().AddDate(0, 0, values[1]+1)
 	}
 
-	globals.Logger.Debug(fmt.Sprintf("Getting flight from %s to %s", from, to))
-	fmt.Printf("Getting flights from %s to %s\n", from, to)
+	globals.Logger.Debug(fmt.Sprintf("Getting flight from %s to %s", from.Format("2006-01-02"), to.Format("2006-01-02")))
+	fmt.Printf("Getting flights from %s to %s\n", from.Format("2006-01-02"), to.Format("2006-01-02"))
 
-	queryBody := fmt.Sprintf(xmlGetFlightsTemplateBody, repo.AMSToken, from, to, repo.AMSAirport)
-	bodyReader := bytes.NewReader([]byte(queryBody))
-
-	req, err := http.NewRequest(http.MethodPost, repo.AMSSOAPServiceURL, bodyReader)
+	flights, err := getAMSClient(airportCode).GetFlights(globals.Ctx, from, to)
 	if err != nil {
-		globals.Logger.Error(fmt.Sprintf("client: could not create request: %s\n", err))
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "text/xml;charset=UTF-8")
-	req.Header.Add("SOAPAction", "http://www.sita.aero/ams6-xml-api-webservice/IAMSIntegrationService/GetFlights")
+	fmt.Printf("Got flights from %s to %s\n", from.Format("2006-01-02"), to.Format("2006-01-02"))
+	return flights, nil
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		globals.Logger.Error(fmt.Sprintf("client: error making http request: %s\n", err))
-	}
+// recordFlightHistory adds the version of the flight to its history.
+// Must be called while holding the write lock of the repository
+func recordFlightHistory(repo *models.Repository, flight *models.Flight, messageType string) models.FlightHistoryEntry {
 
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		globals.Logger.Error(fmt.Sprintf("client: could not read response body: %s\n", err))
+	entry := models.FlightHistoryEntry{
+		FlightID:    flight.GetFlightID(),
+		Flight:      flight,
+		LastUpdate:  flight.LastUpdate,
+		MessageType: messageType,
 	}
+	repo.FlightHistory.Add(entry, globals.ConfigViper.GetInt("FlightHistoryMaxVersions"))
 
-	fmt.Printf("Got flights from %s to %s\n", from, to)
-	return resBody
+	return entry
 }
+
+// upadateAllocation must be called while holding the write lock of the repository
 func upadateAllocation(flight models.Flight, airportCode string, bypassDelete bool) {
 
 	//defer exeTime(fmt.Sprintf("Updated allocations for Flight %s", flight.GetFlightID()))()
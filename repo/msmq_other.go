@@ -0,0 +1,24 @@
+//go:build !windows
+
+package repo
+
+import (
+	"context"
+	"errors"
+
+	"flightresourcerestapi/models"
+)
+
+// MSMQ is only available on Windows
+
+func init() {
+	RegisterListener("MSMQ", func() NotificationListener { return msmqUnavailable{} })
+}
+
+type msmqUnavailable struct{}
+
+func (msmqUnavailable) Listen(ctx context.Context, repo *models.Repository, handle NotificationHandler) error {
+	return errors.New("MSMQ is only available on Windows. Use a ListenerType of \"RMQ\"")
+}
+
+func clearMSMQ(airportCode string) {}
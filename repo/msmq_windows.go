@@ -0,0 +1,123 @@
+package repo
+
+/*
+
+MSMQ is only available on Windows. The listener and queue maintenance for airports
+configured with a ListenerType of "MSMQ" are here
+
+*/
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/jandauz/go-msmq"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+)
+
+func clearMSMQ(airportCode string) {
+
+	repo := GetRepo(airportCode)
+
+	if repo.ListenerType == "MSMQ" {
+		// Purge the listening queue first before doing the Initializarion of the repository
+		opts := []msmq.QueueInfoOption{
+			msmq.WithPathName(repo.NotificationListenerQueue),
+		}
+		queueInfo, err := msmq.NewQueueInfo(opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		queue, err := queueInfo.Open(msmq.Receive, msmq.DenyNone)
+
+		if err == nil {
+			purgeErr := queue.Purge()
+			if purgeErr != nil {
+				if globals.IsDebug {
+					globals.Logger.Error("Error purging listening queue")
+				}
+			} else {
+				if globals.IsDebug {
+					globals.Logger.Info("Listening queue purged OK")
+				}
+			}
+		}
+	}
+
+}
+
+// The time a receive waits for a message before checking whether the service is stopping
+const msmqReceiveTimeoutInMilliseconds = 1000
+
+func init() {
+	RegisterListener("MSMQ", func() NotificationListener { return &msmqListener{} })
+}
+
+// msmqListener receives the notifications from the MSMQ queue of the airport
+type msmqListener struct{}
+
+func (l *msmqListener) Listen(ctx context.Context, repo *models.Repository, handle NotificationHandler) error {
+
+	//Listen to the notification queue
+	opts := []msmq.QueueInfoOption{
+		msmq.WithPathName(repo.NotificationListenerQueue),
+	}
+	queueInfo, err := msmq.NewQueueInfo(opts...)
+	if err != nil {
+		return err
+	}
+
+	inflight := make(chan struct{}, getPipeline().capacity())
+
+ReconnectMSMQ:
+	for ctx.Err() == nil {
+
+		queue, err := queueInfo.Open(msmq.Receive, msmq.DenyNone)
+		if err != nil {
+			globals.Logger.Error(err)
+			setListenerState(repo.AMSAirport, ListenerDisconnected, err)
+			continue ReconnectMSMQ
+		}
+		setListenerState(repo.AMSAirport, ListenerConnected, nil)
+
+		for {
+
+			if ctx.Err() != nil {
+				queue.Close()
+				break ReconnectMSMQ
+			}
+
+			msg, err := queue.Receive(msmq.ReceiveWithTimeout(msmqReceiveTimeoutInMilliseconds))
+			if err != nil {
+				globals.Logger.Error(err)
+				setListenerState(repo.AMSAirport, ListenerDisconnected, err)
+				queue.Close()
+				continue ReconnectMSMQ
+			}
+
+			// An empty message is returned if the receive timed out
+			message, _ := msg.Body()
+			if message == "" {
+				continue
+			}
+
+			// Wait while the pipeline is saturated rather than receiving more
+			inflight <- struct{}{}
+			go func(message string) {
+				defer func() { <-inflight }()
+				if err := handle(context.Background(), message); err != nil {
+					globals.Logger.Warn(fmt.Sprintf("Ignored MSMQ message for %s: %s", repo.AMSAirport, err))
+				}
+			}(message)
+
+			queue.Close()
+			continue ReconnectMSMQ
+		}
+	}
+
+	return nil
+}
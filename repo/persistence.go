@@ -0,0 +1,438 @@
+package repo
+
+/*
+
+Functions in this file persist the repository of each airport to a local SQLite database.
+Flights, flight history, resource allocations and the configured resources are written through on every
+create, update and delete so that on a restart the repository can be loaded from the
+snapshot immediately while the reconcile with AMS happens in the background
+
+*/
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const snapshotSchema = `
+CREATE TABLE IF NOT EXISTS flights(flightid TEXT PRIMARY KEY, sdo TEXT, lastupdate TEXT, xmlflight BLOB);
+CREATE TABLE IF NOT EXISTS allocations(flightid TEXT, resourcetype TEXT, resourceid TEXT, fromtime TEXT, totime TEXT,
+	direction TEXT, route TEXT, aircrafttype TEXT, aircraftregistration TEXT, lastupdate TEXT);
+CREATE INDEX IF NOT EXISTS allocations_flightid ON allocations(flightid);
+CREATE TABLE IF NOT EXISTS resources(resourcetype TEXT, name TEXT, area TEXT, resourcetypecode TEXT, PRIMARY KEY(resourcetype, name));
+CREATE TABLE IF NOT EXISTS limits(id INTEGER PRIMARY KEY CHECK (id = 0), lower TEXT, upper TEXT);
+CREATE TABLE IF NOT EXISTS history(seq INTEGER PRIMARY KEY AUTOINCREMENT, flightid TEXT, sdo TEXT, messagetype TEXT, lastupdate TEXT, xmlflight BLOB);
+CREATE INDEX IF NOT EXISTS history_flightid ON history(flightid);
+`
+
+const snapshotTimeLayout = time.RFC3339Nano
+
+const snapshotStaleWarning = "Repository loaded from local snapshot. Data may be stale until synchronisation with AMS completes"
+
+// The resource types as recorded in the snapshot and the repository list that holds them
+var snapshotResourceTypes = []string{"CheckIns", "Gates", "Stands", "Carousels", "Chutes"}
+
+func snapshotResourceList(repo *models.Repository, resourceType string) *models.ResourceIndexedList {
+	switch resourceType {
+	case "CheckIns":
+		return &repo.CheckInList
+	case "Gates":
+		return &repo.GateList
+	case "Stands":
+		return &repo.StandList
+	case "Carousels":
+		return &repo.CarouselList
+	case "Chutes":
+		return &repo.ChuteList
+	}
+	return nil
+}
+
+var snapshotDBs = make(map[string]*sql.DB)
+var snapshotDBsMutex = &sync.RWMutex{}
+
+func persistenceEnabled() bool {
+	return globals.ConfigViper.GetBool("EnablePersistence") && !globals.DemoMode
+}
+
+func getSnapshotDB(airportCode string) *sql.DB {
+	snapshotDBsMutex.RLock()
+	defer snapshotDBsMutex.RUnlock()
+	return snapshotDBs[airportCode]
+}
+
+// openSnapshotDB opens (creating if required) the snapshot database for the airport
+func openSnapshotDB(airportCode string) (*sql.DB, error) {
+
+	if db := getSnapshotDB(airportCode); db != nil {
+		return db, nil
+	}
+
+	dir := globals.ConfigViper.GetString("PersistenceDirectory")
+	if dir == "" {
+		dir = "."
+	}
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL", filepath.Join(dir, airportCode+".db"))
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows one writer, so serialise access through a single connection
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(snapshotSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	snapshotDBsMutex.Lock()
+	snapshotDBs[airportCode] = db
+	snapshotDBsMutex.Unlock()
+
+	return db, nil
+}
+
+// loadRepositorySnapshot populates the repository from the snapshot database.
+// Returns true if any flights were loaded
+func loadRepositorySnapshot(airportCode string) bool {
+
+	defer globals.ExeTime(fmt.Sprintf("Loading Repository Snapshot for %s", airportCode))()
+
+	db, err := openSnapshotDB(airportCode)
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not open repository snapshot for %s: %s", airportCode, err))
+		return false
+	}
+
+	repo := GetRepo(airportCode)
+	repo.Lock()
+	defer repo.Unlock()
+
+	// Resources first so the allocations have somewhere to go
+	rows, err := db.Query("SELECT resourcetype, name, area, resourcetypecode FROM resources ORDER BY rowid")
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not read resources from snapshot for %s: %s", airportCode, err))
+		return false
+	}
+	for rows.Next() {
+		var resourceType string
+		var res models.FixedResource
+		if err := rows.Scan(&resourceType, &res.Name, &res.Area, &res.ResourceTypeCode); err != nil {
+			continue
+		}
+		if list := snapshotResourceList(repo, resourceType); list != nil {
+			list.AddNodes([]models.FixedResource{res})
+		}
+	}
+	rows.Close()
+
+	numFlights := 0
+	rows, err = db.Query("SELECT xmlflight FROM flights")
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not read flights from snapshot for %s: %s", airportCode, err))
+		return false
+	}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			continue
+		}
+		var flight models.Flight
+		if err := xml.Unmarshal(data, &flight); err != nil {
+			globals.Logger.Warn(fmt.Sprintf("Skipping unreadable flight in snapshot for %s: %s", airportCode, err))
+			continue
+		}
+		repo.FlightList.ReplaceOrAddNode(flight)
+		numFlights++
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT flightid, resourcetype, resourceid, fromtime, totime, direction, route, aircrafttype, aircraftregistration, lastupdate FROM allocations`)
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not read allocations from snapshot for %s: %s", airportCode, err))
+		return false
+	}
+	for rows.Next() {
+		var resourceType, from, to, lastUpdate string
+		a := models.AllocationItem{AirportCode: airportCode}
+		if err := rows.Scan(&a.FlightID, &resourceType, &a.ResourceID, &from, &to, &a.Direction, &a.Route, &a.AircraftType, &a.AircraftRegistration, &lastUpdate); err != nil {
+			continue
+		}
+		a.From, _ = time.Parse(snapshotTimeLayout, from)
+		a.To, _ = time.Parse(snapshotTimeLayout, to)
+		a.LastUpdate, _ = time.Parse(snapshotTimeLayout, lastUpdate)
+		if list := snapshotResourceList(repo, resourceType); list != nil {
+			list.AddAllocation(a)
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT flightid, messagetype, lastupdate, xmlflight FROM history ORDER BY seq")
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not read flight history from snapshot for %s: %s", airportCode, err))
+		return false
+	}
+	maxVersions := globals.ConfigViper.GetInt("FlightHistoryMaxVersions")
+	for rows.Next() {
+		var lastUpdate string
+		var data []byte
+		entry := models.FlightHistoryEntry{}
+		if err := rows.Scan(&entry.FlightID, &entry.MessageType, &lastUpdate, &data); err != nil {
+			continue
+		}
+		var flight models.Flight
+		if err := xml.Unmarshal(data, &flight); err != nil {
+			continue
+		}
+		entry.Flight = &flight
+		entry.LastUpdate, _ = time.Parse(snapshotTimeLayout, lastUpdate)
+		repo.FlightHistory.Add(entry, maxVersions)
+	}
+	rows.Close()
+
+	var lower, upper string
+	if err := db.QueryRow("SELECT lower, upper FROM limits WHERE id = 0").Scan(&lower, &upper); err == nil {
+		l, _ := time.Parse(snapshotTimeLayout, lower)
+		u, _ := time.Parse(snapshotTimeLayout, upper)
+		repo.UpdateLowerLimit(l)
+		repo.UpdateUpperLimit(u)
+	}
+
+	globals.Logger.Info(fmt.Sprintf("Loaded %d flights for %s from the repository snapshot", numFlights, airportCode))
+
+	return numFlights > 0
+}
+
+// persistFlights writes the flights and their current allocations to the snapshot in a single transaction
+func persistFlights(airportCode string, flights []models.Flight) {
+
+	if !persistenceEnabled() {
+		return
+	}
+	db := getSnapshotDB(airportCode)
+	if db == nil {
+		return
+	}
+	// Take a copy of the allocations so the repository is not locked while writing to the database
+	repo := GetRepo(airportCode)
+	allocations := make(map[string]map[string][]models.AllocationItem)
+	repo.RLock()
+	for _, flight := range flights {
+		flightID := flight.GetFlightID()
+		allocations[flightID] = make(map[string][]models.AllocationItem)
+		for _, resourceType := range snapshotResourceTypes {
+			allocations[flightID][resourceType] = snapshotResourceList(repo, resourceType).FlightAllocations(flightID)
+		}
+	}
+	repo.RUnlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not begin transaction: %s", airportCode, err))
+		return
+	}
+	defer tx.Rollback() // The rollback will be ignored if the tx has been committed
+
+	for _, flight := range flights {
+		data, err := xml.Marshal(flight)
+		if err != nil {
+			globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not serialise flight %s: %s", airportCode, flight.GetFlightID(), err))
+			continue
+		}
+		flightID := flight.GetFlightID()
+
+		if _, err := tx.Exec("INSERT OR REPLACE INTO flights(flightid, sdo, lastupdate, xmlflight) VALUES(?, ?, ?, ?)",
+			flightID, flight.FlightId.ScheduledDate, flight.LastUpdate.Format(snapshotTimeLayout), data); err != nil {
+			globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not write flight %s: %s", airportCode, flightID, err))
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM allocations WHERE flightid = ?", flightID); err != nil {
+			globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not clear allocations for %s: %s", airportCode, flightID, err))
+			return
+		}
+		for _, resourceType := range snapshotResourceTypes {
+			for _, a := range allocations[flightID][resourceType] {
+				if _, err := tx.Exec(`INSERT INTO allocations(flightid, resourcetype, resourceid, fromtime, totime, direction, route, aircrafttype, aircraftregistration, lastupdate)
+					VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+					flightID, resourceType, a.ResourceID, a.From.Format(snapshotTimeLayout), a.To.Format(snapshotTimeLayout),
+					a.Direction, a.Route, a.AircraftType, a.AircraftRegistration, a.LastUpdate.Format(snapshotTimeLayout)); err != nil {
+					globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not write allocation for %s: %s", airportCode, flightID, err))
+					return
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not commit flights: %s", airportCode, err))
+	}
+}
+
+func persistFlight(airportCode string, flight models.Flight) {
+	persistFlights(airportCode, []models.Flight{flight})
+}
+
+// persistFlightDeletes removes the flights and their allocations from the snapshot
+func persistFlightDeletes(airportCode string, flightIDs []string) {
+
+	if !persistenceEnabled() || len(flightIDs) == 0 {
+		return
+	}
+	db := getSnapshotDB(airportCode)
+	if db == nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not begin transaction: %s", airportCode, err))
+		return
+	}
+	defer tx.Rollback()
+
+	for _, flightID := range flightIDs {
+		if _, err := tx.Exec("DELETE FROM flights WHERE flightid = ?", flightID); err != nil {
+			globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not delete flight %s: %s", airportCode, flightID, err))
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM allocations WHERE flightid = ?", flightID); err != nil {
+			globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not delete allocations for %s: %s", airportCode, flightID, err))
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not commit deletes: %s", airportCode, err))
+	}
+}
+
+func persistFlightDelete(airportCode string, flightID string) {
+	persistFlightDeletes(airportCode, []string{flightID})
+}
+
+// persistExpiredFlights removes the flights with a scheduled date of operation before "from" from the snapshot
+func persistExpiredFlights(airportCode string, from time.Time) {
+
+	if !persistenceEnabled() {
+		return
+	}
+	db := getSnapshotDB(airportCode)
+	if db == nil {
+		return
+	}
+
+	sdo := from.Format("2006-01-02")
+	if _, err := db.Exec("DELETE FROM allocations WHERE flightid IN (SELECT flightid FROM flights WHERE sdo < ?)", sdo); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not remove expired allocations: %s", airportCode, err))
+	}
+	if _, err := db.Exec("DELETE FROM flights WHERE sdo < ?", sdo); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not remove expired flights: %s", airportCode, err))
+	}
+	if _, err := db.Exec("DELETE FROM history WHERE sdo < ?", sdo); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not remove expired flight history: %s", airportCode, err))
+	}
+}
+
+// persistFlightHistory appends the entries to the flight history in the snapshot, keeping
+// only the most recent FlightHistoryMaxVersions versions of each flight
+func persistFlightHistory(airportCode string, entries []models.FlightHistoryEntry) {
+
+	if !persistenceEnabled() || len(entries) == 0 {
+		return
+	}
+	db := getSnapshotDB(airportCode)
+	if db == nil {
+		return
+	}
+	maxVersions := globals.ConfigViper.GetInt("FlightHistoryMaxVersions")
+
+	tx, err := db.Begin()
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not begin transaction: %s", airportCode, err))
+		return
+	}
+	defer tx.Rollback()
+
+	for _, entry := range entries {
+		data, err := xml.Marshal(entry.Flight)
+		if err != nil {
+			globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not serialise flight %s: %s", airportCode, entry.FlightID, err))
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO history(flightid, sdo, messagetype, lastupdate, xmlflight) VALUES(?, ?, ?, ?, ?)",
+			entry.FlightID, entry.Flight.FlightId.ScheduledDate, entry.MessageType, entry.LastUpdate.Format(snapshotTimeLayout), data); err != nil {
+			globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not write history for %s: %s", airportCode, entry.FlightID, err))
+			return
+		}
+		if maxVersions > 0 {
+			if _, err := tx.Exec("DELETE FROM history WHERE flightid = ? AND seq NOT IN (SELECT seq FROM history WHERE flightid = ? ORDER BY seq DESC LIMIT ?)",
+				entry.FlightID, entry.FlightID, maxVersions); err != nil {
+				globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not trim history for %s: %s", airportCode, entry.FlightID, err))
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not commit flight history: %s", airportCode, err))
+	}
+}
+
+// persistResources records the configured resources of the type
+func persistResources(airportCode string, resourceType string, resources []models.FixedResource) {
+
+	if !persistenceEnabled() || len(resources) == 0 {
+		return
+	}
+	db := getSnapshotDB(airportCode)
+	if db == nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not begin transaction: %s", airportCode, err))
+		return
+	}
+	defer tx.Rollback()
+
+	for _, res := range resources {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO resources(resourcetype, name, area, resourcetypecode) VALUES(?, ?, ?, ?)",
+			resourceType, res.Name, res.Area, res.ResourceTypeCode); err != nil {
+			globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not write resource %s: %s", airportCode, res.Name, err))
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not commit resources: %s", airportCode, err))
+	}
+}
+
+// persistLimits records the window of flights held in the repository
+func persistLimits(airportCode string, lower, upper time.Time) {
+
+	if !persistenceEnabled() {
+		return
+	}
+	db := getSnapshotDB(airportCode)
+	if db == nil {
+		return
+	}
+
+	if _, err := db.Exec("INSERT OR REPLACE INTO limits(id, lower, upper) VALUES(0, ?, ?)",
+		lower.Format(snapshotTimeLayout), upper.Format(snapshotTimeLayout)); err != nil {
+		globals.Logger.Error(fmt.Sprintf("Repository snapshot for %s: could not write limits: %s", airportCode, err))
+	}
+}
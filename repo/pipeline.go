@@ -0,0 +1,315 @@
+package repo
+
+/*
+
+The notification pipeline applies the notifications received by the listeners. Each notification is
+parsed by the listener that received it, routed by its flight to one of a fixed number of shards and
+applied by the worker of that shard, which then publishes the change to the event monitor.
+
+Notifications for the same flight always go to the same shard so they are applied in the order they
+are queued. Listeners that wait for each notification to be applied queue them in the order they were
+received. The RabbitMQ listener applies several messages at a time, so it waits only until each one
+has been queued, using withQueuedNotice, before taking the next. The queue of each shard is bounded.
+When it is full the listener waits, which holds back the broker consumer rather than queueing without
+limit
+
+*/
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/monitoring"
+	"flightresourcerestapi/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errUnknownNotification = errors.New("not a flight created, updated or deleted notification")
+
+// errPipelineStopped is returned for notifications that were not applied because the service is stopping
+var errPipelineStopped = errors.New("the service is stopping")
+
+// errWrongAirport is returned for notifications that are not for the airport they were sent to
+var errWrongAirport = errors.New("the notification is not for the airport")
+
+type notificationJob struct {
+	ctx      context.Context
+	kind     string
+	airport  string
+	flight   models.Flight
+	received time.Time
+	done     chan error
+}
+
+type notificationPipeline struct {
+	shards  []chan notificationJob
+	metrics pipelineMetrics
+}
+
+var pipeline *notificationPipeline
+var pipelineOnce sync.Once
+
+// getPipeline returns the pipeline, starting its workers on first use
+func getPipeline() *notificationPipeline {
+	pipelineOnce.Do(func() {
+		numShards := globals.ConfigViper.GetInt("NotificationPipelineShards")
+		if numShards < 1 {
+			numShards = 8
+		}
+		queueSize := globals.ConfigViper.GetInt("NotificationPipelineQueueSize")
+		if queueSize < 1 {
+			queueSize = 100
+		}
+
+		pipeline = &notificationPipeline{}
+		for i := 0; i < numShards; i++ {
+			shard := make(chan notificationJob, queueSize)
+			pipeline.shards = append(pipeline.shards, shard)
+			go pipeline.work(shard)
+		}
+
+		globals.Logger.Info(fmt.Sprintf("Started notification pipeline with %d shards of %d notifications", numShards, queueSize))
+	})
+	return pipeline
+}
+
+type queuedNoticeKey struct{}
+
+// withQueuedNotice returns a context that has queued closed once a notification dispatched with it
+// has been queued on its shard, or has failed without being queued
+func withQueuedNotice(ctx context.Context, queued chan struct{}) context.Context {
+	var once sync.Once
+	return context.WithValue(ctx, queuedNoticeKey{}, func() {
+		once.Do(func() { close(queued) })
+	})
+}
+
+// queuedNotice returns the function that signals the notification has been queued, if any
+func queuedNotice(ctx context.Context) func() {
+	if notice, ok := ctx.Value(queuedNoticeKey{}).(func()); ok {
+		return notice
+	}
+	return func() {}
+}
+
+type expectedAirportKey struct{}
+
+// withExpectedAirport returns a context that has the notifications dispatched with it rejected unless
+// their flight is at the airport
+func withExpectedAirport(ctx context.Context, airportCode string) context.Context {
+	return context.WithValue(ctx, expectedAirportKey{}, airportCode)
+}
+
+// dispatchNotification parses the notification and returns once it has been applied to the repository
+func dispatchNotification(ctx context.Context, message string) error {
+
+	queued := queuedNotice(ctx)
+	defer queued()
+
+	globals.Logger.Debug(fmt.Sprintf("Received Message length %d\n", len(message)))
+
+	job, err := parseNotification(message)
+	if err != nil {
+		kind := job.kind
+		if kind == "" {
+			kind = "unknown"
+		}
+		monitoring.NotificationsReceived.WithLabelValues("unknown", kind).Inc()
+		monitoring.NotificationsProcessed.WithLabelValues("unknown", kind, "failed").Inc()
+		return err
+	}
+	monitoring.NotificationsReceived.WithLabelValues(job.airport, job.kind).Inc()
+
+	if expected, ok := ctx.Value(expectedAirportKey{}).(string); ok && job.airport != expected {
+		monitoring.NotificationsProcessed.WithLabelValues(job.airport, job.kind, "failed").Inc()
+		return fmt.Errorf("%w: the flight is at %s, not %s", errWrongAirport, job.airport, expected)
+	}
+
+	// The changes are pushed after the listener has returned, so the trace must outlive its context
+	job.ctx = tracing.Detach(ctx)
+	return getPipeline().submit(job, queued)
+}
+
+func parseNotification(message string) (notificationJob, error) {
+
+	var job notificationJob
+	var err error
+
+	switch {
+	case strings.Contains(message, globals.FlightUpdatedMessage):
+		var envel models.FlightUpdatedNotificationEnvelope
+		err = xml.Unmarshal([]byte(message), &envel)
+		job = notificationJob{kind: globals.FlightUpdatedMessage, flight: envel.Content.FlightUpdatedNotification.Flight}
+	case strings.Contains(message, globals.FlightCreatedMessage):
+		var envel models.FlightCreatedNotificationEnvelope
+		err = xml.Unmarshal([]byte(message), &envel)
+		job = notificationJob{kind: globals.FlightCreatedMessage, flight: envel.Content.FlightCreatedNotification.Flight}
+	case strings.Contains(message, globals.FlightDeletedMessage):
+		var envel models.FlightDeletedNotificationEnvelope
+		err = xml.Unmarshal([]byte(message), &envel)
+		job = notificationJob{kind: globals.FlightDeletedMessage, flight: envel.Content.FlightDeletedNotification.Flight}
+	default:
+		return job, errUnknownNotification
+	}
+
+	if err != nil {
+		return job, fmt.Errorf("could not parse %s: %w", job.kind, err)
+	}
+
+	job.airport = job.flight.GetIATAAirport()
+	return job, nil
+}
+
+// submit queues the notification on the shard of its flight, waiting while the queue is full, calls
+// queued and waits for it to be applied
+func (p *notificationPipeline) submit(job notificationJob, queued func()) error {
+
+	job.received = time.Now()
+	job.done = make(chan error, 1)
+
+	h := fnv.New32a()
+	h.Write([]byte(job.airport + "/" + job.flight.GetFlightID()))
+	shard := p.shards[h.Sum32()%uint32(len(p.shards))]
+
+	select {
+	case shard <- job:
+	default:
+		p.metrics.saturated()
+		select {
+		case shard <- job:
+		case <-globals.Ctx.Done():
+			return errPipelineStopped
+		}
+	}
+	queued()
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-globals.DrainCtx.Done():
+		return errPipelineStopped
+	}
+}
+
+// work applies the notifications of the shard. Workers keep running while the service stops so
+// the notifications already accepted by the listeners are applied
+func (p *notificationPipeline) work(shard chan notificationJob) {
+
+	for job := range shard {
+
+		start := time.Now()
+
+		attributes := trace.WithAttributes(attribute.String("airport", job.airport), attribute.String("flight.id", job.flight.GetFlightID()))
+		_, queued := tracing.StartSpan(job.ctx, "notification.queue", attributes, trace.WithTimestamp(job.received))
+		queued.End(trace.WithTimestamp(start))
+
+		var err error
+		var span trace.Span
+		ctx := job.ctx
+		switch job.kind {
+		case globals.FlightUpdatedMessage:
+			ctx, span = tracing.StartSpan(ctx, "UpdateFlightEntry", attributes)
+			err = applyFlightUpdate(ctx, job.flight, false)
+		case globals.FlightCreatedMessage:
+			ctx, span = tracing.StartSpan(ctx, "CreateFlightEntry", attributes)
+			err = applyFlightCreate(ctx, job.flight)
+		case globals.FlightDeletedMessage:
+			ctx, span = tracing.StartSpan(ctx, "DeleteFlightEntry", attributes)
+			err = applyFlightDelete(ctx, job.flight)
+		}
+		tracing.End(span, err)
+
+		p.metrics.record(time.Since(job.received), time.Since(start))
+		result := "applied"
+		if err != nil {
+			result = "failed"
+		}
+		monitoring.NotificationsProcessed.WithLabelValues(job.airport, job.kind, result).Inc()
+		job.done <- err
+	}
+}
+
+// capacity is the number of notifications that can be queued across all the shards
+func (p *notificationPipeline) capacity() int {
+	return len(p.shards) * cap(p.shards[0])
+}
+
+// PipelineMetrics are the queue depths and processing times of the notification pipeline
+type PipelineMetrics struct {
+	Shards           int
+	QueueCapacity    int
+	QueueDepth       []int
+	Processed        int64
+	Saturated        int64
+	AverageLatencyMS float64
+	MaxLatencyMS     int64
+	AverageApplyMS   float64
+	MaxApplyMS       int64
+}
+
+type pipelineMetrics struct {
+	mu           sync.Mutex
+	processed    int64
+	saturations  int64
+	totalLatency time.Duration
+	maxLatency   time.Duration
+	totalApply   time.Duration
+	maxApply     time.Duration
+}
+
+func (m *pipelineMetrics) saturated() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.saturations++
+}
+
+func (m *pipelineMetrics) record(latency, apply time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.processed++
+	m.totalLatency += latency
+	m.totalApply += apply
+	if latency > m.maxLatency {
+		m.maxLatency = latency
+	}
+	if apply > m.maxApply {
+		m.maxApply = apply
+	}
+}
+
+// NotificationPipelineMetrics returns the metrics of the notification pipeline. Latency is measured
+// from the notification being received to it being applied, apply is the time taken by the worker
+func NotificationPipelineMetrics() PipelineMetrics {
+
+	p := getPipeline()
+
+	metrics := PipelineMetrics{Shards: len(p.shards), QueueCapacity: cap(p.shards[0])}
+	for _, shard := range p.shards {
+		metrics.QueueDepth = append(metrics.QueueDepth, len(shard))
+	}
+
+	p.metrics.mu.Lock()
+	defer p.metrics.mu.Unlock()
+
+	metrics.Processed = p.metrics.processed
+	metrics.Saturated = p.metrics.saturations
+	metrics.MaxLatencyMS = p.metrics.maxLatency.Milliseconds()
+	metrics.MaxApplyMS = p.metrics.maxApply.Milliseconds()
+	if p.metrics.processed > 0 {
+		metrics.AverageLatencyMS = float64(p.metrics.totalLatency.Microseconds()) / float64(p.metrics.processed) / 1000
+		metrics.AverageApplyMS = float64(p.metrics.totalApply.Microseconds()) / float64(p.metrics.processed) / 1000
+	}
+
+	return metrics
+}
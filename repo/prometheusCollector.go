@@ -0,0 +1,118 @@
+package repo
+
+import (
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/monitoring"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// repositoryCollector reports the state of the repositories, the notification pipeline, the change
+// push outbox and the change streams when the Prometheus metrics are scraped
+type repositoryCollector struct {
+	flights               *prometheus.Desc
+	resources             *prometheus.Desc
+	allocations           *prometheus.Desc
+	staleUpdatesDropped   *prometheus.Desc
+	staleDeletesDropped   *prometheus.Desc
+	windowLowerLimit      *prometheus.Desc
+	windowUpperLimit      *prometheus.Desc
+	pipelineQueueDepth    *prometheus.Desc
+	pipelineQueueCapacity *prometheus.Desc
+	pipelineSaturated     *prometheus.Desc
+	changePushPending     *prometheus.Desc
+	streamClients         *prometheus.Desc
+}
+
+func init() {
+	monitoring.Register(newRepositoryCollector())
+}
+
+func newRepositoryCollector() *repositoryCollector {
+	return &repositoryCollector{
+		flights:               prometheus.NewDesc("frapi_repository_flights", "Flights in the repository of the airport", []string{"airport"}, nil),
+		resources:             prometheus.NewDesc("frapi_repository_resources", "Fixed resources in the repository of the airport by type", []string{"airport", "type"}, nil),
+		allocations:           prometheus.NewDesc("frapi_repository_allocations", "Flight allocations of the fixed resources of the airport by type", []string{"airport", "type"}, nil),
+		staleUpdatesDropped:   prometheus.NewDesc("frapi_repository_stale_updates_dropped_total", "Flight updates dropped because they were older than the flight in the repository", []string{"airport"}, nil),
+		staleDeletesDropped:   prometheus.NewDesc("frapi_repository_stale_deletes_dropped_total", "Flight deletes dropped because they were older than the flight in the repository", []string{"airport"}, nil),
+		windowLowerLimit:      prometheus.NewDesc("frapi_repository_window_lower_limit_seconds", "Start of the window of flights held in the repository as a Unix time", []string{"airport"}, nil),
+		windowUpperLimit:      prometheus.NewDesc("frapi_repository_window_upper_limit_seconds", "End of the window of flights held in the repository as a Unix time", []string{"airport"}, nil),
+		pipelineQueueDepth:    prometheus.NewDesc("frapi_notification_pipeline_queue_depth", "Notifications waiting to be applied across the shards of the pipeline", nil, nil),
+		pipelineQueueCapacity: prometheus.NewDesc("frapi_notification_pipeline_queue_capacity", "Notifications that can be queued across the shards of the pipeline", nil, nil),
+		pipelineSaturated:     prometheus.NewDesc("frapi_notification_pipeline_saturated_total", "Notifications that waited because the queue of their shard was full", nil, nil),
+		changePushPending:     prometheus.NewDesc("frapi_change_push_queue_depth", "Change pushes in the outbox waiting to be delivered by destination host", []string{"destination"}, nil),
+		streamClients:         prometheus.NewDesc("frapi_change_stream_clients", "Clients connected to the change stream of the airport", []string{"airport"}, nil),
+	}
+}
+
+func (rc *repositoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rc.flights
+	ch <- rc.resources
+	ch <- rc.allocations
+	ch <- rc.staleUpdatesDropped
+	ch <- rc.staleDeletesDropped
+	ch <- rc.windowLowerLimit
+	ch <- rc.windowUpperLimit
+	ch <- rc.pipelineQueueDepth
+	ch <- rc.pipelineQueueCapacity
+	ch <- rc.pipelineSaturated
+	ch <- rc.changePushPending
+	ch <- rc.streamClients
+}
+
+func (rc *repositoryCollector) Collect(ch chan<- prometheus.Metric) {
+
+	globals.RepoListMutex.RLock()
+	repos := append([]*models.Repository{}, globals.RepoList...)
+	globals.RepoListMutex.RUnlock()
+
+	for _, r := range repos {
+		apt := r.AMSAirport
+
+		r.RLock()
+		ch <- prometheus.MustNewConstMetric(rc.flights, prometheus.GaugeValue, float64(r.FlightList.Len()), apt)
+		for _, list := range []struct {
+			resourceType string
+			list         *models.ResourceIndexedList
+		}{
+			{"checkin", &r.CheckInList},
+			{"gate", &r.GateList},
+			{"stand", &r.StandList},
+			{"carousel", &r.CarouselList},
+			{"chute", &r.ChuteList},
+		} {
+			ch <- prometheus.MustNewConstMetric(rc.resources, prometheus.GaugeValue, float64(list.list.Len()), apt, list.resourceType)
+			ch <- prometheus.MustNewConstMetric(rc.allocations, prometheus.GaugeValue, float64(list.list.NumberOfFlightAllocations()), apt, list.resourceType)
+		}
+		if !r.CurrentLowerLimit.IsZero() {
+			ch <- prometheus.MustNewConstMetric(rc.windowLowerLimit, prometheus.GaugeValue, float64(r.CurrentLowerLimit.Unix()), apt)
+		}
+		if !r.CurrentUpperLimit.IsZero() {
+			ch <- prometheus.MustNewConstMetric(rc.windowUpperLimit, prometheus.GaugeValue, float64(r.CurrentUpperLimit.Unix()), apt)
+		}
+		r.RUnlock()
+
+		ch <- prometheus.MustNewConstMetric(rc.staleUpdatesDropped, prometheus.CounterValue, float64(r.StaleUpdatesDropped()), apt)
+		ch <- prometheus.MustNewConstMetric(rc.staleDeletesDropped, prometheus.CounterValue, float64(r.StaleDeletesDropped()), apt)
+		ch <- prometheus.MustNewConstMetric(rc.streamClients, prometheus.GaugeValue, float64(ChangeStreamMetrics(apt).Clients), apt)
+	}
+
+	pipelineMetrics := NotificationPipelineMetrics()
+	depth := 0
+	for _, n := range pipelineMetrics.QueueDepth {
+		depth += n
+	}
+	ch <- prometheus.MustNewConstMetric(rc.pipelineQueueDepth, prometheus.GaugeValue, float64(depth))
+	ch <- prometheus.MustNewConstMetric(rc.pipelineQueueCapacity, prometheus.GaugeValue, float64(pipelineMetrics.Shards*pipelineMetrics.QueueCapacity))
+	ch <- prometheus.MustNewConstMetric(rc.pipelineSaturated, prometheus.CounterValue, float64(pipelineMetrics.Saturated))
+
+	// Destinations with different paths on the same host are reported together
+	pending := map[string]int{}
+	for destination, m := range ChangePushOutboxMetrics() {
+		pending[monitoring.Destination(destination)] += m.Pending
+	}
+	for destination, n := range pending {
+		ch <- prometheus.MustNewConstMetric(rc.changePushPending, prometheus.GaugeValue, float64(n), destination)
+	}
+}
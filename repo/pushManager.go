@@ -2,28 +2,38 @@ package repo
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"os"
 
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-co-op/gocron"
 
 	"flightresourcerestapi/globals"
 	"flightresourcerestapi/models"
+	"flightresourcerestapi/monitoring"
+	"flightresourcerestapi/signing"
 	"flightresourcerestapi/timeservice"
+	"flightresourcerestapi/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Channels for handling the push notifications
+// Channel for handling the scheduled push notifications
 // The size of the channel is the number of elements the channel can
 // buffer without blocking
-var changePushJobChannel = make(chan models.ChangePushJob, 20)
 var schedulePushJobChannel = make(chan models.SchedulePushJob, 20)
 
+// The number of scheduled push workers running
+var scheduledPushWorkers int32
+
 // func ReloadschedulePushes(airportCode string) {
 // 	if _, ok := globals.SchedulerMap[airportCode]; ok {
 // 		globals.SchedulerMap[airportCode].Clear()
@@ -32,95 +42,168 @@ var schedulePushJobChannel = make(chan models.SchedulePushJob, 20)
 // 	go SchedulePushes(airportCode, false)
 // }
 
-func StartChangePushWorkerPool(numWorkers int) {
-	for w := 1; w <= numWorkers; w++ {
-		go executeChangePushWorker(w, changePushJobChannel)
-	}
-}
+var schedulePushPoolOnce sync.Once
+
+// StartSchedulePushWorkerPool starts the scheduled push workers. Only the first call starts them, so
+// the pool is shared by every airport
 func StartSchedulePushWorkerPool(numWorkers int) {
-	for w := 1; w <= numWorkers; w++ {
-		go executeScheduledPushWorker(w, schedulePushJobChannel)
-	}
+	schedulePushPoolOnce.Do(func() {
+		// The workers are registered with the shutdown wait group so none are started once stopping
+		if globals.Ctx.Err() != nil {
+			return
+		}
+		for w := 1; w <= numWorkers; w++ {
+			globals.ShutdownWg.Add(1)
+			go executeScheduledPushWorker(w, schedulePushJobChannel)
+		}
+	})
 }
 
+// The demo mode each airport's pushes were scheduled in, guarded by pushSchedulersMutex with globals.SchedulerMap
+var pushSchedulerDemoMode = make(map[string]bool)
+var pushSchedulersMutex = &sync.Mutex{}
+
 func SchedulePushes(airportCode string, demoMode bool) {
 
 	StartChangePushWorkerPool(globals.ConfigViper.GetInt("NumberOfChangePushWorkers"))
 	StartSchedulePushWorkerPool(globals.ConfigViper.GetInt("NumberOfSchedulePushWorkers"))
 
-	today := time.Now().Format("2006-01-02")
 	s := gocron.NewScheduler(time.Local)
 
+	pushSchedulersMutex.Lock()
 	globals.SchedulerMap[airportCode] = s
+	pushSchedulerDemoMode[airportCode] = demoMode
+	schedulePushJobs(s, airportCode, demoMode, true)
+	pushSchedulersMutex.Unlock()
+
+	runScheduler(s)
+}
+
+// ReschedulePushes replaces the scheduled pushes of the airport with those of the current push subscriptions.
+// Airports whose pushes have not been scheduled yet are left to SchedulePushes
+func ReschedulePushes(airportCode string) {
 
-	for _, u := range globals.GetUserProfiles() {
+	pushSchedulersMutex.Lock()
+	defer pushSchedulersMutex.Unlock()
+
+	s := globals.SchedulerMap[airportCode]
+	if s == nil {
+		return
+	}
+	s.Clear()
+	schedulePushJobs(s, airportCode, pushSchedulerDemoMode[airportCode], false)
+
+	globals.Logger.Info(fmt.Sprintf("Scheduled Pushes for %s rescheduled", airportCode))
+}
+
+// schedulePushJobs adds a job to the scheduler for each push subscription of the airport. The pushes
+// with PushOnStartUp are also queued if the service is starting
+func schedulePushJobs(s *gocron.Scheduler, airportCode string, demoMode bool, startUp bool) {
+
+	today := time.Now().Format("2006-01-02")
+
+	for _, u := range userProfilesWithSubscriptions() {
 
 		if !u.Enabled {
 			continue
 		}
+		u := u
 
 		for _, sub := range u.UserPushSubscriptions {
 			if sub.Airport != airportCode || !sub.Enabled || (demoMode && !sub.EnableInDemoMode) {
 				continue
 			}
+			sub := sub
 
 			startTimeStr := today + "T" + sub.Time
 			startTime, _ := time.ParseInLocation("2006-01-02T15:04:05", startTimeStr, timeservice.Loc)
 			user := u.UserName
-			token := u.Key
+
+			// Jobs are stopped by the user name
+			tags := []string{user}
 
 			if sub.ReptitionHours != 0 {
-				s.Every(sub.ReptitionHours).Hours().StartAt(startTime).Tag(token).Do(func() {
-					schedulePushJobChannel <- models.SchedulePushJob{Sub: sub, UserToken: token, UserName: user, UserProfile: &u}
+				s.Every(sub.ReptitionHours).Hours().StartAt(startTime).Tag(tags...).Do(func() {
+					queueScheduledPush(models.SchedulePushJob{Sub: sub, UserName: user, UserProfile: &u})
 				})
 				globals.Logger.Info(fmt.Sprintf("Scheduled Push for user %s, starting from %s, repeating every %v hours", u.UserName, startTimeStr, sub.ReptitionHours))
 			}
 			if sub.ReptitionMinutes != 0 {
-				s.Every(sub.ReptitionMinutes).Minutes().StartAt(time.Now()).Tag(token).Do(func() {
-					schedulePushJobChannel <- models.SchedulePushJob{Sub: sub, UserToken: token, UserName: user, UserProfile: &u}
+				s.Every(sub.ReptitionMinutes).Minutes().StartAt(time.Now()).Tag(tags...).Do(func() {
+					queueScheduledPush(models.SchedulePushJob{Sub: sub, UserName: user, UserProfile: &u})
 				})
 				globals.Logger.Info(fmt.Sprintf("Scheduled Push for user %s, starting from now, repeating every %v minutes", u.UserName, sub.ReptitionMinutes))
 
 			}
 
-			if sub.PushOnStartUp {
-				schedulePushJobChannel <- models.SchedulePushJob{Sub: sub, UserToken: token, UserName: user, UserProfile: &u}
+			if startUp && sub.PushOnStartUp {
+				queueScheduledPush(models.SchedulePushJob{Sub: sub, UserName: user, UserProfile: &u})
 			}
 		}
 	}
+}
 
-	s.StartBlocking()
+// queueScheduledPush queues the push for the workers. Nothing is queued once the service is stopping
+func queueScheduledPush(job models.SchedulePushJob) {
+	select {
+	case schedulePushJobChannel <- job:
+	case <-globals.Ctx.Done():
+	}
 }
 
 func HandleFlightUpdate(mess models.FlightUpdateChannelMessage) {
+	ctx, span := tracing.StartSpan(mess.Ctx, "eventMonitor", trace.WithAttributes(attribute.String("event", globals.FlightUpdatedMessage), attribute.String("flight.id", mess.FlightID)))
+	defer span.End()
+
+	mess.Ctx = ctx
 	checkForImpactedSubscription(mess)
+	publishFlightChange(globals.FlightUpdatedMessage, mess)
 	return
 }
 
 func HandleFlightCreate(mess models.FlightUpdateChannelMessage) {
+	ctx, span := tracing.StartSpan(mess.Ctx, "eventMonitor", trace.WithAttributes(attribute.String("event", globals.FlightCreatedMessage), attribute.String("flight.id", mess.FlightID)))
+	defer span.End()
+
+	mess.Ctx = ctx
 	checkForImpactedSubscription(mess)
+	publishFlightChange(globals.FlightCreatedMessage, mess)
 	return
 }
 
-func HandleFlightDelete(flt models.Flight) {
-	checkForImpactedDeleteSubscription(flt)
+func HandleFlightDelete(mess models.FlightDeleteChannelMessage) {
+	ctx, span := tracing.StartSpan(mess.Ctx, "eventMonitor", trace.WithAttributes(attribute.String("event", globals.FlightDeletedMessage), attribute.String("flight.id", mess.Flight.GetFlightID())))
+	defer span.End()
+
+	checkForImpactedDeleteSubscription(ctx, mess.Flight)
+	publishChangeStreamEvent(globals.FlightDeletedMessage, &mess.Flight)
 	return
 }
 
+// Changes to flights scheduled more than 36 hours ahead are not pushed or streamed
+func withinChangeHorizon(flt *models.Flight) bool {
+	return !flt.GetSTO().Local().After(time.Now().Local().Add(36 * time.Hour))
+}
+
 // Check if any of the registered change subscriptions are interested in this change
 func checkForImpactedSubscription(mess models.FlightUpdateChannelMessage) {
 
+	ctx, span := tracing.StartSpan(mess.Ctx, "checkForImpactedSubscription")
+	defer span.End()
+
 	flt := GetRepo(mess.AirportCode).GetFlight(mess.FlightID)
-	sto := flt.GetSTO()
+	if flt == nil {
+		// Deleted before the change could be processed
+		return
+	}
 
-	if sto.Local().After(time.Now().Local().Add(36 * time.Hour)) {
+	if !withinChangeHorizon(flt) {
 		return
 	}
 
 	globals.UserChangeSubscriptionsMutex.Lock()
 	defer globals.UserChangeSubscriptionsMutex.Unlock()
 
-NextSub:
 	for _, sub := range globals.UserChangeSubscriptions {
 
 		if !sub.Enabled {
@@ -129,91 +212,19 @@ NextSub:
 		if sub.Airport != (*flt).GetIATAAirport() {
 			continue
 		}
-
-		if !sub.UpdateFlight && (*flt).Action == globals.UpdateAction {
-			continue
-		}
-		if sub.All {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue NextSub
-		}
-		if sub.CreateFlight && (*flt).Action == globals.CreateAction {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue NextSub
-		}
-		if !sub.DeleteFlight && (*flt).Action == globals.DeleteAction {
-			continue
-		}
-
-		if sub.DeleteFlight && (*flt).Action == globals.DeleteAction {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue NextSub
-		}
-		if sub.CreateFlight && (*flt).Action == globals.CreateAction {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue NextSub
-		}
-		if !sub.UpdateFlight && (*flt).Action == globals.UpdateAction {
-			continue
-		}
-		// Required Parameter Field Changes
-		for _, change := range (*flt).FlightChanges.Changes {
-
-			if globals.Contains(sub.ParameterChange, change.PropertyName) {
-				changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-				continue NextSub
-			}
-
-			if (change.PropertyName == "Stand" && sub.StandChange) ||
-				(change.PropertyName == "Gate" && sub.GateChange) ||
-				(change.PropertyName == "CheckInCounters" && sub.CheckInChange) ||
-				(change.PropertyName == "Carousel" && sub.CarouselChange) ||
-				(change.PropertyName == "Chute" && sub.ChuteChange) {
-
-				changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-				continue NextSub
-			}
-
-		}
-
-		if sub.CheckInChange && (*flt).FlightChanges.CheckinSlotsChange != nil {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue
-		}
-		if sub.GateChange && (*flt).FlightChanges.GateSlotsChange != nil {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue
-		}
-		if sub.StandChange && (*flt).FlightChanges.StandSlotsChange != nil {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue
-		}
-		if sub.ChuteChange && (*flt).FlightChanges.ChuteSlotsChange != nil {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue
-		}
-		if sub.CarouselChange && (*flt).FlightChanges.CarouselSlotsChange != nil {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue
-		}
-
-		if sub.AircraftTypeOrRegoChange && (*flt).FlightChanges.AircraftTypeChange != nil {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue
-		}
-		if sub.AircraftTypeOrRegoChange && (*flt).FlightChanges.AircraftChange != nil {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: flt}
-			continue
+		if changeSubscriptionMatches(sub, flt) {
+			queueChangePush(models.ChangePushJob{Sub: sub, Flight: flt, Ctx: ctx})
 		}
 	}
 
 	return
 }
-func checkForImpactedDeleteSubscription(flt models.Flight) {
+func checkForImpactedDeleteSubscription(ctx context.Context, flt models.Flight) {
 
-	sto := flt.GetSTO()
+	ctx, span := tracing.StartSpan(ctx, "checkForImpactedSubscription")
+	defer span.End()
 
-	if sto.Local().After(time.Now().Local().Add(36 * time.Hour)) {
+	if !withinChangeHorizon(&flt) {
 		return
 	}
 
@@ -228,83 +239,117 @@ func checkForImpactedDeleteSubscription(flt models.Flight) {
 		if sub.Airport != flt.GetIATAAirport() {
 			continue
 		}
-
-		if sub.DeleteFlight && flt.Action == globals.DeleteAction {
-			changePushJobChannel <- models.ChangePushJob{Sub: sub, Flight: &flt}
+		if changeSubscriptionMatches(sub, &flt) {
+			queueChangePush(models.ChangePushJob{Sub: sub, Flight: &flt, Ctx: ctx})
 		}
 	}
 
 	return
 }
 
-func executeChangePushWorker(id int, jobs <-chan models.ChangePushJob) {
+// changeSubscriptionMatches reports whether the subscription is interested in the change to the flight.
+// It is used for both the change pushes and the change streams
+func changeSubscriptionMatches(sub models.UserChangeSubscription, flt *models.Flight) bool {
 
-	for job := range jobs {
-		globals.Logger.Debug(fmt.Sprintf("Push Worker: %d Executing Change Push for User ", id))
+	if (*flt).Action == globals.DeleteAction {
+		return sub.DeleteFlight
+	}
 
-		queryBody, _ := json.Marshal(*job.Flight)
-		bodyReader := bytes.NewReader([]byte(queryBody))
+	if !sub.UpdateFlight && (*flt).Action == globals.UpdateAction {
+		return false
+	}
+	if sub.All {
+		return true
+	}
+	if sub.CreateFlight && (*flt).Action == globals.CreateAction {
+		return true
+	}
 
-		req, err := http.NewRequest(http.MethodPost, job.Sub.DestinationURL, bodyReader)
-		if err != nil {
-			globals.Logger.Error(fmt.Sprintf("Change Push Client: could not create change request: %s\n", err))
-		}
+	// Required Parameter Field Changes
+	for _, change := range (*flt).FlightChanges.Changes {
 
-		req.Header.Set("Content-Type", "application/json")
-		for _, pair := range job.Sub.HeaderParameters {
-			req.Header.Add(pair.Parameter, pair.Value)
+		if globals.Contains(sub.ParameterChange, change.PropertyName) {
+			return true
 		}
 
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: job.Sub.TrustBadCertificates},
-		}
-		client := http.Client{
-			Timeout:   20 * time.Second,
-			Transport: tr,
-		}
-		r, sendErr := client.Do(req)
-		if sendErr != nil {
-			globals.Logger.Error(fmt.Sprintf("Change Push Client. Error making http request: %s", sendErr))
-			return
-		}
-		if r == nil {
-			globals.Logger.Error(fmt.Sprintf("Scheduled Push Client for user: Error making http request to: %s\n", job.Sub.DestinationURL))
-			return
-		}
-		if r.StatusCode != 200 {
-			globals.Logger.Error(fmt.Sprintf("Change Push Client. Error making HTTP request: Returned status code = %v. URL = %s", r.StatusCode, job.Sub.DestinationURL))
-			return
+		if (change.PropertyName == "Stand" && sub.StandChange) ||
+			(change.PropertyName == "Gate" && sub.GateChange) ||
+			(change.PropertyName == "CheckInCounters" && sub.CheckInChange) ||
+			(change.PropertyName == "Carousel" && sub.CarouselChange) ||
+			(change.PropertyName == "Chute" && sub.ChuteChange) {
+			return true
 		}
 	}
+
+	if sub.CheckInChange && (*flt).FlightChanges.CheckinSlotsChange != nil {
+		return true
+	}
+	if sub.GateChange && (*flt).FlightChanges.GateSlotsChange != nil {
+		return true
+	}
+	if sub.StandChange && (*flt).FlightChanges.StandSlotsChange != nil {
+		return true
+	}
+	if sub.ChuteChange && (*flt).FlightChanges.ChuteSlotsChange != nil {
+		return true
+	}
+	if sub.CarouselChange && (*flt).FlightChanges.CarouselSlotsChange != nil {
+		return true
+	}
+	if sub.AircraftTypeOrRegoChange && (*flt).FlightChanges.AircraftTypeChange != nil {
+		return true
+	}
+	if sub.AircraftTypeOrRegoChange && (*flt).FlightChanges.AircraftChange != nil {
+		return true
+	}
+
+	return false
 }
 
+// executeScheduledPushWorker sends the scheduled pushes until the service is stopped.
+// Scheduled pushes still queued when the service is stopped are not sent
 func executeScheduledPushWorker(id int, jobs <-chan models.SchedulePushJob) {
 
-	for job := range jobs {
+	defer globals.ShutdownWg.Done()
+
+	atomic.AddInt32(&scheduledPushWorkers, 1)
+	defer atomic.AddInt32(&scheduledPushWorkers, -1)
 
-		globals.Logger.Info(fmt.Sprintf("Executing Scheduled Push for User %s", job.UserName))
+	for {
+		select {
+		case job := <-jobs:
+			executeScheduledPush(job)
+		case <-globals.Ctx.Done():
+			globals.Logger.Debug(fmt.Sprintf("Scheduled Push Worker: %d Stopped", id))
+			return
+		}
+	}
+}
 
-		if strings.ToLower(job.Sub.SubscriptionType) == "flight" {
+func executeScheduledPush(job models.SchedulePushJob) {
 
-			flightresponse, _ := GetRequestedFlightsSub(job.Sub, job.UserToken)
-			fileName, _ := writeFlightResponseToFile(flightresponse, job.UserProfile)
+	globals.Logger.Info(fmt.Sprintf("Executing Scheduled Push for User %s", job.UserName))
 
-			defer func() {
-				globals.FileDeleteChannel <- fileName
-			}()
+	if strings.ToLower(job.Sub.SubscriptionType) == "flight" {
 
-			sendViaHTTPClient(fileName, &job)
+		flightresponse, _ := GetRequestedFlightsSub(job.Sub, job.UserProfile)
+		fileName, _ := writeFlightResponseToFile(flightresponse, job.UserProfile)
 
-		} else if strings.ToLower(job.Sub.SubscriptionType) == "resource" {
-			resourceresponse, _ := GetResourceSub(job.Sub, job.UserToken)
-			fileName, _ := writeResourceResponseToFile(resourceresponse, job.UserProfile)
+		defer func() {
+			globals.FileDeleteChannel <- fileName
+		}()
 
-			defer func() {
-				globals.FileDeleteChannel <- fileName
-			}()
+		sendViaHTTPClient(fileName, &job)
 
-			sendViaHTTPClient(fileName, &job)
-		}
+	} else if strings.ToLower(job.Sub.SubscriptionType) == "resource" {
+		resourceresponse, _ := GetResourceSub(job.Sub, job.UserProfile)
+		fileName, _ := writeResourceResponseToFile(resourceresponse, job.UserProfile)
+
+		defer func() {
+			globals.FileDeleteChannel <- fileName
+		}()
+
+		sendViaHTTPClient(fileName, &job)
 	}
 }
 
@@ -321,9 +366,10 @@ func sendViaHTTPClient(fileName string, job *models.SchedulePushJob) {
 		}
 	}()
 
-	req, err := http.NewRequest(http.MethodPost, job.Sub.DestinationURL, bytes.NewReader(bytesdata))
+	req, err := http.NewRequestWithContext(globals.DrainCtx, http.MethodPost, job.Sub.DestinationURL, bytes.NewReader(bytesdata))
 	if err != nil {
 		globals.Logger.Error(fmt.Sprintf("Scheduled Push Client for user %s: could not create request: %s\n", job.UserName, err))
+		return
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -331,14 +377,28 @@ func sendViaHTTPClient(fileName string, job *models.SchedulePushJob) {
 		req.Header.Add(pair.Parameter, pair.Value)
 	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: job.Sub.TrustBadCertificates},
+	ctx, span := tracing.StartSpan(context.Background(), "scheduled push", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", http.MethodPost), attribute.String("server.address", monitoring.Destination(job.Sub.DestinationURL)), attribute.String("user", job.UserName)))
+	defer span.End()
+	tracing.Inject(ctx, req.Header)
+	signing.SignRequest(req, job.Sub.SigningSecret, signing.NewDeliveryID(), bytesdata)
+
+	r, sendErr := destinationClient(job.Sub.TrustBadCertificates, job.Sub.SubscriptionID != 0).Do(req)
+
+	result := "success"
+	if sendErr != nil || r == nil || r.StatusCode != 200 {
+		result = "failure"
 	}
-	client := http.Client{
-		Timeout:   20 * time.Second,
-		Transport: tr,
+	monitoring.ScheduledPushes.WithLabelValues(monitoring.Destination(job.Sub.DestinationURL), result).Inc()
+	if sendErr != nil {
+		span.RecordError(sendErr)
+		span.SetStatus(codes.Error, sendErr.Error())
+	} else if r != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", r.StatusCode))
+		if r.StatusCode != 200 {
+			span.SetStatus(codes.Error, r.Status)
+		}
 	}
-	r, sendErr := client.Do(req)
 
 	if sendErr != nil {
 		globals.Logger.Error(fmt.Sprintf("Scheduled Push Client for user %s: Error making http request: %s\n", job.UserName, sendErr))
@@ -9,63 +9,45 @@ updates and the refresh of the repository is scheduled
 */
 
 import (
-	"bytes"
-	//	"database/sql"
-	"encoding/xml"
+	"context"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"strings"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/go-co-op/gocron"
-	"github.com/jandauz/go-msmq"
 
 	"flightresourcerestapi/globals"
 	"flightresourcerestapi/models"
 	"flightresourcerestapi/timeservice"
-
-	//	_ "github.com/mattn/go-sqlite3"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-const xmlGetFlightsTemplateBody = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:ams6="http://www.sita.aero/ams6-xml-api-webservice">
-<soapenv:Header/>
-<soapenv:Body>
-   <ams6:GetFlights>
-	  <!--Optional:-->
-	  <ams6:sessionToken>%s</ams6:sessionToken>
-	  <!--Optional:-->
-	  <ams6:from>%sT00:00:00</ams6:from>
-	  <!--Optional:-->
-	  <ams6:to>%sT00:00:00</ams6:to> 
-	  <!--Optional:-->
-	  <ams6:airport>%s</ams6:airport>
-	  <!--Optional:-->
-   </ams6:GetFlights>
-</soapenv:Body>
-</soapenv:Envelope>`
-
-const testNativeAPIMessage = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:ams6="http://www.sita.aero/ams6-xml-api-webservice">
-<soapenv:Header/>
-<soapenv:Body>
-   <ams6:GetAirports>
-	  <!--Optional:-->
-	  <ams6:sessionToken>%sf</ams6:sessionToken>
-   </ams6:GetAirports>
-</soapenv:Body>
-</soapenv:Envelope>`
-
 func GetRepo(airportCode string) *models.Repository {
-	for idx, repo := range globals.RepoList {
+	globals.RepoListMutex.RLock()
+	defer globals.RepoListMutex.RUnlock()
+
+	for _, repo := range globals.RepoList {
 		if repo.AMSAirport == airportCode {
-			return &globals.RepoList[idx]
+			return repo
 		}
 	}
 	return nil
 }
 
+// addRepo adds the repository to the global list, replacing any existing repository for the same airport
+func addRepo(repo *models.Repository) {
+	globals.RepoListMutex.Lock()
+	defer globals.RepoListMutex.Unlock()
+
+	for idx, r := range globals.RepoList {
+		if r.AMSAirport == repo.AMSAirport {
+			globals.RepoList[idx] = repo
+			return
+		}
+	}
+	globals.RepoList = append(globals.RepoList, repo)
+}
+
 func InitRepositories() {
 
 	// Load the configuration from the airports.json config
@@ -76,10 +58,30 @@ func InitRepositories() {
 	}
 
 	// Add each airport to the global list and then initialise it
-	for _, v := range repos.Repositories {
-		globals.RepoList = append(globals.RepoList, v)
-		go initRepository(v.AMSAirport)
+	wg := sync.WaitGroup{}
+	for idx := range repos.Repositories {
+		addRepo(&repos.Repositories[idx])
+		wg.Add(1)
+		go func(airportCode string) {
+			defer wg.Done()
+			initRepository(airportCode)
+		}(repos.Repositories[idx].AMSAirport)
 	}
+
+	go func() {
+		wg.Wait()
+		close(repositoriesReady)
+	}()
+
+	go monitorAMSHealth()
+}
+
+// Closed once every airport has completed the first load of its repository
+var repositoriesReady = make(chan struct{})
+
+// RepositoriesReady returns a channel that is closed once every airport has completed the first load of its repository
+func RepositoriesReady() <-chan struct{} {
+	return repositoriesReady
 }
 
 func ReInitAirport(aptCode string) {
@@ -88,12 +90,13 @@ func ReInitAirport(aptCode string) {
 	globals.AirportsViper.ReadInConfig()
 	globals.AirportsViper.Unmarshal(&repos)
 
-	for _, v := range repos.Repositories {
-		if v.AMSAirport != aptCode {
+	for idx := range repos.Repositories {
+		if repos.Repositories[idx].AMSAirport != aptCode {
 			continue
 		}
-		globals.RepoList = append(globals.RepoList, v)
+		addRepo(&repos.Repositories[idx])
 	}
+	resetAMSClient(aptCode)
 
 	s := globals.RefreshSchedulerMap[aptCode]
 	if s != nil {
@@ -107,32 +110,32 @@ func initRepository(airportCode string) {
 
 	defer globals.ExeTime(fmt.Sprintf("Initialising Repository for %s", airportCode))()
 
+	startInitialLoad(airportCode)
+
+	// Load the last known state of the repository from the local snapshot so the API can respond
+	// straight away. The content is marked as stale until it has been reconciled with AMS
+	if persistenceEnabled() {
+		if loadRepositorySnapshot(airportCode) {
+			GetRepo(airportCode).SetSnapshotStale(true)
+		}
+	}
+
 	//Make sure the required services are available and loop until they are.
 	//This may occur if this service starts before AMS
-	for !testNativeAPIConnectivity(airportCode) || !testRestAPIConnectivity(airportCode) {
+	for !testNativeAPIConnectivity(globals.Ctx, airportCode) || !testRestAPIConnectivity(globals.Ctx, airportCode) {
 		globals.Logger.Warn(fmt.Sprintf("AMS Webservice API or AMS RestAPI not avaiable for %s. Will try again in 8 seconds", airportCode))
-		time.Sleep(8 * time.Second)
+		select {
+		case <-time.After(8 * time.Second):
+		case <-globals.Ctx.Done():
+			return
+		}
 	}
 
-	// db, err := sql.Open("sqlite3", airportCode+".db")
-	// defer db.Close()
-
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// sts := `
-	// DROP TABLE IF EXISTS flights;
-	// CREATE TABLE flights(id INTEGER PRIMARY KEY, flightid TEXT, jsonflight TEXT);
-	// `
-	// _, err = db.Exec(sts)
-
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-
 	//Clear the MSMQ notifiaction queue if using MSMQ
 	clearMSMQ(airportCode)
 
+	setLoadState(airportCode, LoadLoadingResources)
+
 	// Get the resources from the RestAPI Server
 	populateResourceMaps(airportCode)
 
@@ -148,57 +151,22 @@ func populateResourceMaps(airportCode string) {
 
 	repo := GetRepo(airportCode)
 	globals.Logger.Info(fmt.Sprintf("Populating Resource Maps for %s", airportCode))
-	// Retrieve the available resources
-
-	var checkIns models.FixedResources
-	xml.Unmarshal(getResource(airportCode, "CheckIns"), &checkIns)
-	(*repo).CheckInList.AddNodes(checkIns.Values)
-
-	var stands models.FixedResources
-	xml.Unmarshal(getResource(airportCode, "Stands"), &stands)
-	(*repo).StandList.AddNodes(stands.Values)
-
-	var gates models.FixedResources
-	xml.Unmarshal(getResource(airportCode, "Gates"), &gates)
-	(*repo).GateList.AddNodes(gates.Values)
-
-	var carousels models.FixedResources
-	xml.Unmarshal(getResource(airportCode, "Carousels"), &carousels)
-	(*repo).CarouselList.AddNodes(carousels.Values)
-
-	var chutes models.FixedResources
-	xml.Unmarshal(getResource(airportCode, "Chutes"), &chutes)
-	(*repo).ChuteList.AddNodes(chutes.Values)
-
-	globals.Logger.Info(fmt.Sprintf("Completed Populating Resource Maps for %s", airportCode))
-}
-func getResource(airportCode string, resourceType string) []byte {
-
-	repo := GetRepo(airportCode)
-
-	url := repo.AMSRestServiceURL + "/" + repo.AMSAirport + "/" + resourceType
-
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		globals.Logger.Error(fmt.Sprintf("Get Resource Client: Could not create request: %s\n", err))
-		return nil
-	}
-
-	req.Header.Set("Authorization", repo.AMSToken)
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		globals.Logger.Error(fmt.Sprintf("Get Resource Client: error making http request: %s\n", err))
-		return nil
-	}
+	// Retrieve the available resources. A resource type that could not be retrieved is left as it is
+	for _, resourceType := range snapshotResourceTypes {
+		resources, err := getAMSClient(airportCode).GetFixedResources(globals.Ctx, resourceType)
+		if err != nil {
+			globals.Logger.Error(fmt.Sprintf("Could not get %s for %s from AMS: %s", resourceType, airportCode, err))
+			continue
+		}
 
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		globals.Logger.Error(fmt.Sprintf("Get Resource Client: could not read response body: %s\n", err))
-		return nil
+		repo.Lock()
+		snapshotResourceList(repo, resourceType).AddNodes(resources)
+		repo.Unlock()
+		persistResources(airportCode, resourceType, resources)
 	}
 
-	return resBody
+	globals.Logger.Info(fmt.Sprintf("Completed Populating Resource Maps for %s", airportCode))
 }
 
 func MaintainRepository(airportCode string, perfTest bool) {
@@ -208,141 +176,8 @@ func MaintainRepository(airportCode string, perfTest bool) {
 		go scheduleUpdates(airportCode)
 	}
 
-	repo := GetRepo(airportCode)
-
-	if repo.ListenerType == "MSMQ" {
-		//Listen to the notification queue
-		opts := []msmq.QueueInfoOption{
-			msmq.WithPathName(GetRepo(airportCode).NotificationListenerQueue),
-		}
-		queueInfo, err := msmq.NewQueueInfo(opts...)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-	ReconnectMSMQ:
-		for {
-
-			queue, err := queueInfo.Open(msmq.Receive, msmq.DenyNone)
-			if err != nil {
-				globals.Logger.Error(err)
-				continue ReconnectMSMQ
-			}
-
-			for {
-
-				msg, err := queue.Receive() //This call blocks until a message is available
-				if err != nil {
-					globals.Logger.Error(err)
-					continue ReconnectMSMQ
-				}
-
-				message, _ := msg.Body()
-
-				globals.Logger.Debug(fmt.Sprintf("Received Message length %d\n", len(message)))
-
-				if strings.Contains(message, "FlightUpdatedNotification") {
-					go UpdateFlightEntry(message, false)
-					queue.Close()
-					continue ReconnectMSMQ
-				}
-				if strings.Contains(message, "FlightCreatedNotification") {
-					go createFlightEntry(message)
-					queue.Close()
-					continue ReconnectMSMQ
-				}
-				if strings.Contains(message, "FlightDeletedNotification") {
-					go deleteFlightEntry(message)
-					queue.Close()
-					continue ReconnectMSMQ
-				}
-			}
-		}
-	} else if repo.ListenerType == "RMQ" {
-		conn, err := amqp.Dial(repo.RabbitMQConnectionString)
-		failOnError(err, "Failed to connect to RabbitMQ")
-		defer conn.Close()
-
-		ch, err := conn.Channel()
-		failOnError(err, "Failed to open a channel")
-		defer ch.Close()
-
-		// Declare the Exchange which the system will try to match if it exists or create if it doesn't
-		err = ch.ExchangeDeclare(
-			repo.RabbitMQExchange, // exchange
-			"topic",               // routing key
-			true,                  // durable
-			false,                 // auto-deleted
-			false,                 // internal
-			false,                 // no-wait
-			nil,                   // arguments
-		)
-		failOnError(err, "Failed to declare an exchange")
-
-		//the session queue that will receive the messages from the Topic publisher
-		q, err := ch.QueueDeclare(
-			"",    // name
-			false, // durable
-			false, // delete when unused
-			true,  // exclusive
-			false, // no-wait
-			nil,   // arguments
-		)
-		failOnError(err, "Failed to declare the listening queue")
-
-		log.Printf("Binding queue %s to exchange %s with routing key %s", q.Name, repo.RabbitMQExchange, repo.RabbitMQTopic)
-
-		// Bind the seession queue to the Publisher
-		err = ch.QueueBind(
-			q.Name,                // queue name
-			repo.RabbitMQTopic,    // routing key
-			repo.RabbitMQExchange, // exchange
-			false,
-			nil)
-		failOnError(err, "Failed to bind a queue")
-
-		msgs, err := ch.Consume(
-			q.Name, // queue
-			"",     // consumer
-			true,   // auto ack
-			false,  // exclusive
-			false,  // no local
-			false,  // no wait
-			nil,    // args
-		)
-		failOnError(err, "Failed to register a consumer")
-
-		var forever chan struct{}
-
-		// Read the messages from the queue
-		go func() {
-			i := 1
-			for d := range msgs {
-				globals.Logger.Debug("Rabbit Message Received")
-				fmt.Println("Rabbit Message Received ", i)
-				i++
-				message := string(d.Body[:])
-
-				globals.Logger.Debug(fmt.Sprintf("Received Message length %d\n", len(message)))
-
-				if strings.Contains(message, "FlightUpdatedNotification") {
-					go UpdateFlightEntry(message, false)
-					continue
-				}
-				if strings.Contains(message, "FlightCreatedNotification") {
-					go createFlightEntry(message)
-					continue
-				}
-				if strings.Contains(message, "FlightDeletedNotification") {
-					go deleteFlightEntry(message)
-					continue
-				}
-			}
-		}()
-
-		log.Printf(" [*] Waiting for logs. To exit press CTRL+C")
-		<-forever
-	}
+	// Receive the notifications with the listener configured for the airport until the service is stopped
+	listen(airportCode)
 }
 
 func scheduleUpdates(airportCode string) {
@@ -365,6 +200,20 @@ func scheduleUpdates(airportCode string) {
 
 	globals.Logger.Info(fmt.Sprintf("Regular updates of the repository have been scheduled at %s for every %v hours", startTimeStr, globals.ConfigViper.GetString("ScheduleUpdateJobIntervalInHours")))
 
+	runScheduler(s)
+}
+
+// runScheduler runs the jobs of the scheduler until the lifecycle context is cancelled.
+// A job that is running when the service is stopped is allowed to complete
+func runScheduler(s *gocron.Scheduler) {
+
+	globals.ShutdownWg.Add(1)
+	go func() {
+		defer globals.ShutdownWg.Done()
+		<-globals.Ctx.Done()
+		s.Stop()
+	}()
+
 	s.StartBlocking()
 }
 func loadRepositoryOnStartup(airportCode string) {
@@ -376,6 +225,31 @@ func loadRepositoryOnStartup(airportCode string) {
 
 }
 
+var resyncsInProgress = make(map[string]bool)
+var resyncsInProgressMutex = &sync.Mutex{}
+
+// resyncRepository refreshes the repository from AMS after notifications may have been missed.
+// A resync that is requested while one is already running for the airport is skipped
+func resyncRepository(airportCode string, reason string) {
+
+	resyncsInProgressMutex.Lock()
+	if resyncsInProgress[airportCode] {
+		resyncsInProgressMutex.Unlock()
+		return
+	}
+	resyncsInProgress[airportCode] = true
+	resyncsInProgressMutex.Unlock()
+
+	defer func() {
+		resyncsInProgressMutex.Lock()
+		delete(resyncsInProgress, airportCode)
+		resyncsInProgressMutex.Unlock()
+	}()
+
+	globals.Logger.Warn(fmt.Sprintf("Resynchronising repository for %s: %s", airportCode, reason))
+	updateRepository(airportCode)
+}
+
 func updateRepository(airportCode string) {
 
 	defer globals.ExeTime(fmt.Sprintf("Updated Repository for %s", airportCode))()
@@ -391,21 +265,63 @@ func updateRepository(airportCode string) {
 	}
 
 	globals.Logger.Info(fmt.Sprintf("Scheduled Maintenance of Repository: %s. Getting flights. Chunk Size: %v days", airportCode, chunkSize))
+	startRefresh(airportCode, (repo.FlightSDOWindowMaximumInDaysFromNow-repo.FlightSDOWindowMinimumInDaysFromNow)/chunkSize+1)
+
+	// Keep track of the flights AMS returned so flights deleted in AMS while we were not
+	// listening can be removed. Only done if every chunk was retrieved successfully
+	seen := make(map[string]bool)
+	complete := true
+	refreshStarted := time.Now()
 
 	for min := GetRepo(airportCode).FlightSDOWindowMinimumInDaysFromNow; min <= GetRepo(airportCode).FlightSDOWindowMaximumInDaysFromNow; min += chunkSize {
-		var envel models.Envelope
-		xml.Unmarshal(getFlights(airportCode, min, min+chunkSize), &envel)
-
-		for _, flight := range envel.Body.GetFlightsResponse.GetFlightsResult.WebServiceResult.ApiResponse.Data.Flights.Flight {
-			flight.LastUpdate = time.Now()
-			flight.Action = globals.StatusAction
-			//	globals.MapMutex.Lock()
-			(*repo).FlightLinkedList.ReplaceOrAddNode(flight)
-			upadateAllocation(flight, airportCode, false)
-			//	globals.MapMutex.Unlock()
+		flights, err := getFlights(airportCode, min, min+chunkSize)
+		if err != nil {
+			globals.Logger.Error(fmt.Sprintf("Scheduled Maintenance of Repository: %s. Could not get flights: %s", airportCode, err))
+			complete = false
+		}
+
+		history := []models.FlightHistoryEntry{}
+		applied := []models.Flight{}
+
+		// The flights are locked until they are persisted, so a notification applied in the meantime
+		// can not have its version in the snapshot overwritten by the older version from AMS
+		flightIDs := make([]string, len(flights))
+		for idx := range flights {
+			flightIDs[idx] = flights[idx].GetFlightID()
+		}
+		unlockFlights := lockFlights(airportCode, flightIDs)
+
+		repo.Lock()
+		for idx := range flights {
+			flights[idx].LastUpdate = time.Now()
+			flights[idx].Action = globals.StatusAction
+			flightID := flightIDs[idx]
+			seen[flightID] = true
+
+			// A notification received since AMS returned the flight may already have applied, or deleted, a newer version
+			if flights[idx].IsOlderThan(newestVersion(repo, flightID)) {
+				continue
+			}
+			current := repo.FlightList.GetFlight(flightID)
+
+			// Only record a new version in the history if the flight has changed since it was last seen
+			changed := current == nil || !reflect.DeepEqual(current.FlightState, flights[idx].FlightState)
+
+			(*repo).FlightList.ReplaceOrAddNode(flights[idx])
+			upadateAllocation(flights[idx], airportCode, false)
+			repo.FlightTombstones.Remove(flightID)
+			if changed {
+				history = append(history, recordFlightHistory(repo, repo.FlightList.GetFlight(flightID), globals.GetFlightsMessage))
+			}
+			applied = append(applied, flights[idx])
 		}
+		repo.Unlock()
+		persistFlights(airportCode, applied)
+		persistFlightHistory(airportCode, history)
+		unlockFlights()
 
-		globals.FlightsInitChannel <- len(envel.Body.GetFlightsResponse.GetFlightsResult.WebServiceResult.ApiResponse.Data.Flights.Flight)
+		globals.FlightsInitChannel <- len(flights)
+		recordChunkLoaded(airportCode)
 	}
 
 	from := time.Now().AddDate(0, 0, repo.FlightSDOWindowMinimumInDaysFromNow)
@@ -413,99 +329,92 @@ func updateRepository(airportCode string) {
 
 	fmt.Printf("Got flights set from %s to %s\n", from, to)
 
-	(*repo).UpdateLowerLimit(time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location()))
-	(*repo).UpdateUpperLimit(time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, to.Location()))
+	lower := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	upper := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, to.Location())
+	repo.Lock()
+	(*repo).UpdateLowerLimit(lower)
+	(*repo).UpdateUpperLimit(upper)
+	repo.Unlock()
+	persistLimits(airportCode, lower, upper)
+
+	if complete {
+		removeUnseenFlights(airportCode, seen, lower, upper.AddDate(0, 0, 1), refreshStarted)
+		repo.SetSnapshotStale(false)
+	}
 
 	cleanRepository(from, airportCode)
+	completeRefresh(airportCode, complete)
 }
-func cleanRepository(from time.Time, airportCode string) {
 
-	// Cleans the repository of old entries
-	// globals.MapMutex.Lock()
-	// defer globals.MapMutex.Unlock()
-
-	globals.Logger.Info(fmt.Sprintf("Cleaning repository from: %s", from))
-	GetRepo(airportCode).FlightLinkedList.RemoveExpiredNode(from)
-}
-
-func clearMSMQ(airportCode string) {
+// removeUnseenFlights removes the flights scheduled between from and to that were not returned by AMS
+// during the refresh. Flights outside the window that was fetched, and flights changed by a notification
+// since the refresh started, are kept as AMS was not asked about them
+func removeUnseenFlights(airportCode string, seen map[string]bool, from, to, refreshStarted time.Time) {
 
 	repo := GetRepo(airportCode)
 
-	if repo.ListenerType == "MSMQ" {
-		// Purge the listening queue first before doing the Initializarion of the repository
-		opts := []msmq.QueueInfoOption{
-			msmq.WithPathName(repo.NotificationListenerQueue),
-		}
-		queueInfo, err := msmq.NewQueueInfo(opts...)
-		if err != nil {
-			log.Fatal(err)
-		}
+	unseen := []models.Flight{}
 
-		queue, err := queueInfo.Open(msmq.Receive, msmq.DenyNone)
-
-		if err == nil {
-			purgeErr := queue.Purge()
-			if purgeErr != nil {
-				if globals.IsDebug {
-					globals.Logger.Error("Error purging listening queue")
-				}
-			} else {
-				if globals.IsDebug {
-					globals.Logger.Info("Listening queue purged OK")
-				}
-			}
+	repo.RLock()
+	repo.FlightList.ForEach(func(f *models.Flight) bool {
+		if !seen[f.GetFlightID()] {
+			unseen = append(unseen, *f)
+		}
+		return true
+	})
+	repo.RUnlock()
+
+	removed := 0
+	for _, flight := range unseen {
+		if deleteFlight(context.Background(), repo, flight, globals.FlightDeletedMessage, func(current *models.Flight) bool {
+			sto := current.GetSTO()
+			return !sto.Before(from) && sto.Before(to) && current.LastUpdate.Before(refreshStarted)
+		}) {
+			removed++
 		}
 	}
 
+	if removed > 0 {
+		globals.Logger.Info(fmt.Sprintf("Removed %d flights from %s no longer present in AMS", removed, airportCode))
+	}
 }
-func testNativeAPIConnectivity(airportCode string) bool {
-
-	repo := GetRepo(airportCode)
 
-	queryBody := fmt.Sprintf(testNativeAPIMessage, repo.AMSToken)
-	bodyReader := bytes.NewReader([]byte(queryBody))
-
-	req, err := http.NewRequest(http.MethodPost, repo.AMSSOAPServiceURL, bodyReader)
-	if err != nil {
-		globals.Logger.Error(fmt.Sprintf("Native API Test Client: could not create request: %s\n", err))
-		return false
-	}
+func cleanRepository(from time.Time, airportCode string) {
 
-	req.Header.Set("Content-Type", "text/xml;charset=UTF-8")
-	req.Header.Add("SOAPAction", "http://www.sita.aero/ams6-xml-api-webservice/IAMSIntegrationService/GetAirports")
+	// Cleans the repository of old entries
+	globals.Logger.Info(fmt.Sprintf("Cleaning repository from: %s", from))
+	repo := GetRepo(airportCode)
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil || res.StatusCode != 200 {
-		globals.Logger.Error(fmt.Sprintf("Native API Test Client: error making http request: %s\n", err))
-		return false
+	repo.Lock()
+	for _, flightID := range repo.FlightList.RemoveExpiredNode(from) {
+		repo.RemoveFlightAllocation(flightID)
 	}
+	repo.FlightHistory.RemoveExpired(from)
+	repo.Unlock()
 
-	return true
+	persistExpiredFlights(airportCode, from)
 }
 
-func testRestAPIConnectivity(airportCode string) bool {
-	repo := GetRepo(airportCode)
-
-	url := repo.AMSRestServiceURL + "/" + repo.AMSAirport + "/Gates"
+func testNativeAPIConnectivity(ctx context.Context, airportCode string) bool {
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	start := time.Now()
+	err := getAMSClient(airportCode).GetAirports(ctx)
+	recordAMSCheck(airportCode, true, time.Since(start), err)
 	if err != nil {
-		globals.Logger.Error(fmt.Sprintf("Test Connectivity Client: Could not create request: %s\n", err))
+		globals.Logger.Error(fmt.Sprintf("Native API Test Client: %s", err))
 		return false
 	}
 
-	req.Header.Set("Authorization", repo.AMSToken)
+	return true
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil || res.StatusCode != 200 {
-		globals.Logger.Error(fmt.Sprintf("Test Connectivity Client: error making http request: %s\n", err))
-		return false
-	}
+func testRestAPIConnectivity(ctx context.Context, airportCode string) bool {
 
-	_, err = io.ReadAll(res.Body)
+	start := time.Now()
+	_, err := getAMSClient(airportCode).GetFixedResources(ctx, "Gates")
+	recordAMSCheck(airportCode, false, time.Since(start), err)
 	if err != nil {
-		globals.Logger.Error(fmt.Sprintf("Test Connectivity Client: could not read response body: %s\n", err))
+		globals.Logger.Error(fmt.Sprintf("Test Connectivity Client: %s", err))
 		return false
 	}
 
@@ -0,0 +1,207 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/tracing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// The wait before the first attempt to reconnect to RabbitMQ. It doubles for each failed attempt
+// up to RabbitMQReconnectMaxBackoffInSeconds
+const rabbitMQReconnectMinBackoff = time.Second
+
+// The number of unacknowledged messages delivered at a time if RabbitMQPrefetch is not configured
+const rabbitMQDefaultPrefetch = 20
+
+func init() {
+	RegisterListener("RMQ", func() NotificationListener { return &rabbitMQListener{} })
+}
+
+// rabbitMQListener receives the notifications published to the RabbitMQ topic exchange of the airport.
+// The connection is re-established if it is lost, and the repository is resynchronised with AMS
+// once it is, as notifications may have been missed while disconnected
+type rabbitMQListener struct{}
+
+func (l *rabbitMQListener) Listen(ctx context.Context, repo *models.Repository, handle NotificationHandler) error {
+
+	maxBackoff := time.Duration(globals.ConfigViper.GetInt("RabbitMQReconnectMaxBackoffInSeconds")) * time.Second
+	if maxBackoff < rabbitMQReconnectMinBackoff {
+		maxBackoff = 60 * time.Second
+	}
+
+	backoff := rabbitMQReconnectMinBackoff
+	outage := false
+
+	for {
+		err := l.consume(ctx, repo, handle, func() {
+			setListenerState(repo.AMSAirport, ListenerConnected, nil)
+			backoff = rabbitMQReconnectMinBackoff
+			if outage {
+				go resyncRepository(repo.AMSAirport, "reconnected to RabbitMQ")
+			}
+			outage = false
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		outage = true
+		setListenerState(repo.AMSAirport, ListenerDisconnected, err)
+		globals.Logger.Error(fmt.Sprintf("RabbitMQ listener for %s: %s. Reconnecting in %s", repo.AMSAirport, err, backoff))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// consume connects to RabbitMQ and processes the notifications until the context is cancelled or the
+// connection is lost. Each message is acknowledged once it has been applied to the repository
+func (l *rabbitMQListener) consume(ctx context.Context, repo *models.Repository, handle NotificationHandler, established func()) error {
+
+	conn, err := amqp.Dial(repo.RabbitMQConnectionString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	defer ch.Close()
+
+	// Declare the Exchange which the system will try to match if it exists or create if it doesn't
+	err = ch.ExchangeDeclare(
+		repo.RabbitMQExchange, // exchange
+		"topic",               // routing key
+		true,                  // durable
+		false,                 // auto-deleted
+		false,                 // internal
+		false,                 // no-wait
+		nil,                   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare an exchange: %w", err)
+	}
+
+	// A named queue is durable and keeps the notifications published while we are disconnected.
+	// Without a name, a session queue is created that is deleted when the connection closes
+	durable := repo.RabbitMQQueue != ""
+	q, err := ch.QueueDeclare(
+		repo.RabbitMQQueue, // name
+		durable,            // durable
+		!durable,           // delete when unused
+		!durable,           // exclusive
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare the listening queue: %w", err)
+	}
+
+	globals.Logger.Info(fmt.Sprintf("Binding queue %s to exchange %s with routing key %s", q.Name, repo.RabbitMQExchange, repo.RabbitMQTopic))
+
+	// Bind the seession queue to the Publisher
+	err = ch.QueueBind(
+		q.Name,                // queue name
+		repo.RabbitMQTopic,    // routing key
+		repo.RabbitMQExchange, // exchange
+		false,
+		nil)
+	if err != nil {
+		return fmt.Errorf("failed to bind a queue: %w", err)
+	}
+
+	prefetch := repo.RabbitMQPrefetch
+	if prefetch < 1 {
+		prefetch = rabbitMQDefaultPrefetch
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set the prefetch count: %w", err)
+	}
+
+	msgs, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		false,  // auto ack
+		false,  // exclusive
+		false,  // no local
+		false,  // no wait
+		nil,    // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register a consumer: %w", err)
+	}
+
+	established()
+
+	// Wait for the messages being applied to be acknowledged before the channel is closed. Messages
+	// delivered but not yet acknowledged are returned to a named queue when the channel closes
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-msgs:
+			if !ok {
+				return errors.New("the connection to RabbitMQ was lost")
+			}
+			globals.Logger.Debug("Rabbit Message Received")
+
+			// Each message is queued on the pipeline before the next is taken so the messages for a
+			// flight are applied in the order they were delivered, while they are applied concurrently
+			queued := make(chan struct{})
+			inflight.Add(1)
+			go func(d amqp.Delivery) {
+				defer inflight.Done()
+
+				ctx := withQueuedNotice(tracing.ExtractMap(context.Background(), amqpHeaders(d.Headers)), queued)
+				err := handle(ctx, string(d.Body))
+				if errors.Is(err, errPipelineStopped) {
+					// Returned to the queue to be applied when the service restarts
+					d.Nack(false, true)
+					return
+				}
+				if err != nil {
+					globals.Logger.Warn(fmt.Sprintf("Rejected RabbitMQ message for %s: %s", repo.AMSAirport, err))
+					d.Reject(false)
+					return
+				}
+				if err := d.Ack(false); err != nil {
+					globals.Logger.Warn(fmt.Sprintf("Could not acknowledge RabbitMQ message for %s: %s", repo.AMSAirport, err))
+				}
+			}(d)
+			<-queued
+		}
+	}
+}
+
+// amqpHeaders returns the string headers of a message, which carry the trace context if the publisher
+// started a trace
+func amqpHeaders(table amqp.Table) map[string]string {
+	headers := map[string]string{}
+	for key, value := range table {
+		if s, ok := value.(string); ok {
+			headers[key] = s
+		}
+	}
+	return headers
+}
@@ -0,0 +1,291 @@
+package repo
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// The write deadline for an event sent to a WebSocket client
+const streamWriteTimeout = 10 * time.Second
+
+// StreamChangesAPI streams the changes to the flights of the airport. The connection is upgraded to a
+// WebSocket if the client requests it, otherwise the changes are sent as Server-Sent Events.
+// The changes are filtered with the same parameters as a change subscription
+func StreamChangesAPI(c *gin.Context) {
+
+	userProfile := StreamUserProfile(c)
+
+	if !userProfile.Enabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"Error": "User Access Has Been Disabled"})
+		return
+	}
+
+	globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", userProfile.UserName, c.RemoteIP(), requestURIWithoutCredentials(c.Request)))
+
+	apt := c.Param("apt")
+	if GetRepo(apt) == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Airport %s not found", apt)})
+		return
+	}
+	if !globals.Contains(userProfile.AllowedAirports, apt) && !globals.Contains(userProfile.AllowedAirports, "*") {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": "User is not allowed to access requested airport"})
+		return
+	}
+
+	filter, err := streamFilter(c, apt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		return
+	}
+
+	// Browsers send the Last-Event-ID header when an event source reconnects
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		if lastID, err = strconv.ParseInt(lastEventID, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Invalid last event ID %s", lastEventID)})
+			return
+		}
+	}
+
+	clientBuffer := globals.ConfigViper.GetInt("StreamClientBufferSize")
+	if clientBuffer < 1 {
+		clientBuffer = 256
+	}
+	client := &streamClient{filter: filter, profile: userProfile, events: make(chan streamEvent, clientBuffer)}
+	hub := getChangeStreamHub(apt)
+
+	if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		server := websocket.Server{Handshake: checkStreamOrigin, Handler: func(ws *websocket.Conn) {
+			streamWebSocket(ws, hub, client, lastID)
+		}}
+		server.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	streamSSE(c, hub, client, lastID)
+}
+
+// StreamUserProfile returns the profile of the user of a stream. Browsers can not set headers on an event
+// source or WebSocket, so the token can also be given with the "token" query parameter and a bearer
+// token with the "access_token" query parameter
+func StreamUserProfile(c *gin.Context) models.UserProfile {
+
+	if _, ok := c.Get(userProfileContextKey); ok || HasCredentials(c) {
+		return GetUserProfile(c, "")
+	}
+
+	var profile models.UserProfile
+	if c.Query("token") != "" {
+		profile = GetUserProfile(nil, c.Query("token"))
+	} else if c.Query("access_token") != "" {
+		profile = userProfileForBearer(c.Query("access_token"))
+	} else {
+		return GetUserProfile(c, "")
+	}
+
+	c.Set(userProfileContextKey, profile)
+	return profile
+}
+
+// requestURIWithoutCredentials returns the path and query of the request without the credentials that
+// streams accept in the query, so they are not written to the request log
+func requestURIWithoutCredentials(r *http.Request) string {
+
+	query := r.URL.Query()
+	if !query.Has("token") && !query.Has("access_token") {
+		return r.URL.RequestURI()
+	}
+	query.Del("token")
+	query.Del("access_token")
+
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
+// checkStreamOrigin refuses WebSocket connections opened by pages from other sites, which could use the
+// credentials of a user given in the query. Pages served from the host of the service and from
+// StreamAllowedOrigins are accepted. Clients other than browsers send no Origin and are accepted
+func checkStreamOrigin(config *websocket.Config, req *http.Request) error {
+
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return nil
+	}
+	config.Origin = origin
+
+	if strings.EqualFold(origin.Host, req.Host) {
+		return nil
+	}
+	for _, allowed := range globals.ConfigViper.GetStringSlice("StreamAllowedOrigins") {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin.Scheme+"://"+origin.Host) {
+			return nil
+		}
+	}
+
+	globals.Logger.Warn(fmt.Sprintf("Stream WebSocket from origin %s refused", origin))
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+// streamFilter creates the change subscription for the stream from the query parameters, which have the
+// names of the fields of a change subscription. ParameterChange is a comma separated list. All changes
+// are streamed if none are given. CreateFlight, UpdateFlight and DeleteFlight are true unless set
+func streamFilter(c *gin.Context, apt string) (models.UserChangeSubscription, error) {
+
+	filter := models.UserChangeSubscription{Enabled: true, Airport: apt, CreateFlight: true, UpdateFlight: true, DeleteFlight: true}
+
+	var err error
+	set := false
+	flag := func(name string, value *bool) {
+		v, ok := c.GetQuery(name)
+		if !ok || err != nil {
+			return
+		}
+		if *value, err = strconv.ParseBool(v); err != nil {
+			err = fmt.Errorf("Invalid value %s for %s", v, name)
+		}
+		set = true
+	}
+
+	flag("CheckInChange", &filter.CheckInChange)
+	flag("GateChange", &filter.GateChange)
+	flag("StandChange", &filter.StandChange)
+	flag("CarouselChange", &filter.CarouselChange)
+	flag("ChuteChange", &filter.ChuteChange)
+	flag("AircraftTypeOrRegoChange", &filter.AircraftTypeOrRegoChange)
+	flag("EventChange", &filter.EventChange)
+	flag("CreateFlight", &filter.CreateFlight)
+	flag("UpdateFlight", &filter.UpdateFlight)
+	flag("DeleteFlight", &filter.DeleteFlight)
+	flag("All", &filter.All)
+
+	if v := c.Query("ParameterChange"); v != "" {
+		filter.ParameterChange = strings.Split(v, ",")
+		set = true
+	}
+
+	if !set {
+		filter.All = true
+	}
+	return filter, err
+}
+
+// streamSSE sends the changes to the client as Server-Sent Events until the client disconnects
+func streamSSE(c *gin.Context, hub *changeStreamHub, client *streamClient, lastID int64) {
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	runChangeStream(c.Request.Context().Done(), hub, client, lastID, func(name string, id int64, data []byte) error {
+
+		var sb strings.Builder
+		if name == streamKeepAliveEvent {
+			sb.WriteString(": keepalive\n\n")
+		} else {
+			if id > 0 {
+				sb.WriteString("id: " + strconv.FormatInt(id, 10) + "\n")
+			}
+			sb.WriteString("event: " + name + "\n")
+			for _, line := range strings.Split(string(data), "\n") {
+				sb.WriteString("data: " + line + "\n")
+			}
+			sb.WriteString("\n")
+		}
+
+		if _, err := c.Writer.WriteString(sb.String()); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+}
+
+// streamWebSocket sends the changes to the client as WebSocket text messages until the client disconnects.
+// Messages received from the client are ignored
+func streamWebSocket(ws *websocket.Conn, hub *changeStreamHub, client *streamClient, lastID int64) {
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var message string
+		for websocket.Message.Receive(ws, &message) == nil {
+		}
+	}()
+
+	runChangeStream(closed, hub, client, lastID, func(name string, id int64, data []byte) error {
+		ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return websocket.Message.Send(ws, string(data))
+	})
+}
+
+// runChangeStream sends the changes missed since lastID and then the changes as they are published,
+// until the client disconnects, falls behind or the service stops
+func runChangeStream(closed <-chan struct{}, hub *changeStreamHub, client *streamClient, lastID int64, send func(name string, id int64, data []byte) error) {
+
+	apt := client.filter.Airport
+
+	replay, reset := hub.subscribe(client, lastID)
+	defer hub.unsubscribe(client)
+
+	globals.Logger.Info(fmt.Sprintf("Change stream client %s connected for %s, replaying %d changes", client.profile.UserName, apt, len(replay)))
+	defer globals.Logger.Info(fmt.Sprintf("Change stream client %s for %s disconnected", client.profile.UserName, apt))
+
+	if reset {
+		if err := send(streamResetEvent, 0, []byte("{\"Event\":\""+streamResetEvent+"\",\"Airport\":\""+apt+"\"}")); err != nil {
+			return
+		}
+	}
+	for i := range replay {
+		if err := send(streamEventName(replay[i].kind), replay[i].id, replay[i].json(&client.profile)); err != nil {
+			return
+		}
+	}
+
+	keepAlive := globals.ConfigViper.GetInt("StreamKeepAliveInSeconds")
+	if keepAlive < 1 {
+		keepAlive = 15
+	}
+	ticker := time.NewTicker(time.Duration(keepAlive) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case <-globals.Ctx.Done():
+			return
+		case event, ok := <-client.events:
+			if !ok {
+				return
+			}
+			err = send(streamEventName(event.kind), event.id, event.json(&client.profile))
+		case <-ticker.C:
+			err = send(streamKeepAliveEvent, 0, []byte("{\"Event\":\""+streamKeepAliveEvent+"\"}"))
+		}
+		if err != nil {
+			globals.Logger.Debug(fmt.Sprintf("Change stream client %s for %s: %s", client.profile.UserName, apt, err))
+			return
+		}
+	}
+}
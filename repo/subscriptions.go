@@ -0,0 +1,548 @@
+package repo
+
+/*
+
+Subscriptions created through the API are kept in a SQLite database in the PersistenceDirectory and
+belong to the user that created them. They are added to the subscriptions of the user in users.json,
+and the change subscriptions and scheduled pushes are rebuilt whenever either changes, so changes
+take effect without a restart
+
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+)
+
+const subscriptionSchema = `
+CREATE TABLE IF NOT EXISTS subscriptions(id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT, type TEXT,
+	created TEXT, updated TEXT, definition BLOB);
+CREATE INDEX IF NOT EXISTS subscriptions_username ON subscriptions(username);
+`
+
+// The types of subscription
+const (
+	ChangeSubscription = "Change"
+	PushSubscription   = "Push"
+)
+
+// The sources of subscriptions
+const (
+	subscriptionSourceAPI    = "API"
+	subscriptionSourceConfig = "users.json"
+)
+
+// ErrSubscriptionNotFound is returned for a subscription that is not in the store or belongs to another user
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// ErrInvalidSubscription is wrapped by the errors returned for subscriptions that can not be saved
+var ErrInvalidSubscription = errors.New("invalid subscription")
+
+var subscriptionDB *sql.DB
+var subscriptionDBErr error
+var subscriptionDBOnce sync.Once
+
+// Serialises the changes to the stored subscriptions with the rebuilding of the active subscriptions
+var subscriptionsMutex sync.Mutex
+
+func init() {
+	globals.OnUserConfigChange(func() {
+		loadConfigUsers()
+		go reloadAllSubscriptions()
+	})
+}
+
+// getSubscriptionDB opens (creating if required) the subscription database on first use
+func getSubscriptionDB() (*sql.DB, error) {
+
+	subscriptionDBOnce.Do(func() {
+		dir := globals.ConfigViper.GetString("PersistenceDirectory")
+		if dir == "" {
+			dir = "."
+		}
+		dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL", filepath.Join(dir, "subscriptions.db"))
+
+		db, err := sql.Open("sqlite3", dsn)
+		if err != nil {
+			subscriptionDBErr = err
+			return
+		}
+		db.SetMaxOpenConns(1)
+
+		if _, err = db.Exec(subscriptionSchema); err != nil {
+			db.Close()
+			subscriptionDBErr = err
+			return
+		}
+		subscriptionDB = db
+	})
+
+	return subscriptionDB, subscriptionDBErr
+}
+
+// storedSubscriptions returns the subscriptions of the user in the store, or of all users if no user is given
+func storedSubscriptions(userName string) ([]models.Subscription, error) {
+
+	db, err := getSubscriptionDB()
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT id, username, type, created, updated, definition FROM subscriptions"
+	args := []interface{}{}
+	if userName != "" {
+		query += " WHERE username = ?"
+		args = append(args, userName)
+	}
+	query += " ORDER BY id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []models.Subscription{}
+	for rows.Next() {
+		var sub models.Subscription
+		var created, updated string
+		var definition []byte
+		if err := rows.Scan(&sub.ID, &sub.UserName, &sub.Type, &created, &updated, &definition); err != nil {
+			return nil, err
+		}
+		if err := decodeSubscription(&sub, created, updated, definition); err != nil {
+			globals.Logger.Error(fmt.Sprintf("Could not read subscription %d: %s", sub.ID, err))
+			continue
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+func decodeSubscription(sub *models.Subscription, created, updated string, definition []byte) error {
+
+	sub.Source = subscriptionSourceAPI
+	createdTime, _ := time.Parse(snapshotTimeLayout, created)
+	updatedTime, _ := time.Parse(snapshotTimeLayout, updated)
+	sub.Created = &createdTime
+	sub.Updated = &updatedTime
+
+	if sub.Type == PushSubscription {
+		sub.Push = &models.UserPushSubscription{}
+		return json.Unmarshal(definition, sub.Push)
+	}
+	sub.Change = &models.UserChangeSubscription{}
+	return json.Unmarshal(definition, sub.Change)
+}
+
+// userProfilesWithSubscriptions returns the user profiles with the subscriptions in the store added to
+// those of their users
+func userProfilesWithSubscriptions() []models.UserProfile {
+
+	users := userProfiles()
+
+	stored, err := storedSubscriptions("")
+	if err != nil {
+		globals.Logger.Error(fmt.Sprintf("Could not read the subscription store: %s", err))
+		return users
+	}
+
+	for i := range users {
+		for _, sub := range stored {
+			if sub.UserName != users[i].UserName {
+				continue
+			}
+			if sub.Change != nil {
+				change := *sub.Change
+				change.SubscriptionID = sub.ID
+				users[i].UserChangeSubscriptions = append(users[i].UserChangeSubscriptions, change)
+			}
+			if sub.Push != nil {
+				push := *sub.Push
+				push.SubscriptionID = sub.ID
+				users[i].UserPushSubscriptions = append(users[i].UserPushSubscriptions, push)
+			}
+		}
+	}
+
+	return users
+}
+
+// RefreshChangeSubscriptions rebuilds the change subscriptions of the enabled users
+func RefreshChangeSubscriptions() {
+
+	subscriptions := []models.UserChangeSubscription{}
+	for _, up := range userProfilesWithSubscriptions() {
+		if !up.Enabled {
+			continue
+		}
+		for _, sub := range up.UserChangeSubscriptions {
+			sub.UserName = up.UserName
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+
+	globals.UserChangeSubscriptionsMutex.Lock()
+	globals.UserChangeSubscriptions = subscriptions
+	globals.UserChangeSubscriptionsMutex.Unlock()
+
+	globals.Logger.Debug(fmt.Sprintf("%d change subscriptions active", len(subscriptions)))
+}
+
+// reloadSubscriptions rebuilds the change subscriptions and the scheduled pushes of the airports
+func reloadSubscriptions(airports ...string) {
+
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	RefreshChangeSubscriptions()
+	for _, apt := range airports {
+		ReschedulePushes(apt)
+	}
+}
+
+// reloadAllSubscriptions rebuilds the change subscriptions and the scheduled pushes of all the airports
+func reloadAllSubscriptions() {
+
+	airports := []string{}
+	pushSchedulersMutex.Lock()
+	for apt := range globals.SchedulerMap {
+		airports = append(airports, apt)
+	}
+	pushSchedulersMutex.Unlock()
+
+	reloadSubscriptions(airports...)
+}
+
+// ListSubscriptions returns the subscriptions of the user, those from users.json first
+func ListSubscriptions(user models.UserProfile) ([]models.Subscription, error) {
+
+	subscriptions := []models.Subscription{}
+	for i := range user.UserChangeSubscriptions {
+		subscriptions = append(subscriptions, models.Subscription{UserName: user.UserName, Type: ChangeSubscription, Source: subscriptionSourceConfig, Change: &user.UserChangeSubscriptions[i]})
+	}
+	for i := range user.UserPushSubscriptions {
+		subscriptions = append(subscriptions, models.Subscription{UserName: user.UserName, Type: PushSubscription, Source: subscriptionSourceConfig, Push: &user.UserPushSubscriptions[i]})
+	}
+
+	stored, err := storedSubscriptions(user.UserName)
+	if err != nil {
+		return nil, err
+	}
+	return append(subscriptions, stored...), nil
+}
+
+// GetSubscription returns the subscription of the user from the store
+func GetSubscription(user models.UserProfile, id int64) (models.Subscription, error) {
+
+	var sub models.Subscription
+
+	db, err := getSubscriptionDB()
+	if err != nil {
+		return sub, err
+	}
+
+	var created, updated string
+	var definition []byte
+	err = db.QueryRow("SELECT id, username, type, created, updated, definition FROM subscriptions WHERE id = ? AND username = ?", id, user.UserName).
+		Scan(&sub.ID, &sub.UserName, &sub.Type, &created, &updated, &definition)
+	if err == sql.ErrNoRows {
+		return sub, ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return sub, err
+	}
+
+	return sub, decodeSubscription(&sub, created, updated, definition)
+}
+
+// CreateSubscription validates the subscription, which must have its Change or Push definition set, and
+// adds it to the store for the user
+func CreateSubscription(user models.UserProfile, sub models.Subscription) (models.Subscription, error) {
+
+	if err := validateSubscription(user, &sub); err != nil {
+		return sub, err
+	}
+	definition, airport := subscriptionDefinition(sub)
+
+	db, err := getSubscriptionDB()
+	if err != nil {
+		return sub, err
+	}
+
+	now := time.Now()
+	result, err := db.Exec("INSERT INTO subscriptions(username, type, created, updated, definition) VALUES(?, ?, ?, ?, ?)",
+		user.UserName, sub.Type, now.Format(snapshotTimeLayout), now.Format(snapshotTimeLayout), definition)
+	if err != nil {
+		return sub, err
+	}
+
+	sub.ID, _ = result.LastInsertId()
+	sub.UserName = user.UserName
+	sub.Source = subscriptionSourceAPI
+	sub.Created = &now
+	sub.Updated = &now
+
+	globals.Logger.Info(fmt.Sprintf("%s subscription %d for %s created by %s", sub.Type, sub.ID, airport, user.UserName))
+	subscriptionChanged(sub.Type, airport)
+
+	return sub, nil
+}
+
+// UpdateSubscription replaces the definition of the subscription of the user. The type can not be changed
+func UpdateSubscription(user models.UserProfile, id int64, sub models.Subscription) (models.Subscription, error) {
+
+	current, err := GetSubscription(user, id)
+	if err != nil {
+		return sub, err
+	}
+	if sub.Type != current.Type {
+		return sub, fmt.Errorf("%w: a %s subscription can not be changed to a %s subscription", ErrInvalidSubscription, current.Type, sub.Type)
+	}
+	if err := validateSubscription(user, &sub); err != nil {
+		return sub, err
+	}
+	definition, airport := subscriptionDefinition(sub)
+	_, previousAirport := subscriptionDefinition(current)
+
+	db, _ := getSubscriptionDB()
+
+	now := time.Now()
+	if _, err := db.Exec("UPDATE subscriptions SET definition = ?, updated = ? WHERE id = ?", definition, now.Format(snapshotTimeLayout), id); err != nil {
+		return sub, err
+	}
+
+	sub.ID = id
+	sub.UserName = user.UserName
+	sub.Source = subscriptionSourceAPI
+	sub.Created = current.Created
+	sub.Updated = &now
+
+	globals.Logger.Info(fmt.Sprintf("%s subscription %d for %s updated by %s", sub.Type, sub.ID, airport, user.UserName))
+	subscriptionChanged(sub.Type, airport, previousAirport)
+
+	return sub, nil
+}
+
+// SetSubscriptionEnabled pauses or resumes the subscription of the user
+func SetSubscriptionEnabled(user models.UserProfile, id int64, enabled bool) (models.Subscription, error) {
+
+	sub, err := GetSubscription(user, id)
+	if err != nil {
+		return sub, err
+	}
+	if sub.Change != nil {
+		sub.Change.Enabled = enabled
+	}
+	if sub.Push != nil {
+		sub.Push.Enabled = enabled
+	}
+	return UpdateSubscription(user, id, sub)
+}
+
+// DeleteSubscription removes the subscription of the user from the store
+func DeleteSubscription(user models.UserProfile, id int64) error {
+
+	sub, err := GetSubscription(user, id)
+	if err != nil {
+		return err
+	}
+
+	db, _ := getSubscriptionDB()
+	if _, err := db.Exec("DELETE FROM subscriptions WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	_, airport := subscriptionDefinition(sub)
+	globals.Logger.Info(fmt.Sprintf("%s subscription %d for %s deleted by %s", sub.Type, sub.ID, airport, user.UserName))
+	subscriptionChanged(sub.Type, airport)
+
+	return nil
+}
+
+// subscriptionChanged brings the change subscriptions, and the scheduled pushes of the airports of a
+// push subscription, up to date
+func subscriptionChanged(subscriptionType string, airports ...string) {
+	if subscriptionType == PushSubscription {
+		reloadSubscriptions(airports...)
+	} else {
+		reloadSubscriptions()
+	}
+}
+
+// subscriptionDefinition returns the serialised definition of the subscription and its airport
+func subscriptionDefinition(sub models.Subscription) ([]byte, string) {
+	if sub.Push != nil {
+		definition, _ := json.Marshal(sub.Push)
+		return definition, sub.Push.Airport
+	}
+	definition, _ := json.Marshal(sub.Change)
+	return definition, sub.Change.Airport
+}
+
+// validateSubscription checks that the subscription is complete and for an airport the user can access
+func validateSubscription(user models.UserProfile, sub *models.Subscription) error {
+
+	var airport, destination string
+	var trustBadCertificates bool
+
+	switch {
+	case sub.Type == ChangeSubscription && sub.Change != nil:
+		airport = sub.Change.Airport
+		destination = sub.Change.DestinationURL
+		trustBadCertificates = sub.Change.TrustBadCertificates
+	case sub.Type == PushSubscription && sub.Push != nil:
+		airport = sub.Push.Airport
+		destination = sub.Push.DestinationURL
+		trustBadCertificates = sub.Push.TrustBadCertificates
+
+		subscriptionType := strings.ToLower(sub.Push.SubscriptionType)
+		if subscriptionType != "flight" && subscriptionType != "resource" {
+			return fmt.Errorf("%w: SubscriptionType must be Flight or Resource", ErrInvalidSubscription)
+		}
+		if sub.Push.ReptitionHours < 0 || sub.Push.ReptitionMinutes < 0 || (sub.Push.ReptitionHours == 0 && sub.Push.ReptitionMinutes == 0) {
+			return fmt.Errorf("%w: one of ReptitionHours or ReptitionMinutes must be set", ErrInvalidSubscription)
+		}
+		if sub.Push.ReptitionHours > 0 {
+			if _, err := time.Parse("15:04:05", sub.Push.Time); err != nil {
+				return fmt.Errorf("%w: Time must be given as hh:mm:ss for a push repeated every ReptitionHours", ErrInvalidSubscription)
+			}
+		}
+	default:
+		return fmt.Errorf("%w: the %s definition is missing", ErrInvalidSubscription, sub.Type)
+	}
+
+	if airport == "" || GetRepo(airport) == nil {
+		return fmt.Errorf("%w: Airport %s not found", ErrInvalidSubscription, airport)
+	}
+	if !globals.Contains(user.AllowedAirports, airport) && !globals.Contains(user.AllowedAirports, "*") {
+		return fmt.Errorf("%w: User is not allowed to access requested airport", ErrInvalidSubscription)
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: DestinationURL must be an http or https URL", ErrInvalidSubscription)
+	}
+	if err := checkDestination(u.Hostname()); err != nil {
+		return err
+	}
+
+	// Certificate checks can only be turned off by an administrator, in the subscriptions of the user's profile
+	if trustBadCertificates {
+		return fmt.Errorf("%w: TrustBadCertificates can only be set by an administrator", ErrInvalidSubscription)
+	}
+
+	return nil
+}
+
+// checkDestination refuses destinations that are, or resolve to, loopback, link-local, private or
+// unspecified addresses, so users can not have the service send to hosts on its own network. Hosts,
+// addresses and CIDR ranges in SubscriptionDestinationAllowlist are allowed
+func checkDestination(host string) error {
+
+	allowlist := globals.ConfigViper.GetStringSlice("SubscriptionDestinationAllowlist")
+	for _, allowed := range allowlist {
+		if strings.EqualFold(allowed, host) {
+			return nil
+		}
+	}
+
+	ips := []net.IP{}
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		ctx, cancel := context.WithTimeout(globals.Ctx, 5*time.Second)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			return fmt.Errorf("%w: DestinationURL host %s could not be resolved", ErrInvalidSubscription, host)
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if internalAddress(ip) && !addressAllowed(ip, allowlist) {
+			return fmt.Errorf("%w: DestinationURL host %s is an internal address", ErrInvalidSubscription, host)
+		}
+	}
+	return nil
+}
+
+func internalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+func addressAllowed(ip net.IP, allowlist []string) bool {
+	for _, allowed := range allowlist {
+		if _, network, err := net.ParseCIDR(allowed); err == nil && network.Contains(ip) {
+			return true
+		}
+		if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationClient returns the client for sending pushes to a subscription destination. Redirects are
+// not followed. For subscriptions created through the API, checkAddress, the address is checked again
+// when connecting, so a host that redirects or resolves to an internal address after the subscription
+// was saved is refused
+func destinationClient(trustBadCertificates, checkAddress bool) *http.Client {
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		DialContext:     dialer.DialContext,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: trustBadCertificates},
+	}
+
+	if checkAddress {
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+
+			// The host is given as in the DestinationURL, before it is resolved
+			allowlist := globals.ConfigViper.GetStringSlice("SubscriptionDestinationAllowlist")
+			host, _, _ := net.SplitHostPort(address)
+			for _, allowed := range allowlist {
+				if strings.EqualFold(allowed, host) {
+					return dialer.DialContext(ctx, network, address)
+				}
+			}
+
+			checked := *dialer
+			checked.Control = func(network, address string, _ syscall.RawConn) error {
+				ip, _, _ := net.SplitHostPort(address)
+				if addr := net.ParseIP(ip); addr != nil && internalAddress(addr) && !addressAllowed(addr, allowlist) {
+					return fmt.Errorf("%s of %s is an internal address", ip, host)
+				}
+				return nil
+			}
+			return checked.DialContext(ctx, network, address)
+		}
+	}
+
+	return &http.Client{
+		Timeout:   20 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,54 @@
+package repo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"flightresourcerestapi/globals"
+)
+
+// TestDestinationClient checks that pushes for subscriptions created through the API are not sent to
+// internal addresses and that redirects are not followed
+func TestDestinationClient(t *testing.T) {
+
+	received := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/push", http.StatusTemporaryRedirect)
+			return
+		}
+		received++
+	}))
+	defer receiver.Close()
+
+	globals.ConfigViper.Set("SubscriptionDestinationAllowlist", []string{})
+	defer globals.ConfigViper.Set("SubscriptionDestinationAllowlist", nil)
+
+	if _, err := destinationClient(false, true).Post(receiver.URL+"/push", "application/json", nil); err == nil {
+		t.Errorf("push to %s was sent, the loopback address should be refused", receiver.URL)
+	}
+
+	r, err := destinationClient(false, false).Post(receiver.URL+"/push", "application/json", nil)
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("push to %s from the user's profile was not sent: %v", receiver.URL, err)
+	}
+	r.Body.Close()
+
+	r, err = destinationClient(false, false).Post(receiver.URL+"/redirect", "application/json", nil)
+	if err != nil {
+		t.Fatalf("push to %s/redirect failed: %v", receiver.URL, err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusTemporaryRedirect || received != 1 {
+		t.Errorf("redirect was followed, status %d and %d pushes received", r.StatusCode, received)
+	}
+
+	// Addresses in the allowlist are accepted
+	globals.ConfigViper.Set("SubscriptionDestinationAllowlist", []string{"127.0.0.0/8"})
+	r, err = destinationClient(false, true).Post(receiver.URL+"/push", "application/json", nil)
+	if err != nil {
+		t.Fatalf("push to %s in the allowlist was not sent: %v", receiver.URL, err)
+	}
+	r.Body.Close()
+}
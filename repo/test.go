@@ -1,9 +1,7 @@
 package repo
 
 import (
-	"database/sql"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 
@@ -12,7 +10,6 @@ import (
 	"flightresourcerestapi/globals"
 	"flightresourcerestapi/models"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/viper"
 )
 
@@ -74,7 +71,7 @@ func PerfTestInit() {
 		return
 	}
 
-	globals.RepoList = append(globals.RepoList, config.TestConfig.Repository)
+	addRepo(&config.TestConfig.Repository)
 
 	rep := GetRepo(config.TestConfig.Repository.AMSAirport)
 
@@ -100,30 +97,16 @@ func PerfTestInit() {
 		time.Sleep(time.Duration(1 * time.Second))
 	}
 
-	db, err := sql.Open("sqlite3", "APT.db")
-	defer db.Close()
-
-	if err != nil {
-		log.Fatal(err)
-	}
-	sts := `
-	DROP TABLE IF EXISTS flights;
-	CREATE TABLE flights(id INTEGER PRIMARY KEY, flightid TEXT, jsonflight TEXT);
-	`
-	_, err = db.Exec(sts)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
+	rep.Lock()
 	(*rep).CurrentLowerLimit = time.Now().Add(-60 * 24 * 15 * time.Minute)
 	(*rep).CurrentUpperLimit = time.Now().Add(60 * 24 * 15 * time.Minute)
+	rep.Unlock()
 
 	fmt.Println("Demo Resources Loaded. Ready to process requests via HTTP RestAPI")
 
 }
 
-func addResource(area string, num int, rtype string, arr *models.ResourceLinkedList) {
+func addResource(area string, num int, rtype string, arr *models.ResourceIndexedList) {
 
 	for i := 1; i <= num; i++ {
 		arr.AddNode(
@@ -138,9 +121,3 @@ func addResource(area string, num int, rtype string, arr *models.ResourceLinkedL
 	}
 
 }
-
-func failOnError(err error, msg string) {
-	if err != nil {
-		log.Panicf("%s: %s", msg, err)
-	}
-}
@@ -0,0 +1,551 @@
+package repo
+
+/*
+
+Users created by the admin API are kept in a SQLite database in the PersistenceDirectory, alongside
+the users in users.json.
+
+Only the SHA-256 hash of a user's key is stored. The key is returned once, when the user is created or
+the key rotated. Keys are "frapi_", eight random hex characters and "_" followed by the secret. The part
+before the secret is the KeyPrefix, which is stored and shown so a key can be identified. Keys are
+random so a plain hash is sufficient to protect them. Users in users.json should have a KeyHash in place
+of their Key, which can be generated with the generateKey command. A Key in users.json is deprecated and
+is replaced by its hash when the file is read, so keys are only ever compared by their hash. A key with
+a KeyExpires time in the past is not accepted
+
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+)
+
+const userSchema = `
+CREATE TABLE IF NOT EXISTS users(username TEXT PRIMARY KEY, keyprefix TEXT, keyhash TEXT UNIQUE,
+	created TEXT, updated TEXT, profile BLOB);
+`
+
+const apiKeyPrefix = "frapi_"
+
+// The sources of users
+const (
+	userSourceAPI    = "API"
+	userSourceConfig = "users.json"
+)
+
+// ErrUserNotFound is returned for a user that is not in the user store
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserInConfig is returned for changes to a user defined in users.json
+var ErrUserInConfig = errors.New("user is defined in users.json and can only be changed by editing the file")
+
+// ErrInvalidUser is wrapped by the errors returned for users that can not be saved
+var ErrInvalidUser = errors.New("invalid user")
+
+var userDB *sql.DB
+var userDBErr error
+var userDBOnce sync.Once
+
+// The users in the store, kept in memory as they are needed for every request
+var managedUsers []models.UserAccount
+var managedUsersMutex sync.RWMutex
+
+// The users in users.json with their keys replaced by the hash, read again when the file changes
+var configUsers []models.UserProfile
+var configUsersLoaded bool
+var configUsersMutex sync.RWMutex
+
+// getUserDB opens (creating if required) the user database on first use and loads the users
+func getUserDB() (*sql.DB, error) {
+
+	userDBOnce.Do(func() {
+		dir := globals.ConfigViper.GetString("PersistenceDirectory")
+		if dir == "" {
+			dir = "."
+		}
+		dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL", filepath.Join(dir, "users.db"))
+
+		db, err := sql.Open("sqlite3", dsn)
+		if err != nil {
+			userDBErr = err
+			return
+		}
+		db.SetMaxOpenConns(1)
+
+		if _, err = db.Exec(userSchema); err != nil {
+			db.Close()
+			userDBErr = err
+			return
+		}
+		userDB = db
+
+		if err := loadManagedUsers(); err != nil {
+			globals.Logger.Error(fmt.Sprintf("Could not read the user store: %s", err))
+		}
+	})
+
+	return userDB, userDBErr
+}
+
+// loadManagedUsers reads the users in the store into memory
+func loadManagedUsers() error {
+
+	rows, err := userDB.Query("SELECT created, updated, profile FROM users ORDER BY username")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	users := []models.UserAccount{}
+	for rows.Next() {
+		var created, updated string
+		var profile []byte
+		if err := rows.Scan(&created, &updated, &profile); err != nil {
+			return err
+		}
+
+		account := models.UserAccount{Source: userSourceAPI}
+		if err := json.Unmarshal(profile, &account.User); err != nil {
+			return err
+		}
+		createdTime, _ := time.Parse(snapshotTimeLayout, created)
+		updatedTime, _ := time.Parse(snapshotTimeLayout, updated)
+		account.Created = &createdTime
+		account.Updated = &updatedTime
+		users = append(users, account)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	managedUsersMutex.Lock()
+	managedUsers = users
+	managedUsersMutex.Unlock()
+
+	return nil
+}
+
+// loadConfigUsers reads the users in users.json, replacing each Key by its KeyHash
+func loadConfigUsers() {
+
+	users := globals.GetUserProfiles()
+	for i := range users {
+		if users[i].Key == "" {
+			continue
+		}
+		globals.Logger.Warn(fmt.Sprintf("User %s has a Key in users.json, which is deprecated. Replace it with the KeyHash from the generateKey command", users[i].UserName))
+		if users[i].KeyHash == "" {
+			users[i].KeyHash = HashAPIKey(users[i].Key)
+		}
+		users[i].Key = ""
+	}
+
+	configUsersMutex.Lock()
+	configUsers = users
+	configUsersLoaded = true
+	configUsersMutex.Unlock()
+}
+
+// configUserProfiles returns the users in users.json, without their keys
+func configUserProfiles() []models.UserProfile {
+
+	configUsersMutex.RLock()
+	loaded := configUsersLoaded
+	configUsersMutex.RUnlock()
+	if !loaded {
+		loadConfigUsers()
+	}
+
+	configUsersMutex.RLock()
+	defer configUsersMutex.RUnlock()
+	return append([]models.UserProfile(nil), configUsers...)
+}
+
+// userProfiles returns the users in users.json followed by the users in the store
+func userProfiles() []models.UserProfile {
+
+	users := configUserProfiles()
+
+	if _, err := getUserDB(); err != nil {
+		return users
+	}
+
+	managedUsersMutex.RLock()
+	defer managedUsersMutex.RUnlock()
+
+	for _, account := range managedUsers {
+		users = append(users, account.User)
+	}
+	return users
+}
+
+// userProfileForKey returns the profile of the user with the key. An empty profile, which is not enabled,
+// is returned if there is no user with the key or the key has expired
+func userProfileForKey(key string) models.UserProfile {
+
+	hash := HashAPIKey(key)
+
+	for _, u := range userProfiles() {
+
+		if u.KeyHash == "" || subtle.ConstantTimeCompare([]byte(strings.ToLower(u.KeyHash)), []byte(hash)) != 1 {
+			continue
+		}
+
+		if keyExpired(u) {
+			globals.Logger.Warn(fmt.Sprintf("Expired key %s used for user %s", u.KeyPrefix, u.UserName))
+			return models.UserProfile{}
+		}
+		return u
+	}
+
+	return models.UserProfile{}
+}
+
+// keyExpired reports whether the KeyExpires time of the user has passed. It can be given as a date or an
+// RFC 3339 time. A time that can not be read is treated as expired
+func keyExpired(u models.UserProfile) bool {
+
+	if u.KeyExpires == "" {
+		return false
+	}
+	expires, err := parseKeyExpiry(u.KeyExpires)
+	return err != nil || time.Now().After(expires)
+}
+
+func parseKeyExpiry(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("%w: KeyExpires must be a date (yyyy-mm-dd) or an RFC 3339 time", ErrInvalidUser)
+	}
+	return t, nil
+}
+
+// HashAPIKey returns the hex SHA-256 hash of the key that is stored in place of the key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateAPIKey returns a new random key and its prefix
+func GenerateAPIKey() (key string, prefix string) {
+
+	id := make([]byte, 4)
+	secret := make([]byte, 32)
+	rand.Read(id)
+	rand.Read(secret)
+
+	prefix = apiKeyPrefix + hex.EncodeToString(id)
+	return prefix + "_" + base64.RawURLEncoding.EncodeToString(secret), prefix
+}
+
+// MaskedSigningSecret is returned in place of a signing secret. Sending it back in an update keeps the secret
+const MaskedSigningSecret = "********"
+
+// subscriptionSecrets are the signing secrets of the subscriptions of a user by destination and airport
+type subscriptionSecrets map[string][]string
+
+func (s subscriptionSecrets) add(destination, airport, secret string) {
+	key := destination + " " + airport
+	if secret != "" && !globals.Contains(s[key], secret) {
+		s[key] = append(s[key], secret)
+	}
+}
+
+// restore replaces a masked secret with the secret of the subscription to the destination for the
+// airport. It is refused if there is no such subscription with a secret, or several with different ones
+func (s subscriptionSecrets) restore(destination, airport string, secret *string) error {
+	if *secret != MaskedSigningSecret {
+		return nil
+	}
+	secrets := s[destination+" "+airport]
+	if len(secrets) != 1 {
+		return fmt.Errorf("%w: the masked SigningSecret of the subscription to %s for %s does not match one existing subscription, give the secret", ErrInvalidUser, destination, airport)
+	}
+	*secret = secrets[0]
+	return nil
+}
+
+// accountFor returns the user without their key, its hash or the signing secrets of their subscriptions
+func accountFor(u models.UserProfile, source string) models.UserAccount {
+	u.Key = ""
+	u.KeyHash = ""
+
+	// Copied so the profile of the user is not changed
+	u.UserChangeSubscriptions = append([]models.UserChangeSubscription(nil), u.UserChangeSubscriptions...)
+	for i := range u.UserChangeSubscriptions {
+		if u.UserChangeSubscriptions[i].SigningSecret != "" {
+			u.UserChangeSubscriptions[i].SigningSecret = MaskedSigningSecret
+		}
+	}
+	u.UserPushSubscriptions = append([]models.UserPushSubscription(nil), u.UserPushSubscriptions...)
+	for i := range u.UserPushSubscriptions {
+		if u.UserPushSubscriptions[i].SigningSecret != "" {
+			u.UserPushSubscriptions[i].SigningSecret = MaskedSigningSecret
+		}
+	}
+	return models.UserAccount{Source: source, User: u}
+}
+
+// ListUsers returns the users in users.json followed by the users in the store
+func ListUsers() ([]models.UserAccount, error) {
+
+	if _, err := getUserDB(); err != nil {
+		return nil, err
+	}
+
+	accounts := []models.UserAccount{}
+	for _, u := range configUserProfiles() {
+		accounts = append(accounts, accountFor(u, userSourceConfig))
+	}
+
+	managedUsersMutex.RLock()
+	defer managedUsersMutex.RUnlock()
+
+	for _, account := range managedUsers {
+		managed := accountFor(account.User, userSourceAPI)
+		managed.Created = account.Created
+		managed.Updated = account.Updated
+		accounts = append(accounts, managed)
+	}
+	return accounts, nil
+}
+
+// GetUser returns the user, from users.json or the store
+func GetUser(userName string) (models.UserAccount, error) {
+
+	users, err := ListUsers()
+	if err != nil {
+		return models.UserAccount{}, err
+	}
+	for _, account := range users {
+		if account.User.UserName == userName {
+			return account, nil
+		}
+	}
+	return models.UserAccount{}, ErrUserNotFound
+}
+
+// managedUser returns the user in the store with their key hash
+func managedUser(userName string) (models.UserAccount, error) {
+
+	for _, u := range configUserProfiles() {
+		if u.UserName == userName {
+			return models.UserAccount{}, ErrUserInConfig
+		}
+	}
+
+	managedUsersMutex.RLock()
+	defer managedUsersMutex.RUnlock()
+
+	for _, account := range managedUsers {
+		if account.User.UserName == userName {
+			return account, nil
+		}
+	}
+	return models.UserAccount{}, ErrUserNotFound
+}
+
+// CreateUser adds the user to the store with a new key, which is returned. This is the only time the
+// key is available
+func CreateUser(u models.UserProfile) (models.UserAccount, string, error) {
+
+	db, err := getUserDB()
+	if err != nil {
+		return models.UserAccount{}, "", err
+	}
+
+	if err := validateUser(u); err != nil {
+		return models.UserAccount{}, "", err
+	}
+	if _, err := GetUser(u.UserName); err == nil {
+		return models.UserAccount{}, "", fmt.Errorf("%w: user %s already exists", ErrInvalidUser, u.UserName)
+	}
+
+	key, prefix := GenerateAPIKey()
+	u.Key = ""
+	u.KeyHash = HashAPIKey(key)
+	u.KeyPrefix = prefix
+
+	profile, _ := json.Marshal(u)
+	now := time.Now().Format(snapshotTimeLayout)
+	_, err = db.Exec("INSERT INTO users(username, keyprefix, keyhash, created, updated, profile) VALUES(?, ?, ?, ?, ?, ?)",
+		u.UserName, u.KeyPrefix, u.KeyHash, now, now, profile)
+	if err != nil {
+		return models.UserAccount{}, "", err
+	}
+
+	globals.Logger.Info(fmt.Sprintf("User %s created with key %s", u.UserName, u.KeyPrefix))
+	if err := userChanged(); err != nil {
+		return models.UserAccount{}, "", err
+	}
+
+	account, err := GetUser(u.UserName)
+	return account, key, err
+}
+
+// UpdateUser replaces the profile of the user in the store. The user name and key can not be changed
+func UpdateUser(userName string, u models.UserProfile) (models.UserAccount, error) {
+
+	current, err := managedUser(userName)
+	if err != nil {
+		return models.UserAccount{}, err
+	}
+
+	u.UserName = current.User.UserName
+	u.Key = ""
+	u.KeyHash = current.User.KeyHash
+	u.KeyPrefix = current.User.KeyPrefix
+
+	// A masked signing secret keeps the secret of the current subscription with the same destination
+	changeSecrets, pushSecrets := subscriptionSecrets{}, subscriptionSecrets{}
+	for _, sub := range current.User.UserChangeSubscriptions {
+		changeSecrets.add(sub.DestinationURL, sub.Airport, sub.SigningSecret)
+	}
+	for _, sub := range current.User.UserPushSubscriptions {
+		pushSecrets.add(sub.DestinationURL, sub.Airport, sub.SigningSecret)
+	}
+	for i := range u.UserChangeSubscriptions {
+		sub := &u.UserChangeSubscriptions[i]
+		if err := changeSecrets.restore(sub.DestinationURL, sub.Airport, &sub.SigningSecret); err != nil {
+			return models.UserAccount{}, err
+		}
+	}
+	for i := range u.UserPushSubscriptions {
+		sub := &u.UserPushSubscriptions[i]
+		if err := pushSecrets.restore(sub.DestinationURL, sub.Airport, &sub.SigningSecret); err != nil {
+			return models.UserAccount{}, err
+		}
+	}
+	if err := validateUser(u); err != nil {
+		return models.UserAccount{}, err
+	}
+
+	if err := saveUser(u); err != nil {
+		return models.UserAccount{}, err
+	}
+	globals.Logger.Info(fmt.Sprintf("User %s updated", userName))
+
+	return GetUser(userName)
+}
+
+// SetUserEnabled enables or disables the user in the store
+func SetUserEnabled(userName string, enabled bool) (models.UserAccount, error) {
+
+	current, err := managedUser(userName)
+	if err != nil {
+		return models.UserAccount{}, err
+	}
+
+	current.User.Enabled = enabled
+	if err := saveUser(current.User); err != nil {
+		return models.UserAccount{}, err
+	}
+	globals.Logger.Info(fmt.Sprintf("User %s enabled: %t", userName, enabled))
+
+	return GetUser(userName)
+}
+
+// RotateUserKey replaces the key of the user in the store with a new key, which is returned. The new
+// key expires at the given time, or not at all if no time is given
+func RotateUserKey(userName string, keyExpires string) (models.UserAccount, string, error) {
+
+	current, err := managedUser(userName)
+	if err != nil {
+		return models.UserAccount{}, "", err
+	}
+
+	u := current.User
+	u.KeyExpires = keyExpires
+	if err := validateUser(u); err != nil {
+		return models.UserAccount{}, "", err
+	}
+
+	previousPrefix := u.KeyPrefix
+	key, prefix := GenerateAPIKey()
+	u.KeyHash = HashAPIKey(key)
+	u.KeyPrefix = prefix
+
+	if err := saveUser(u); err != nil {
+		return models.UserAccount{}, "", err
+	}
+	globals.Logger.Info(fmt.Sprintf("Key %s of user %s replaced by %s", previousPrefix, userName, prefix))
+
+	account, err := GetUser(userName)
+	return account, key, err
+}
+
+// DeleteUser removes the user and their subscriptions from the stores
+func DeleteUser(userName string) error {
+
+	if _, err := managedUser(userName); err != nil {
+		return err
+	}
+
+	db, _ := getUserDB()
+	if _, err := db.Exec("DELETE FROM users WHERE username = ?", userName); err != nil {
+		return err
+	}
+	if subDB, err := getSubscriptionDB(); err == nil {
+		if _, err := subDB.Exec("DELETE FROM subscriptions WHERE username = ?", userName); err != nil {
+			globals.Logger.Error(fmt.Sprintf("Could not delete the subscriptions of user %s: %s", userName, err))
+		}
+	}
+
+	globals.Logger.Info(fmt.Sprintf("User %s deleted", userName))
+	return userChanged()
+}
+
+func saveUser(u models.UserProfile) error {
+
+	db, _ := getUserDB()
+
+	profile, _ := json.Marshal(u)
+	_, err := db.Exec("UPDATE users SET keyprefix = ?, keyhash = ?, updated = ?, profile = ? WHERE username = ?",
+		u.KeyPrefix, u.KeyHash, time.Now().Format(snapshotTimeLayout), profile, u.UserName)
+	if err != nil {
+		return err
+	}
+	return userChanged()
+}
+
+// userChanged reloads the users in the store and the subscriptions, which depend on the users being enabled
+func userChanged() error {
+	if err := loadManagedUsers(); err != nil {
+		return err
+	}
+	go reloadAllSubscriptions()
+	return nil
+}
+
+func validateUser(u models.UserProfile) error {
+
+	if strings.TrimSpace(u.UserName) == "" {
+		return fmt.Errorf("%w: UserName is required", ErrInvalidUser)
+	}
+	if u.KeyExpires != "" {
+		if _, err := parseKeyExpiry(u.KeyExpires); err != nil {
+			return err
+		}
+	}
+	if u.RateLimitPerSecond < 0 || u.RateLimitBurst < 0 || u.MaxConcurrentRequests < 0 || u.DailyRequestQuota < 0 {
+		return fmt.Errorf("%w: limits can not be negative", ErrInvalidUser)
+	}
+	return nil
+}
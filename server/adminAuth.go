@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Authorization of the admin endpoints. Each route declares the permission it needs and the
+// requirePermission middleware checks that the caller has a role that grants it, then records the
+// action in the audit log.
+//
+// A role in the Roles of a user profile is the name of a role, optionally followed by ":" and the
+// airport it is limited to, for example "operator:APT". A role without an airport applies to all
+// airports. Permissions for an airport are granted by roles for the airport, permissions that are
+// not for an airport only by roles for all airports. The AdminToken from service.json is a superuser
+
+type Permission string
+
+const (
+	PermissionViewMetrics       Permission = "metrics:view"
+	PermissionManageMetrics     Permission = "metrics:manage"
+	PermissionViewDeadLetters   Permission = "deadletters:view"
+	PermissionManageDeadLetters Permission = "deadletters:manage"
+	PermissionOperateAirport    Permission = "airport:operate"
+	PermissionManageUsers       Permission = "users:manage"
+)
+
+const (
+	RoleSuperuser     = "superuser"
+	RoleMetricsReader = "metrics-reader"
+	RoleOperator      = "operator"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleSuperuser:     {PermissionViewMetrics, PermissionManageMetrics, PermissionViewDeadLetters, PermissionManageDeadLetters, PermissionOperateAirport, PermissionManageUsers},
+	RoleMetricsReader: {PermissionViewMetrics, PermissionViewDeadLetters},
+	RoleOperator:      {PermissionViewMetrics, PermissionViewDeadLetters, PermissionManageDeadLetters, PermissionOperateAirport},
+}
+
+// The context key of the caller of an admin endpoint
+const adminCallerKey = "adminCaller"
+
+// Passed as the airport to check a permission for any of the caller's airports
+const anyAirport = "*"
+
+type adminCaller struct {
+	UserName string
+	Source   string
+	Roles    []string
+}
+
+// allows reports whether the caller has a role granting the permission for the airport. An empty
+// airport requires a role for all airports
+func (caller adminCaller) allows(permission Permission, airport string) bool {
+
+	for _, role := range caller.Roles {
+		name, scope, _ := strings.Cut(role, ":")
+
+		granted := false
+		for _, p := range rolePermissions[name] {
+			if p == permission {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			continue
+		}
+
+		if scope == "" || scope == "*" || airport == anyAirport || (airport != "" && scope == airport) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminError aborts the request with the status and a JSON error
+func adminError(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"Error": message})
+}
+
+// authenticateAdmin identifies the caller from the AdminToken, the Token header or a bearer token
+func authenticateAdmin(c *gin.Context) (adminCaller, bool) {
+
+	adminToken := globals.ConfigViper.GetString("AdminToken")
+	token := c.GetHeader("Token")
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return adminCaller{UserName: "admin", Source: "AdminToken", Roles: []string{RoleSuperuser}}, true
+	}
+
+	if !repo.HasCredentials(c) {
+		return adminCaller{}, false
+	}
+	profile := repo.GetUserProfile(c, "")
+	if !profile.Enabled {
+		return adminCaller{}, false
+	}
+
+	source := "Token"
+	if token == "" {
+		source = "Bearer"
+	}
+	return adminCaller{UserName: profile.UserName, Source: source, Roles: profile.Roles}, true
+}
+
+// requirePermission allows the request if the caller has the permission for the airport of the route,
+// given by the "apt" parameter or the "airport" query parameter
+func requirePermission(permission Permission) gin.HandlerFunc {
+	return authorize(permission, false)
+}
+
+// requirePermissionForAnyAirport allows the request if the caller has the permission for any airport.
+// The handler checks the airport with allowedAirport once it is known
+func requirePermissionForAnyAirport(permission Permission) gin.HandlerFunc {
+	return authorize(permission, true)
+}
+
+func authorize(permission Permission, forAnyAirport bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		airport := c.Param("apt")
+		if airport == "" {
+			airport = c.Query("airport")
+		}
+		if forAnyAirport {
+			airport = anyAirport
+		}
+
+		caller, ok := authenticateAdmin(c)
+		if !ok {
+			globals.AuditLogger.Warn(fmt.Sprintf("Denied: unauthenticated IP: %s Action: %s %s", c.RemoteIP(), c.Request.Method, c.Request.RequestURI))
+			adminError(c, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if !caller.allows(permission, airport) {
+			globals.AuditLogger.Warn(fmt.Sprintf("Denied: User: %s Source: %s IP: %s Action: %s %s Permission: %s", caller.UserName, caller.Source, c.RemoteIP(), c.Request.Method, c.Request.RequestURI, permission))
+			adminError(c, http.StatusForbidden, permissionMessage(permission, airport))
+			return
+		}
+
+		globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", caller.UserName, c.RemoteIP(), c.Request.RequestURI))
+		c.Set(adminCallerKey, caller)
+
+		c.Next()
+
+		globals.AuditLogger.Info(fmt.Sprintf("User: %s Source: %s IP: %s Action: %s %s Permission: %s Status: %d", caller.UserName, caller.Source, c.RemoteIP(), c.Request.Method, c.Request.RequestURI, permission, c.Writer.Status()))
+	}
+}
+
+// allowedAirport checks that the caller of a route declared with requirePermissionForAnyAirport has the
+// permission for the airport, aborting the request if not
+func allowedAirport(c *gin.Context, permission Permission, airport string) bool {
+
+	caller := c.MustGet(adminCallerKey).(adminCaller)
+	if !caller.allows(permission, airport) {
+		globals.AuditLogger.Warn(fmt.Sprintf("Denied: User: %s Source: %s IP: %s Action: %s %s Permission: %s Airport: %s", caller.UserName, caller.Source, c.RemoteIP(), c.Request.Method, c.Request.RequestURI, permission, airport))
+		adminError(c, http.StatusForbidden, permissionMessage(permission, airport))
+		return false
+	}
+	return true
+}
+
+func permissionMessage(permission Permission, airport string) string {
+	if airport == "" || airport == anyAirport {
+		return fmt.Sprintf("Not Authorized: %s permission required", permission)
+	}
+	return fmt.Sprintf("Not Authorized: %s permission required for %s", permission, airport)
+}
+
+// routeAirport returns the airport of the route, aborting the request if there is no such airport
+func routeAirport(c *gin.Context) (string, bool) {
+	apt := c.Param("apt")
+	if repo.GetRepo(apt) == nil {
+		adminError(c, http.StatusNotFound, fmt.Sprintf("Airport %s not found", apt))
+		return apt, false
+	}
+	return apt, true
+}
@@ -33,6 +33,7 @@ func StartGinServer(demoMode bool) {
 	gin.SetMode(mode)
 
 	router := gin.New()
+	router.Use(traceRequests, observeRequests)
 
 	// Configure all the endpoints for the HTTP Server
 
@@ -40,34 +41,60 @@ func StartGinServer(demoMode bool) {
 	if globals.ConfigViper.GetBool("TestHTTPServer") {
 		router.POST("/test", testQuery)
 	}
-	router.GET("/getFlights/:apt", repo.GetRequestedFlightsAPI)
-	router.GET("/getAllocations/:apt", repo.GetResourceAPI)
-	router.GET("/getConfiguredResources/:apt/:resourceType", repo.GetConfiguredResources)
-	router.GET("/getConfiguredResources/:apt", repo.GetConfiguredResources)
-
-	router.GET("/admin/reinit/:apt", reinit)
-	router.GET("/admin/stopJobs/:apt/:userToken", stopJobs)
-	router.GET("/admin/stopAllAptJobs/:apt", stopAllAptJobs)
-	router.GET("/admin/rescheduleAllAptJobs/:apt", rescheduleAllAptJobs)
-	router.GET("/admin/repoMetricsReport/:apt", metricsReport)
-	router.GET("/admin/enableMetrics", func(c *gin.Context) {
-		if hasAdminToken(c) {
-			globals.MetricsLogger.SetLevel(logrus.InfoLevel)
-			globals.MetricsLogger.Info("Performance Metrics Reporting Enabled")
-			c.JSON(http.StatusOK, gin.H{"PerformanceMetricsReporting": fmt.Sprintf("Enabled")})
-		} else {
-			c.JSON(http.StatusForbidden, gin.H{"Error": fmt.Sprintf("Not Authorized")})
-		}
-	})
-	router.GET("/admin/disableMetrics", func(c *gin.Context) {
-		if hasAdminToken(c) {
-			globals.MetricsLogger.Info("Performance Metrics Reporting Disabled")
-			globals.MetricsLogger.SetLevel(logrus.ErrorLevel)
-			c.JSON(http.StatusOK, gin.H{"PerformanceMetricsReporting": fmt.Sprintf("Disabledd")})
-		} else {
-			globals.MetricsLogger.Info("Performance Metrics Enabled")
-		}
-	})
+	// The requests of each user are limited by the limits in their profile
+	limited := limitUsage(requestUserProfile, true)
+
+	router.GET("/getFlights/:apt", limited, repo.GetRequestedFlightsAPI)
+	router.GET("/getAllocations/:apt", limited, repo.GetResourceAPI)
+	router.GET("/getConfiguredResources/:apt/:resourceType", limited, repo.GetConfiguredResources)
+	router.GET("/getConfiguredResources/:apt", limited, repo.GetConfiguredResources)
+	router.GET("/getFlightHistory/:apt/:flightId", limited, repo.GetFlightHistoryAPI)
+	router.POST("/notifications/:apt", repo.IngestNotificationAPI)
+	router.GET("/stream/:apt", limitUsage(repo.StreamUserProfile, false), repo.StreamChangesAPI)
+	router.GET("/subscriptions", limited, listSubscriptions)
+	router.POST("/subscriptions/change", limited, createSubscription(repo.ChangeSubscription))
+	router.POST("/subscriptions/push", limited, createSubscription(repo.PushSubscription))
+	router.GET("/subscriptions/:id", limited, getSubscription)
+	router.PUT("/subscriptions/:id", limited, updateSubscription)
+	router.POST("/subscriptions/:id/pause", limited, setSubscriptionEnabled(false))
+	router.POST("/subscriptions/:id/resume", limited, setSubscriptionEnabled(true))
+	router.DELETE("/subscriptions/:id", limited, deleteSubscription)
+
+	// Each admin route declares the permission it requires
+	router.GET("/admin/reinit/:apt", requirePermission(PermissionOperateAirport), reinit)
+	router.GET("/admin/stopJobs/:apt/:userToken", requirePermission(PermissionOperateAirport), stopJobs)
+	router.GET("/admin/stopAllAptJobs/:apt", requirePermission(PermissionOperateAirport), stopAllAptJobs)
+	router.GET("/admin/rescheduleAllAptJobs/:apt", requirePermission(PermissionOperateAirport), rescheduleAllAptJobs)
+	router.GET("/admin/repoMetricsReport/:apt", requirePermission(PermissionViewMetrics), metricsReport)
+	router.GET("/admin/enableMetrics", requirePermission(PermissionManageMetrics), enableMetrics)
+	router.GET("/admin/disableMetrics", requirePermission(PermissionManageMetrics), disableMetrics)
+	if globals.ConfigViper.GetBool("MetricsRequireAuthentication") {
+		router.GET("/metrics", requirePermission(PermissionViewMetrics), metricsHandler())
+	} else {
+		router.GET("/metrics", metricsHandler())
+	}
+	if globals.ConfigViper.GetBool("HealthRequireAuthentication") {
+		router.GET("/healthz", requirePermission(PermissionViewMetrics), healthz)
+		router.GET("/readyz", requirePermission(PermissionViewMetrics), readyz)
+	} else {
+		router.GET("/healthz", healthz)
+		router.GET("/readyz", readyz)
+	}
+	router.GET("/admin/usage", requirePermission(PermissionViewMetrics), listUsage)
+	router.GET("/admin/usage/:name", requirePermission(PermissionViewMetrics), getUsage)
+	router.GET("/admin/deadLetters", requirePermission(PermissionViewDeadLetters), listDeadLetters)
+	router.GET("/admin/deadLetters/:id", requirePermissionForAnyAirport(PermissionViewDeadLetters), getDeadLetter)
+	router.POST("/admin/deadLetters/:id/replay", requirePermissionForAnyAirport(PermissionManageDeadLetters), replayDeadLetter)
+	router.DELETE("/admin/deadLetters/:id", requirePermissionForAnyAirport(PermissionManageDeadLetters), deleteDeadLetter)
+	router.DELETE("/admin/deadLetters", requirePermission(PermissionManageDeadLetters), purgeDeadLetters)
+	router.GET("/admin/users", requirePermission(PermissionManageUsers), listUsers)
+	router.POST("/admin/users", requirePermission(PermissionManageUsers), createUser)
+	router.GET("/admin/users/:name", requirePermission(PermissionManageUsers), getUser)
+	router.PUT("/admin/users/:name", requirePermission(PermissionManageUsers), updateUser)
+	router.POST("/admin/users/:name/enable", requirePermission(PermissionManageUsers), setUserEnabled(true))
+	router.POST("/admin/users/:name/disable", requirePermission(PermissionManageUsers), setUserEnabled(false))
+	router.POST("/admin/users/:name/rotateKey", requirePermission(PermissionManageUsers), rotateUserKey)
+	router.DELETE("/admin/users/:name", requirePermission(PermissionManageUsers), deleteUser)
 	router.GET("/help", func(c *gin.Context) {
 		data, err := os.ReadFile("./help.html")
 		if err != nil {
@@ -145,8 +172,11 @@ func StartGinServer(demoMode bool) {
 	// Start it up with the configured security mode
 	if !globals.ConfigViper.GetBool("UseHTTPS") && !globals.ConfigViper.GetBool("UseHTTPSUntrusted") {
 
-		err := router.Run(globals.ConfigViper.GetString("ServiceIPPort"))
-		if err != nil {
+		server := &http.Server{Addr: globals.ConfigViper.GetString("ServiceIPPort"), Handler: router}
+		shutdownOnCancel(server)
+
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			globals.Logger.Fatal("Unable to start HTTP server.")
 			globals.Wg.Done()
 			os.Exit(2)
@@ -154,9 +184,11 @@ func StartGinServer(demoMode bool) {
 
 	} else if globals.ConfigViper.GetBool("UseHTTPS") && globals.ConfigViper.GetString("KeyFile") != "" && globals.ConfigViper.GetString("CertFile") != "" {
 
-		server := http.Server{Addr: globals.ConfigViper.GetString("ServiceIPPort"), Handler: router}
+		server := &http.Server{Addr: globals.ConfigViper.GetString("ServiceIPPort"), Handler: router}
+		shutdownOnCancel(server)
+
 		err := server.ListenAndServeTLS(globals.ConfigViper.GetString("CertFile"), globals.ConfigViper.GetString("KeyFile"))
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			globals.Logger.Fatal("Unable to start HTTPS server. Likely cause is that the keyFile or certFile were not found")
 			globals.Wg.Done()
 			os.Exit(2)
@@ -199,10 +231,11 @@ func StartGinServer(demoMode bool) {
 		x509Cert, _ := tls.X509KeyPair(certBytes, keyBytes)
 
 		tlsConfig := &tls.Config{Certificates: []tls.Certificate{x509Cert}}
-		server := http.Server{Addr: globals.ConfigViper.GetString("ServiceIPPort"), Handler: router, TLSConfig: tlsConfig}
+		server := &http.Server{Addr: globals.ConfigViper.GetString("ServiceIPPort"), Handler: router, TLSConfig: tlsConfig}
+		shutdownOnCancel(server)
 
 		err := server.ListenAndServeTLS("", "")
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			globals.Logger.Fatal("Unable to start HTTPS server with local certificates and key")
 			globals.Wg.Done()
 			os.Exit(2)
@@ -211,55 +244,63 @@ func StartGinServer(demoMode bool) {
 
 }
 
-func hasAdminToken(c *gin.Context) bool {
-	keys := c.Request.Header["Token"]
-	if keys == nil {
-		return false
-	}
-	if keys[0] == globals.ConfigViper.GetString("AdminToken") {
-		return true
-	} else {
-		return false
-	}
+// shutdownOnCancel stops the server accepting new connections once the lifecycle context is cancelled
+// and waits for the active requests to complete, up to the shutdown deadline
+func shutdownOnCancel(server *http.Server) {
+
+	globals.ShutdownWg.Add(1)
+	go func() {
+		defer globals.ShutdownWg.Done()
+
+		<-globals.Ctx.Done()
+		if err := server.Shutdown(globals.DrainCtx); err != nil {
+			globals.Logger.Error(fmt.Sprintf("HTTP server did not shutdown cleanly: %s", err))
+			return
+		}
+		globals.Logger.Info("HTTP server stopped")
+	}()
 }
 
 func reinit(c *gin.Context) {
 
-	if !hasAdminToken(c) {
-		c.JSON(http.StatusForbidden, gin.H{"Error": fmt.Sprintf("Not Authorized")})
+	apt, ok := routeAirport(c)
+	if !ok {
 		return
-	} else {
-		globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", "admin", c.RemoteIP(), c.Request.RequestURI))
 	}
-
-	apt := c.Param("apt")
 	repo.ReInitAirport(apt)
+	c.JSON(http.StatusOK, gin.H{"Status": fmt.Sprintf("Airport %s reinitialised", apt)})
+}
+
+func enableMetrics(c *gin.Context) {
+	globals.MetricsLogger.SetLevel(logrus.InfoLevel)
+	globals.MetricsLogger.Info("Performance Metrics Reporting Enabled")
+	c.JSON(http.StatusOK, gin.H{"PerformanceMetricsReporting": "Enabled"})
+}
+
+func disableMetrics(c *gin.Context) {
+	globals.MetricsLogger.Info("Performance Metrics Reporting Disabled")
+	globals.MetricsLogger.SetLevel(logrus.ErrorLevel)
+	c.JSON(http.StatusOK, gin.H{"PerformanceMetricsReporting": "Disabled"})
 }
 
 func metricsReport(c *gin.Context) {
-	// Get the profile of the user making the request
 
-	if !hasAdminToken(c) {
-		c.JSON(http.StatusForbidden, gin.H{"Error": fmt.Sprintf("Not Authorized")})
+	apt, ok := routeAirport(c)
+	if !ok {
 		return
-	} else {
-		globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", "admin", c.RemoteIP(), c.Request.RequestURI))
 	}
 
-	apt := c.Param("apt")
-
 	metrics := models.MetricsReport{}
 	metrics.Airport = apt
 
+	amsMetrics := repo.AMSMetrics(apt)
+	pipelineMetrics := repo.NotificationPipelineMetrics()
+	outboxMetrics := repo.ChangePushOutboxMetrics()
+	streamMetrics := repo.ChangeStreamMetrics(apt)
 	repo := repo.GetRepo(apt)
 
-	if repo == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Airport not found")})
-		return
-
-	}
-
-	metrics.NumberOfFlights = (*repo).FlightLinkedList.Len()
+	repo.RLock()
+	metrics.NumberOfFlights = (*repo).FlightList.Len()
 	metrics.NumberOfCheckins = (*repo).CheckInList.Len()
 
 	metrics.NumberOfGates = (*repo).GateList.Len()
@@ -272,6 +313,10 @@ func metricsReport(c *gin.Context) {
 	metrics.NumberOfGateAllocations = (*repo).GateList.NumberOfFlightAllocations()
 	metrics.NumberOfCarouselAllocations = (*repo).CarouselList.NumberOfFlightAllocations()
 	metrics.NumberOfChuteAllocations = (*repo).ChuteList.NumberOfFlightAllocations()
+	metrics.NumberOfDeletedFlightsKept = (*repo).FlightTombstones.Len()
+	repo.RUnlock()
+	metrics.NumberOfStaleUpdatesDropped = repo.StaleUpdatesDropped()
+	metrics.NumberOfStaleDeletesDropped = repo.StaleDeletesDropped()
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -282,55 +327,59 @@ func metricsReport(c *gin.Context) {
 	metrics.MemHeapAllocMB = int(m.HeapAlloc / 1024 / 1024)
 	metrics.MemNumGC = int(m.NumGC)
 
-	c.JSON(http.StatusOK, gin.H{"RepositoryMetrics": metrics})
+	c.JSON(http.StatusOK, gin.H{"RepositoryMetrics": metrics, "AMSMetrics": amsMetrics, "NotificationPipeline": pipelineMetrics, "ChangePushOutbox": outboxMetrics, "ChangeStreams": streamMetrics})
 
 }
 
+// stopJobs removes the scheduled pushes of a user, given by their token or user name
 func stopJobs(c *gin.Context) {
-	// Get the profile of the user making the request
 
-	if !hasAdminToken(c) {
-		c.JSON(http.StatusForbidden, gin.H{"Error": fmt.Sprintf("Not Authorized")})
+	apt, ok := routeAirport(c)
+	if !ok {
 		return
-	} else {
-		globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", "admin", c.RemoteIP(), c.Request.RequestURI))
 	}
-
-	apt := c.Param("apt")
 	userToken := c.Param("userToken")
+
+	// The jobs are tagged with the name of the user, which can also be found from their key
+	tag := userToken
+	if profile := repo.GetUserProfile(nil, userToken); profile.UserName != "" {
+		tag = profile.UserName
+	}
 	s := globals.SchedulerMap[apt]
-	s.RemoveByTag(userToken)
+	if s != nil {
+		s.RemoveByTag(tag)
+	}
 	globals.Logger.Info(fmt.Sprintf("All Aiport Jobs Stopped for %s, user %s", apt, userToken))
+	c.JSON(http.StatusOK, gin.H{"Status": fmt.Sprintf("Scheduled pushes stopped for %s, user %s", apt, userToken)})
 }
 
 func stopAllAptJobs(c *gin.Context) {
 
-	if !hasAdminToken(c) {
-		c.JSON(http.StatusForbidden, gin.H{"Error": fmt.Sprintf("Not Authorized")})
+	apt, ok := routeAirport(c)
+	if !ok {
 		return
-	} else {
-		globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", "admin", c.RemoteIP(), c.Request.RequestURI))
 	}
 
-	apt := c.Param("apt")
-
 	// Get the schedule for the particular airport and clear it
 	s := globals.SchedulerMap[apt]
-	s.Clear()
+	if s != nil {
+		s.Clear()
+	}
 	globals.Logger.Info(fmt.Sprintf("All Aiport Jobs Stopped for %s", apt))
+	c.JSON(http.StatusOK, gin.H{"Status": fmt.Sprintf("All scheduled pushes stopped for %s", apt)})
 }
+
+// rescheduleAllAptJobs replaces the scheduled pushes of the airport with the pushes of the current subscriptions
 func rescheduleAllAptJobs(c *gin.Context) {
-	// if !hasAdminToken(c) {
-	// 	c.JSON(http.StatusForbidden, gin.H{"Error": fmt.Sprintf("Not Authorized")})
-	// 	return
-	// } else {
-	// 	globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", "admin", c.RemoteIP(), c.Request.RequestURI))
-	// }
-	// apt := c.Param("apt")
-
-	// // Reload the schdule of jobs for the airport
-	// push.ReloadschedulePushes(apt)
-	// globals.Logger.Info(fmt.Sprintf("Rescheduled All Aiport Jobs Stopped for %s", apt))
+
+	apt, ok := routeAirport(c)
+	if !ok {
+		return
+	}
+
+	repo.ReschedulePushes(apt)
+	globals.Logger.Info(fmt.Sprintf("Rescheduled All Aiport Jobs for %s", apt))
+	c.JSON(http.StatusOK, gin.H{"Status": fmt.Sprintf("Scheduled pushes rescheduled for %s", apt)})
 }
 
 // Function to just write what was recieved by the server
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"flightresourcerestapi/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin endpoints for the notifications in the dead letter store. The optional "airport" query
+// parameter limits the list and purge to one airport, and is required for callers whose roles are
+// limited to an airport
+
+func deadLetterID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Invalid dead letter id %s", c.Param("id"))})
+		return 0, false
+	}
+	return id, true
+}
+
+func deadLetterError(c *gin.Context, err error) {
+	if err == repo.ErrDeadLetterNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"Error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+}
+
+func listDeadLetters(c *gin.Context) {
+
+	deadLetters, err := repo.ListDeadLetters(c.Query("airport"))
+	if err != nil {
+		deadLetterError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"NumberOfDeadLetters": len(deadLetters), "DeadLetters": deadLetters})
+}
+
+func getDeadLetter(c *gin.Context) {
+
+	id, ok := deadLetterID(c)
+	if !ok {
+		return
+	}
+
+	deadLetter, err := repo.GetDeadLetter(id)
+	if err != nil {
+		deadLetterError(c, err)
+		return
+	}
+	if !allowedAirport(c, PermissionViewDeadLetters, deadLetter.Airport) {
+		return
+	}
+	c.JSON(http.StatusOK, deadLetter)
+}
+
+func replayDeadLetter(c *gin.Context) {
+
+	id, ok := deadLetterID(c)
+	if !ok {
+		return
+	}
+
+	deadLetter, err := repo.GetDeadLetter(id)
+	if err != nil {
+		deadLetterError(c, err)
+		return
+	}
+	if !allowedAirport(c, PermissionManageDeadLetters, deadLetter.Airport) {
+		return
+	}
+	if err := repo.ReplayDeadLetter(id); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"Error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"Status": fmt.Sprintf("Dead letter %d replayed", id)})
+}
+
+func deleteDeadLetter(c *gin.Context) {
+
+	id, ok := deadLetterID(c)
+	if !ok {
+		return
+	}
+
+	deadLetter, err := repo.GetDeadLetter(id)
+	if err != nil {
+		deadLetterError(c, err)
+		return
+	}
+	if !allowedAirport(c, PermissionManageDeadLetters, deadLetter.Airport) {
+		return
+	}
+	if err := repo.DeleteDeadLetter(id); err != nil {
+		deadLetterError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"Status": fmt.Sprintf("Dead letter %d deleted", id)})
+}
+
+func purgeDeadLetters(c *gin.Context) {
+
+	n, err := repo.PurgeDeadLetters(c.Query("airport"))
+	if err != nil {
+		deadLetterError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"Status": fmt.Sprintf("%d dead letters purged", n)})
+}
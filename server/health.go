@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthz reports the status of the components of each airport. It fails only when the service is
+// stopping, so a monitor restarts the service only if it can no longer handle requests
+func healthz(c *gin.Context) {
+	report := repo.HealthReport()
+	status := http.StatusOK
+	if globals.Ctx.Err() != nil {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
+
+// readyz fails until every airport has been loaded from AMS, so a load balancer only sends requests
+// once the flights can be served
+func readyz(c *gin.Context) {
+	report := repo.HealthReport()
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
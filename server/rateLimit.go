@@ -0,0 +1,245 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits on the use of the API by each user, set in their profile. RateLimitPerSecond and RateLimitBurst
+// limit the rate of requests with a token bucket, MaxConcurrentRequests the requests being handled at the
+// same time and DailyRequestQuota the requests in a day, local time. A limit of zero is not applied.
+// Usage is kept in memory, so the daily quotas start again when the service is restarted. The usage of
+// users idle since the previous day is discarded at the first request of each day
+
+const (
+	rateLimitLimitHeader     = "X-RateLimit-Limit"
+	rateLimitRemainingHeader = "X-RateLimit-Remaining"
+	rateLimitResetHeader     = "X-RateLimit-Reset"
+	quotaLimitHeader         = "X-Quota-Limit"
+	quotaRemainingHeader     = "X-Quota-Remaining"
+	quotaResetHeader         = "X-Quota-Reset"
+)
+
+type userUsage struct {
+	profile            models.UserProfile
+	tokens             float64
+	refilled           time.Time
+	concurrent         int
+	day                string
+	today              int
+	total              int64
+	rateLimited        int64
+	concurrencyLimited int64
+	quotaExceeded      int64
+	lastRequest        time.Time
+}
+
+var usage = make(map[string]*userUsage)
+var usageMutex sync.Mutex
+
+// The day the idle users were last removed from the usage, guarded by usageMutex
+var usageSweptDay string
+
+// requestUserProfile returns the profile of the user making a request to the API
+func requestUserProfile(c *gin.Context) models.UserProfile {
+	return repo.GetUserProfile(c, "")
+}
+
+// limitUsage rejects the request with 429 if it would exceed a limit of the user. Requests that hold
+// their connection open, like streams, can be left out of the concurrent requests
+func limitUsage(profileFor func(*gin.Context) models.UserProfile, countConcurrent bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// Users that are not enabled are rejected by the handler
+		profile := profileFor(c)
+		if !profile.Enabled {
+			c.Next()
+			return
+		}
+
+		if message, retryAfter := acquireUsage(profile, countConcurrent, c.Writer.Header()); message != "" {
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"Error": message})
+			return
+		}
+		if countConcurrent {
+			defer releaseUsage(profile.UserName)
+		}
+
+		c.Next()
+	}
+}
+
+// acquireUsage records the request if it is within the limits of the user and sets the limit headers.
+// Otherwise it returns why the request is rejected and the seconds after which it can be retried
+func acquireUsage(profile models.UserProfile, countConcurrent bool, header http.Header) (string, int) {
+
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	now := time.Now()
+	if day := now.Format("2006-01-02"); usageSweptDay != day {
+		usageSweptDay = day
+		sweepUsage(now)
+	}
+
+	u := usage[profile.UserName]
+	if u == nil {
+		u = &userUsage{tokens: float64(rateLimitBurst(profile)), refilled: now}
+		usage[profile.UserName] = u
+	}
+	u.profile = profile
+	u.refill(now)
+
+	if day := now.Format("2006-01-02"); u.day != day {
+		u.day = day
+		u.today = 0
+	}
+
+	if profile.DailyRequestQuota > 0 {
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		untilMidnight := int(math.Ceil(midnight.Sub(now).Seconds()))
+		header.Set(quotaLimitHeader, strconv.Itoa(profile.DailyRequestQuota))
+		header.Set(quotaResetHeader, strconv.Itoa(untilMidnight))
+
+		if u.today >= profile.DailyRequestQuota {
+			header.Set(quotaRemainingHeader, "0")
+			u.quotaExceeded++
+			return "Daily request quota exceeded", untilMidnight
+		}
+		header.Set(quotaRemainingHeader, strconv.Itoa(profile.DailyRequestQuota-u.today))
+	}
+
+	if countConcurrent && profile.MaxConcurrentRequests > 0 && u.concurrent >= profile.MaxConcurrentRequests {
+		u.concurrencyLimited++
+		return "Too many concurrent requests", 1
+	}
+
+	if rate := profile.RateLimitPerSecond; rate > 0 {
+		burst := rateLimitBurst(profile)
+		header.Set(rateLimitLimitHeader, strconv.Itoa(burst))
+
+		if u.tokens < 1 {
+			header.Set(rateLimitRemainingHeader, "0")
+			header.Set(rateLimitResetHeader, strconv.Itoa(int(math.Ceil((float64(burst)-u.tokens)/rate))))
+			u.rateLimited++
+			return "Rate limit exceeded", int(math.Ceil((1 - u.tokens) / rate))
+		}
+		u.tokens--
+		header.Set(rateLimitRemainingHeader, strconv.Itoa(int(u.tokens)))
+		header.Set(rateLimitResetHeader, strconv.Itoa(int(math.Ceil((float64(burst)-u.tokens)/rate))))
+	}
+
+	if profile.DailyRequestQuota > 0 {
+		header.Set(quotaRemainingHeader, strconv.Itoa(profile.DailyRequestQuota-u.today-1))
+	}
+	u.today++
+	u.total++
+	u.lastRequest = now
+	if countConcurrent {
+		u.concurrent++
+	}
+	return "", 0
+}
+
+func releaseUsage(userName string) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	if u := usage[userName]; u != nil && u.concurrent > 0 {
+		u.concurrent--
+	}
+}
+
+// sweepUsage removes the users that have made no requests today or yesterday, have none in progress and
+// have a full token bucket, so their usage has no effect on the limits. Called with usageMutex held
+func sweepUsage(now time.Time) {
+	day, yesterday := now.Format("2006-01-02"), now.AddDate(0, 0, -1).Format("2006-01-02")
+	for userName, u := range usage {
+		u.refill(now)
+		if u.day != day && u.day != yesterday && u.concurrent == 0 && (u.profile.RateLimitPerSecond <= 0 || u.tokens >= float64(rateLimitBurst(u.profile))) {
+			delete(usage, userName)
+		}
+	}
+}
+
+// refill adds the tokens for the time since the bucket was last refilled
+func (u *userUsage) refill(now time.Time) {
+	if rate := u.profile.RateLimitPerSecond; rate > 0 {
+		u.tokens = math.Min(float64(rateLimitBurst(u.profile)), u.tokens+now.Sub(u.refilled).Seconds()*rate)
+	}
+	u.refilled = now
+}
+
+// rateLimitBurst returns the requests that can be made at once, by default the requests allowed in a second
+func rateLimitBurst(profile models.UserProfile) int {
+	if profile.RateLimitBurst > 0 {
+		return profile.RateLimitBurst
+	}
+	return int(math.Max(1, math.Ceil(profile.RateLimitPerSecond)))
+}
+
+func (u *userUsage) report(userName string) models.UserUsage {
+
+	u.refill(time.Now())
+
+	report := models.UserUsage{
+		UserName:              userName,
+		RateLimitPerSecond:    u.profile.RateLimitPerSecond,
+		MaxConcurrentRequests: u.profile.MaxConcurrentRequests,
+		ConcurrentRequests:    u.concurrent,
+		DailyRequestQuota:     u.profile.DailyRequestQuota,
+		TotalRequests:         u.total,
+		RateLimited:           u.rateLimited,
+		ConcurrencyLimited:    u.concurrencyLimited,
+		QuotaExceeded:         u.quotaExceeded,
+	}
+	if u.profile.RateLimitPerSecond > 0 {
+		report.RateLimitBurst = rateLimitBurst(u.profile)
+		report.TokensAvailable = math.Floor(u.tokens*100) / 100
+	}
+	if u.day == time.Now().Format("2006-01-02") {
+		report.RequestsToday = u.today
+	}
+	if !u.lastRequest.IsZero() {
+		lastRequest := u.lastRequest
+		report.LastRequest = &lastRequest
+	}
+	return report
+}
+
+// listUsage returns the usage of the users that have made requests recently
+func listUsage(c *gin.Context) {
+
+	usageMutex.Lock()
+	reports := []models.UserUsage{}
+	for userName, u := range usage {
+		reports = append(reports, u.report(userName))
+	}
+	usageMutex.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].UserName < reports[j].UserName })
+	c.JSON(http.StatusOK, gin.H{"NumberOfUsers": len(reports), "Usage": reports})
+}
+
+func getUsage(c *gin.Context) {
+
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	u := usage[c.Param("name")]
+	if u == nil {
+		c.JSON(http.StatusNotFound, gin.H{"Error": fmt.Sprintf("No requests from user %s", c.Param("name"))})
+		return
+	}
+	c.JSON(http.StatusOK, u.report(c.Param("name")))
+}
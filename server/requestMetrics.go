@@ -0,0 +1,47 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"flightresourcerestapi/monitoring"
+	"flightresourcerestapi/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// observeRequests records the duration of each request by route and counts the requests of each user.
+// Streams are left out as they last as long as the client stays connected
+func observeRequests(c *gin.Context) {
+
+	if c.FullPath() == "/stream/:apt" {
+		c.Next()
+		return
+	}
+
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	monitoring.RequestDuration.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	monitoring.UserRequests.WithLabelValues(requestUserName(c)).Inc()
+}
+
+// requestUserName returns the user the request was made as, or "anonymous" if it was not authenticated
+func requestUserName(c *gin.Context) string {
+	if caller, ok := c.Get(adminCallerKey); ok {
+		return caller.(adminCaller).UserName
+	}
+	if userName := repo.RequestUserName(c); userName != "" {
+		return userName
+	}
+	return "anonymous"
+}
+
+// metricsHandler serves the Prometheus metrics
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(monitoring.Handler())
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"flightresourcerestapi/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRequests records a span for each request, in the trace of the caller if the request carries a
+// trace context. Streams are left out as they last as long as the client stays connected
+func traceRequests(c *gin.Context) {
+
+	route := c.FullPath()
+	if route == "/stream/:apt" {
+		c.Next()
+		return
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+
+	ctx := tracing.Extract(c.Request.Context(), c.Request.Header)
+	ctx, span := tracing.StartSpan(ctx, fmt.Sprintf("%s %s", c.Request.Method, route), trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.request.method", c.Request.Method), attribute.String("http.route", route),
+			attribute.String("url.path", c.Request.URL.Path), attribute.String("client.address", c.ClientIP())))
+	defer span.End()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status), attribute.String("user", requestUserName(c)))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"flightresourcerestapi/globals"
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Endpoints for users to manage their own change and push subscriptions. The user is identified by the
+// "Token" header or a bearer token, which must be given. Subscriptions from users.json are listed but can
+// not be changed
+
+// The value returned in place of a signing secret. Sending it back in an update keeps the secret
+const maskedSigningSecret = repo.MaskedSigningSecret
+
+func authorizeUser(c *gin.Context) (models.UserProfile, bool) {
+
+	if !repo.HasCredentials(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"Error": "Token header or bearer token required"})
+		return models.UserProfile{}, false
+	}
+
+	userProfile := repo.GetUserProfile(c, "")
+	if !userProfile.Enabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"Error": "User Access Has Been Disabled"})
+		return userProfile, false
+	}
+
+	globals.RequestLogger.Info(fmt.Sprintf("User: %s IP: %s Request:%s", userProfile.UserName, c.RemoteIP(), c.Request.RequestURI))
+	return userProfile, true
+}
+
+// authorizeSubscriptionChange authorizes a user to create or change subscriptions. Clients that only
+// have the profile of their role have no user to hold the subscriptions, so they would never be sent
+func authorizeSubscriptionChange(c *gin.Context) (models.UserProfile, bool) {
+
+	userProfile, ok := authorizeUser(c)
+	if !ok {
+		return userProfile, false
+	}
+	if userProfile.RoleMapped {
+		c.JSON(http.StatusForbidden, gin.H{"Error": "Subscriptions can only be managed by clients with a user. Set the ClientID of a user to the client ID of the token"})
+		return userProfile, false
+	}
+	return userProfile, true
+}
+
+func subscriptionID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Invalid subscription id %s", c.Param("id"))})
+		return 0, false
+	}
+	return id, true
+}
+
+func subscriptionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, repo.ErrSubscriptionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"Error": err.Error()})
+	case errors.Is(err, repo.ErrInvalidSubscription):
+		c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+	}
+}
+
+// maskSubscription hides the signing secret of the subscription
+func maskSubscription(sub models.Subscription) models.Subscription {
+	if sub.Change != nil && sub.Change.SigningSecret != "" {
+		change := *sub.Change
+		change.SigningSecret = maskedSigningSecret
+		sub.Change = &change
+	}
+	if sub.Push != nil && sub.Push.SigningSecret != "" {
+		push := *sub.Push
+		push.SigningSecret = maskedSigningSecret
+		sub.Push = &push
+	}
+	return sub
+}
+
+// bindSubscription reads the definition of the subscription from the body onto the fields of sub,
+// so fields that are not given keep their values
+func bindSubscription(c *gin.Context, sub *models.Subscription) bool {
+
+	var err error
+	if sub.Type == repo.PushSubscription {
+		secret := sub.Push.SigningSecret
+		err = c.ShouldBindJSON(sub.Push)
+		if sub.Push.SigningSecret == maskedSigningSecret {
+			sub.Push.SigningSecret = secret
+		}
+	} else {
+		secret := sub.Change.SigningSecret
+		err = c.ShouldBindJSON(sub.Change)
+		if sub.Change.SigningSecret == maskedSigningSecret {
+			sub.Change.SigningSecret = secret
+		}
+	}
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Invalid subscription: %s", err)})
+		return false
+	}
+	return true
+}
+
+func listSubscriptions(c *gin.Context) {
+
+	user, ok := authorizeUser(c)
+	if !ok {
+		return
+	}
+
+	subscriptions, err := repo.ListSubscriptions(user)
+	if err != nil {
+		subscriptionError(c, err)
+		return
+	}
+	for i := range subscriptions {
+		subscriptions[i] = maskSubscription(subscriptions[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"NumberOfSubscriptions": len(subscriptions), "Subscriptions": subscriptions})
+}
+
+func getSubscription(c *gin.Context) {
+
+	user, ok := authorizeUser(c)
+	if !ok {
+		return
+	}
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+
+	sub, err := repo.GetSubscription(user, id)
+	if err != nil {
+		subscriptionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, maskSubscription(sub))
+}
+
+// createSubscription creates a subscription of the type. New subscriptions are enabled unless the
+// definition sets Enabled to false
+func createSubscription(subscriptionType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		user, ok := authorizeSubscriptionChange(c)
+		if !ok {
+			return
+		}
+
+		sub := models.Subscription{Type: subscriptionType}
+		if subscriptionType == repo.PushSubscription {
+			sub.Push = &models.UserPushSubscription{Enabled: true}
+		} else {
+			sub.Change = &models.UserChangeSubscription{Enabled: true}
+		}
+		if !bindSubscription(c, &sub) {
+			return
+		}
+
+		sub, err := repo.CreateSubscription(user, sub)
+		if err != nil {
+			subscriptionError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, maskSubscription(sub))
+	}
+}
+
+// updateSubscription changes the fields of the subscription given in the body
+func updateSubscription(c *gin.Context) {
+
+	user, ok := authorizeSubscriptionChange(c)
+	if !ok {
+		return
+	}
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+
+	sub, err := repo.GetSubscription(user, id)
+	if err != nil {
+		subscriptionError(c, err)
+		return
+	}
+	if !bindSubscription(c, &sub) {
+		return
+	}
+
+	sub, err = repo.UpdateSubscription(user, id, sub)
+	if err != nil {
+		subscriptionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, maskSubscription(sub))
+}
+
+// setSubscriptionEnabled pauses or resumes the subscription
+func setSubscriptionEnabled(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		user, ok := authorizeSubscriptionChange(c)
+		if !ok {
+			return
+		}
+		id, ok := subscriptionID(c)
+		if !ok {
+			return
+		}
+
+		sub, err := repo.SetSubscriptionEnabled(user, id, enabled)
+		if err != nil {
+			subscriptionError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, maskSubscription(sub))
+	}
+}
+
+func deleteSubscription(c *gin.Context) {
+
+	user, ok := authorizeSubscriptionChange(c)
+	if !ok {
+		return
+	}
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+
+	if err := repo.DeleteSubscription(user, id); err != nil {
+		subscriptionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"Status": fmt.Sprintf("Subscription %d deleted", id)})
+}
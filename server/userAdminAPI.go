@@ -0,0 +1,150 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"flightresourcerestapi/models"
+	"flightresourcerestapi/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin endpoints to manage the users in the user store. The users in users.json are listed but can
+// only be changed by editing the file. A user's key is only returned when it is created
+
+const keyShownOnceWarning = "The key is not stored and can not be shown again"
+
+func userError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, repo.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"Error": err.Error()})
+	case errors.Is(err, repo.ErrUserInConfig):
+		c.JSON(http.StatusConflict, gin.H{"Error": err.Error()})
+	case errors.Is(err, repo.ErrInvalidUser):
+		c.JSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"Error": err.Error()})
+	}
+}
+
+func listUsers(c *gin.Context) {
+
+	users, err := repo.ListUsers()
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"NumberOfUsers": len(users), "Users": users})
+}
+
+func getUser(c *gin.Context) {
+
+	user, err := repo.GetUser(c.Param("name"))
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// createUser creates the user with a new key. The user is enabled unless the profile sets Enabled to false
+func createUser(c *gin.Context) {
+
+	profile := models.UserProfile{Enabled: true}
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Invalid user: %s", err)})
+		return
+	}
+	if !validRoles(c, profile.Roles) {
+		return
+	}
+
+	user, key, err := repo.CreateUser(profile)
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"User": user, "Key": key, "Warning": keyShownOnceWarning})
+}
+
+// updateUser changes the fields of the user's profile that are given in the body
+func updateUser(c *gin.Context) {
+
+	current, err := repo.GetUser(c.Param("name"))
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	profile := current.User
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Invalid user: %s", err)})
+		return
+	}
+	if !validRoles(c, profile.Roles) {
+		return
+	}
+
+	user, err := repo.UpdateUser(c.Param("name"), profile)
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+func setUserEnabled(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		user, err := repo.SetUserEnabled(c.Param("name"), enabled)
+		if err != nil {
+			userError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, user)
+	}
+}
+
+// rotateUserKey replaces the user's key. The optional KeyExpires in the body sets the expiry of the new key
+func rotateUserKey(c *gin.Context) {
+
+	var body struct {
+		KeyExpires string
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Invalid request: %s", err)})
+			return
+		}
+	}
+
+	user, key, err := repo.RotateUserKey(c.Param("name"), body.KeyExpires)
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"User": user, "Key": key, "Warning": keyShownOnceWarning})
+}
+
+func deleteUser(c *gin.Context) {
+
+	if err := repo.DeleteUser(c.Param("name")); err != nil {
+		userError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"Status": fmt.Sprintf("User %s deleted", c.Param("name"))})
+}
+
+// validRoles checks that the roles are admin roles, so a mistyped role is not silently ignored
+func validRoles(c *gin.Context, roles []string) bool {
+	for _, role := range roles {
+		name, _, _ := strings.Cut(role, ":")
+		if _, ok := rolePermissions[name]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Invalid user: unknown role %s", role)})
+			return false
+		}
+	}
+	return true
+}
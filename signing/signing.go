@@ -0,0 +1,122 @@
+package signing
+
+/*
+
+Signing of the change and scheduled pushes sent by the service, and verification for the receivers.
+
+Every push carries a unique delivery ID in the X-FRAPI-Delivery-ID header. A change push keeps the
+same delivery ID when it is retried so receivers can discard duplicates. Pushes for a subscription with
+a SigningSecret are also signed. The X-FRAPI-Timestamp header is the time the request was sent in Unix
+seconds and X-FRAPI-Signature is "sha256=" followed by the hex HMAC-SHA256, keyed with the secret, of
+
+	{timestamp}.{delivery ID}.{body}
+
+A receiver verifies a push with
+
+	body, err := signing.VerifyRequest(r, secret, signing.DefaultTolerance)
+
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DeliveryIDHeader = "X-FRAPI-Delivery-ID"
+	TimestampHeader  = "X-FRAPI-Timestamp"
+	SignatureHeader  = "X-FRAPI-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+// DefaultTolerance is the difference allowed between the timestamp of a push and the clock of the receiver
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	ErrMissingSignature = errors.New("the request is not signed")
+	ErrInvalidSignature = errors.New("the signature does not match")
+	ErrExpiredTimestamp = errors.New("the timestamp is outside the tolerance")
+)
+
+// NewDeliveryID returns a random version 4 UUID
+func NewDeliveryID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Signature returns the value of the signature header for the body sent at the timestamp
+func Signature(secret, timestamp, deliveryID string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write([]byte(deliveryID))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the delivery ID header of the request and, if there is a secret, the timestamp
+// and signature headers. The body must be the body of the request
+func SignRequest(req *http.Request, secret, deliveryID string, body []byte) {
+
+	req.Header.Set(DeliveryIDHeader, deliveryID)
+	if secret == "" {
+		return
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Signature(secret, timestamp, deliveryID, body))
+}
+
+// Verify checks the signature headers against the body. The timestamp must be within the tolerance
+// of the current time
+func Verify(header http.Header, body []byte, secret string, tolerance time.Duration) error {
+
+	signature := header.Get(SignatureHeader)
+	timestamp := header.Get(TimestampHeader)
+	if signature == "" || timestamp == "" {
+		return ErrMissingSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return ErrExpiredTimestamp
+	}
+
+	expected := Signature(secret, timestamp, header.Get(DeliveryIDHeader), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyRequest reads the body of the request and checks its signature. The body is returned and
+// also left in the request so it can be read again
+func VerifyRequest(r *http.Request, secret string, tolerance time.Duration) ([]byte, error) {
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, Verify(r.Header, body, secret, tolerance)
+}
@@ -0,0 +1,230 @@
+package tracing
+
+/*
+
+OpenTelemetry tracing of the path of a notification through the service, from its receipt by a
+listener to the change pushes it causes, and of the API requests.
+
+Spans are exported by OTLP over HTTP to a collector, written as JSON lines to stdout or a file for
+offline use, or not recorded at all, which is the default. The W3C trace context is taken from the
+headers of incoming requests and notifications and added to the headers of outgoing pushes, so a
+push can be followed from the AMS message that caused it to the partner that received it
+
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+const instrumentationName = "flightresourcerestapi"
+
+// The time allowed to export the spans that have not been sent when the service stops
+const shutdownTimeout = 5 * time.Second
+
+// Config selects the exporter of the spans and how many traces are recorded
+type Config struct {
+	Exporter    string
+	ServiceName string
+	Version     string
+
+	// The host and port, or URL, of the OTLP/HTTP receiver of the collector. Insecure sends the
+	// spans over HTTP rather than HTTPS
+	OTLPEndpoint string
+	OTLPInsecure bool
+	OTLPHeaders  map[string]string
+
+	// The file the spans are written to by the file exporter
+	File io.Writer
+
+	// The fraction of the traces started by the service that are recorded. Traces started by a
+	// caller are recorded if the caller recorded them
+	SampleRatio float64
+}
+
+var provider *sdktrace.TracerProvider
+var providerMutex sync.Mutex
+
+func init() {
+	// Trace context is propagated even when the spans of the service are not recorded
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Start sets up the exporter of the spans. Nothing is recorded if the exporter is none or not given
+func Start(config Config) error {
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch strings.ToLower(config.Exporter) {
+	case "", ExporterNone:
+		return nil
+	case ExporterOTLP:
+		exporter, err = newOTLPExporter(config)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		if config.File == nil {
+			return fmt.Errorf("no file for the %s trace exporter", ExporterFile)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(config.File))
+	default:
+		return fmt.Errorf("unknown trace exporter \"%s\". Use %s, %s, %s or %s", config.Exporter, ExporterOTLP, ExporterStdout, ExporterFile, ExporterNone)
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", config.ServiceName),
+		attribute.String("service.version", config.Version),
+	))
+	if err != nil {
+		return err
+	}
+
+	ratio := config.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	return nil
+}
+
+func newOTLPExporter(config Config) (sdktrace.SpanExporter, error) {
+
+	options := []otlptracehttp.Option{}
+	if strings.Contains(config.OTLPEndpoint, "://") {
+		options = append(options, otlptracehttp.WithEndpointURL(config.OTLPEndpoint))
+	} else if config.OTLPEndpoint != "" {
+		options = append(options, otlptracehttp.WithEndpoint(config.OTLPEndpoint))
+	}
+	if config.OTLPInsecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if len(config.OTLPHeaders) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(config.OTLPHeaders))
+	}
+
+	// The exporter connects when it first sends spans, so this does not wait for the collector
+	return otlptracehttp.New(context.Background(), options...)
+}
+
+// Shutdown exports the spans that have not been sent and stops recording
+func Shutdown() {
+
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+
+	if provider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	provider.Shutdown(ctx)
+	provider = nil
+}
+
+// StartSpan starts a span in the trace of the context, or a new trace if the context is nil
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records the error, if any, on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Detach returns a context in the trace of ctx that is not cancelled with ctx, for work that carries
+// on after the request that started it has finished
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// Extract returns the context of the trace in the headers, if any
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// ExtractMap returns the context of the trace in the values, if any
+func ExtractMap(ctx context.Context, values map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(values))
+}
+
+// Inject adds the trace context of ctx to the headers
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Encode returns the trace context of ctx as a string to be stored with work done later, or "" if
+// there is no trace
+func Encode(ctx context.Context) string {
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return ""
+	}
+
+	data, err := json.Marshal(carrier)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Decode returns a context in the trace stored by Encode
+func Decode(encoded string) context.Context {
+
+	ctx := context.Background()
+	if encoded == "" {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{}
+	if err := json.Unmarshal([]byte(encoded), &carrier); err != nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}